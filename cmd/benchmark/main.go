@@ -89,6 +89,8 @@ func RangeScanBenchTest(gcInterval, ttl, flushInterval, testDuration time.Durati
 
 	// 5. Print Custom Global Stats
 	fmt.Printf(" I = %d M=%d\n", globalInsertCounter.Load(), globalMissCounter.Load())
+	cacheStats := kvStore.BlockCacheStats()
+	fmt.Printf(" Block Cache Hits = %d Misses = %d\n", cacheStats.Hits, cacheStats.Misses)
 
 	// 6. Reset Counters & Stats
 	globalInsertCounter.Store(0)
@@ -114,7 +116,10 @@ func SingleWriter(keyRange int64, kvStore kv.KV, ctx context.Context) {
 				key := fmt.Sprintf("%16d", kg.Next(randSeq))
 				rand.Read(val)
 
-				kvStore.Put(key, val)
+				if err := kvStore.Put(key, val); err != nil {
+					// closed at the end of the run
+					return
+				}
 
 				globalInsertCounter.Add(1)
 			}
@@ -139,7 +144,10 @@ func MultiReader(kvStore kv.KV, tableName string, keyRange int64, scanWidth, thr
 			count = scanWidth
 		}
 
-		records := kvStore.Scan(key, count, time.Now())
+		records, err := kvStore.Scan(key, count, time.Now())
+		if err != nil {
+			panic(err)
+		}
 		if len(records) != count {
 			globalMissCounter.Add(1)
 		}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"unsafe"
 )
 
@@ -16,7 +19,9 @@ type IClient interface {
 	Put(k string, v []byte)
 	Get(key string) []byte
 	Scan(lKey string, count int) [][]byte
+	ScanBounded(lKey string, count int, endKey, prefix string) [][]byte
 	Delete(k string)
+	Watch(prefix string, fn func(event, data string) bool)
 	Close()
 }
 
@@ -42,7 +47,19 @@ func (c *Client) Get(key string) []byte {
 }
 
 func (c *Client) Scan(lKey string, count int) [][]byte {
-	req, _ := http.NewRequest(http.MethodGet, baseURL+"/scan/"+lKey+"/"+fmt.Sprint(count), nil)
+	return c.ScanBounded(lKey, count, "", "")
+}
+
+// ScanBounded is Scan stopping before endKey and within prefix, if not empty.
+func (c *Client) ScanBounded(lKey string, count int, endKey, prefix string) [][]byte {
+	query := url.Values{}
+	if endKey != "" {
+		query.Set("end", endKey)
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	req, _ := http.NewRequest(http.MethodGet, baseURL+"/scan/"+lKey+"/"+fmt.Sprint(count)+"?"+query.Encode(), nil)
 	bodyBytes := readBytes(c, req)
 
 	var res [][]byte
@@ -64,6 +81,32 @@ func (c *Client) Delete(k string) {
 	readBytes(c, req)
 }
 
+// Watch calls fn on the server-sent events of the mutations of the keys within prefix,
+// committed from now on, until fn returns false. data is the JSON of the event.
+func (c *Client) Watch(prefix string, fn func(event, data string) bool) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	resp, err := c.client.Get(baseURL + "/watch?" + query.Encode())
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = line[len("event:"):]
+		case strings.HasPrefix(line, "data:"):
+			if !fn(event, line[len("data:"):]) {
+				return
+			}
+		}
+	}
+}
+
 func (c *Client) Close() {
 	c.client.CloseIdleConnections()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/dborchard/cometkv/pkg/kv"
 	"github.com/dborchard/cometkv/pkg/memtable"
@@ -17,48 +18,127 @@ import (
 
 func main() {
 	memTableType := memtable.HWTBTree
-	gcInterval := 30 * time.Second   // 5sec, 30sec, 1m
-	ttl := 3 * time.Minute           // 3min
-	flushInterval := 1 * time.Minute // 1min
+	dataDir := "data"
 
-	kvStore := kv.NewCometKV(context.Background(), memTableType, sst.MBtree, gcInterval, ttl, flushInterval)
+	opts := kv.DefaultOptions()
+	opts.MemtableType = memTableType
+	opts.SstType = sst.Disk
+	opts.GcInterval = 30 * time.Second   // 5sec, 30sec, 1m
+	opts.TTL = 3 * time.Minute           // 3min
+	opts.FlushInterval = 1 * time.Minute // 1min
+	opts.OnBackgroundError = func(err error) {
+		fmt.Println(err)
+	}
+
+	kvStore, err := kv.Open(context.Background(), dataDir, opts)
+	if err != nil {
+		panic(err)
+	}
 
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.POST("/put/:key", func(c *gin.Context) {
 		key := c.Param("key")
 		byteBody, _ := io.ReadAll(c.Request.Body)
-		kvStore.Put(key, byteBody)
+		if err := kvStore.Put(key, byteBody); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.Data(http.StatusOK, "application/octet-stream", nil)
 	})
 
 	r.GET("/get/:key", func(c *gin.Context) {
 		key := c.Param("key")
-		byteBody := kvStore.Get(key, time.Now())
+		byteBody, _, err := kvStore.Get(key, time.Now())
+		if errors.Is(err, kv.ErrNotFound) {
+			c.Data(http.StatusNotFound, "application/octet-stream", nil)
+			return
+		} else if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.Data(http.StatusOK, "application/octet-stream", byteBody)
 	})
 
+	// Optional query parameters: end, the exclusive end key, and prefix.
 	r.GET("/scan/:key/:count", func(c *gin.Context) {
 		key := c.Param("key")
 		count, _ := strconv.Atoi(c.Param("count"))
-		items := kvStore.Scan(key, count, time.Now())
+		items, err := kvStore.Scan(key, count, time.Now(), scanOptions(c)...)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		output := ListToByteArray(items, count)
 		c.Data(http.StatusOK, "application/octet-stream", output)
 	})
 
 	r.DELETE("/delete/:key", func(c *gin.Context) {
 		key := c.Param("key")
-		kvStore.Delete(key)
+		if err := kvStore.Delete(key); err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.Data(http.StatusOK, "application/octet-stream", nil)
 	})
 
+	// Streams the mutations committed after from, in unix nanoseconds, as server-sent
+	// events. Optional query parameters: from, now by default, start, end and prefix.
+	r.GET("/watch", func(c *gin.Context) {
+		from := time.Now()
+		if ts, err := strconv.ParseInt(c.Query("from"), 10, 64); err == nil {
+			from = time.Unix(0, ts)
+		}
+		w, err := kvStore.Watch(c.Request.Context(), c.Query("start"), from, scanOptions(c)...)
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer w.Close()
+
+		c.Stream(func(io.Writer) bool {
+			e, ok := <-w.Events()
+			if !ok {
+				return false
+			}
+			c.SSEvent(eventNames[e.Typ], watchEvent{Key: e.Key, End: e.End, Val: e.Val, Ts: e.Ts.UnixNano()})
+			return true
+		})
+	})
+
 	fmt.Println("Started Server with", memTableType)
-	err := r.Run()
+	err = r.Run()
 	if err != nil {
 		panic(err)
 	}
 }
 
+// scanOptions reads the end and prefix query parameters.
+func scanOptions(c *gin.Context) []kv.ScanOption {
+	var opts []kv.ScanOption
+	if end := c.Query("end"); end != "" {
+		opts = append(opts, kv.WithEndKey(end))
+	}
+	if prefix := c.Query("prefix"); prefix != "" {
+		opts = append(opts, kv.WithPrefix(prefix))
+	}
+	return opts
+}
+
+var eventNames = map[kv.EventType]string{
+	kv.EventPut:         "put",
+	kv.EventDelete:      "delete",
+	kv.EventDeleteRange: "delete_range",
+}
+
+// watchEvent is the JSON data of a server-sent event. Val is base64 encoded.
+type watchEvent struct {
+	Key string `json:"key"`
+	End string `json:"end,omitempty"`
+	Val []byte `json:"val,omitempty"`
+	Ts  int64  `json:"ts"`
+}
+
 func ListToByteArray(items []common.Pair[string, []byte], count int) []byte {
 	var output []byte
 
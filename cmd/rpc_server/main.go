@@ -1 +1,173 @@
-package rpc_server
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/kv"
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/sst"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+func main() {
+	memTableType := memtable.HWTBTree
+	dataDir := "data"
+
+	opts := kv.DefaultOptions()
+	opts.MemtableType = memTableType
+	opts.SstType = sst.Disk
+	opts.GcInterval = 30 * time.Second   // 5sec, 30sec, 1m
+	opts.TTL = 3 * time.Minute           // 3min
+	opts.FlushInterval = 1 * time.Minute // 1min
+	opts.OnBackgroundError = func(err error) {
+		fmt.Println(err)
+	}
+
+	kvStore, err := kv.Open(context.Background(), dataDir, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	l, err := net.Listen("tcp", ":8081")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Started Server with", memTableType)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			panic(err)
+		}
+		go serveConn(kvStore, conn)
+	}
+}
+
+// serveConn serves the RPCs of a connection, and stops its watchers once it is closed.
+func serveConn(kvStore kv.KV, conn net.Conn) {
+	svc := NewWatchService(kvStore)
+	defer svc.closeAll()
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("KV", svc); err != nil {
+		panic(err)
+	}
+	server.ServeConn(conn)
+}
+
+// errUnknownWatch is returned by Recv and Cancel for an ID not returned by Watch, or
+// already cancelled.
+var errUnknownWatch = errors.New("rpc_server: unknown watch")
+
+// WatchService streams kv.Watch over net/rpc: Watch opens a stream, Recv is called in a
+// loop to receive its events, and Cancel ends it.
+type WatchService struct {
+	kv       kv.KV
+	mu       sync.Mutex
+	nextID   uint64
+	watchers map[uint64]*kv.Watcher
+}
+
+func NewWatchService(kvStore kv.KV) *WatchService {
+	return &WatchService{kv: kvStore, watchers: make(map[uint64]*kv.Watcher)}
+}
+
+type WatchArgs struct {
+	Start, End, Prefix string
+	// FromTs is in unix nanoseconds.
+	FromTs int64
+}
+
+type WatchReply struct {
+	ID uint64
+}
+
+func (s *WatchService) Watch(args *WatchArgs, reply *WatchReply) error {
+	var opts []kv.ScanOption
+	if args.End != "" {
+		opts = append(opts, kv.WithEndKey(args.End))
+	}
+	if args.Prefix != "" {
+		opts = append(opts, kv.WithPrefix(args.Prefix))
+	}
+	w, err := s.kv.Watch(context.Background(), args.Start, time.Unix(0, args.FromTs), opts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	s.watchers[s.nextID] = w
+	reply.ID = s.nextID
+	return nil
+}
+
+type RecvArgs struct {
+	ID uint64
+	// Max is the most events returned, 1 if not set.
+	Max int
+}
+
+type RecvReply struct {
+	Events []kv.Event
+	// Done is set once the stream has ended, with the error of the watcher in Err.
+	Done bool
+	Err  string
+}
+
+// Recv waits for the next events of a stream, and returns those already received.
+func (s *WatchService) Recv(args *RecvArgs, reply *RecvReply) error {
+	s.mu.Lock()
+	w, ok := s.watchers[args.ID]
+	s.mu.Unlock()
+	if !ok {
+		return errUnknownWatch
+	}
+
+	e, ok := <-w.Events()
+	for ok {
+		reply.Events = append(reply.Events, e)
+		if len(reply.Events) >= args.Max {
+			return nil
+		}
+		select {
+		case e, ok = <-w.Events():
+		default:
+			return nil
+		}
+	}
+	reply.Done = true
+	if err := w.Err(); err != nil {
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+type CancelArgs struct {
+	ID uint64
+}
+
+func (s *WatchService) Cancel(args *CancelArgs, _ *struct{}) error {
+	s.mu.Lock()
+	w, ok := s.watchers[args.ID]
+	delete(s.watchers, args.ID)
+	s.mu.Unlock()
+	if !ok {
+		return errUnknownWatch
+	}
+	w.Close()
+	return nil
+}
+
+func (s *WatchService) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, w := range s.watchers {
+		w.Close()
+		delete(s.watchers, id)
+	}
+}
@@ -0,0 +1,63 @@
+package kv
+
+import "time"
+
+type batchOpType int
+
+const (
+	batchPut batchOpType = iota
+	batchDelete
+	batchDeleteRange
+)
+
+type batchOp struct {
+	typ batchOpType
+	key string
+	// end is the exclusive end of a DeleteRange.
+	end string
+	val []byte
+	// ttl, if set, expires the value of a Put.
+	ttl time.Duration
+}
+
+// WriteBatch collects Put, Delete and DeleteRange mutations that KV.Write applies
+// atomically, at a single commit timestamp. Later mutations of a key in the batch win
+// over earlier ones. The zero value is an empty batch.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put sets key to a copy of val.
+func (b *WriteBatch) Put(key string, val []byte, opts ...PutOption) {
+	if val != nil {
+		val = append([]byte{}, val...)
+	}
+	op := batchOp{typ: batchPut, key: key, val: val}
+	for _, opt := range opts {
+		opt(&op)
+	}
+	b.ops = append(b.ops, op)
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{typ: batchDelete, key: key})
+}
+
+// DeleteRange deletes every key in [start, end) written before the batch, and those put
+// earlier in it, with a single range tombstone.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	b.ops = append(b.ops, batchOp{typ: batchDeleteRange, key: start, end: end})
+}
+
+// Len returns the number of mutations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// errCompareFailed aborts a conditional write whose expected value does not match.
+var errCompareFailed = errors.New("kv: compare failed")
+
+func (c *CometKV) CompareAndSwap(key string, expected, val []byte, opts ...PutOption) (bool, error) {
+	var b WriteBatch
+	b.Put(key, val, opts...)
+	return c.writeIf(key, expected, &b)
+}
+
+func (c *CometKV) PutIfAbsent(key string, val []byte, opts ...PutOption) (bool, error) {
+	return c.CompareAndSwap(key, nil, val, opts...)
+}
+
+func (c *CometKV) DeleteIfEquals(key string, expected []byte) (bool, error) {
+	var b WriteBatch
+	b.Delete(key)
+	return c.writeIf(key, expected, &b)
+}
+
+// writeIf commits b if key holds expected just before the commit timestamp. As every
+// earlier commit is applied by then and every later one is above it, the check and
+// the write take effect at the same point of the commit order.
+func (c *CometKV) writeIf(key string, expected []byte, b *WriteBatch) (bool, error) {
+	err := c.write(b, func(commitTs uint64) error {
+		val, found, err := c.get(key, time.Unix(0, int64(commitTs-1)))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		// nil expects the key to be absent, which an empty value is not.
+		if found != (expected != nil) || !bytes.Equal(val, expected) {
+			return errCompareFailed
+		}
+		return nil
+	})
+	switch {
+	case err == errCompareFailed:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
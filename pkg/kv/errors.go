@@ -0,0 +1,29 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned by Get when the key has no version at the snapshot.
+	ErrNotFound = errors.New("kv: key not found")
+	// ErrDeleted is returned by Get when the newest version at the snapshot is a
+	// tombstone. It matches ErrNotFound with errors.Is.
+	ErrDeleted = fmt.Errorf("%w: deleted", ErrNotFound)
+	// ErrClosed is returned by every call made after Close.
+	ErrClosed = errors.New("kv: closed")
+	// ErrSnapshotExpired is returned by reads at a snapshot older than the TTL, whose
+	// versions may already be garbage collected.
+	ErrSnapshotExpired = errors.New("kv: snapshot expired")
+	// ErrSnapshotReleased is returned by every read on a released Snapshot.
+	ErrSnapshotReleased = errors.New("kv: snapshot released")
+	// ErrNotPersistent is returned by Open for an SstType whose files do not survive a
+	// restart: the WAL could never be truncated.
+	ErrNotPersistent = errors.New("kv: sst type is not persistent")
+	// ErrConflict is returned by Txn.Commit when a key the transaction depends on was
+	// written by another commit after it began. The transaction can be retried.
+	ErrConflict = errors.New("kv: transaction conflict")
+	// ErrTxnDone is returned by every call on a committed or discarded transaction.
+	ErrTxnDone = errors.New("kv: transaction done")
+)
@@ -0,0 +1,78 @@
+package kv
+
+import (
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"math"
+	"sort"
+	"time"
+)
+
+// Version is a version of a key, as returned by History.
+type Version struct {
+	// Ts is the commit timestamp of the version.
+	Ts time.Time
+	// Val is nil for a tombstone.
+	Val     []byte
+	Deleted bool
+	// ExpiresAt is set on a version put with a TTL.
+	ExpiresAt time.Time
+}
+
+// History merges the versions of key kept by the memtable and the SSTs with a commit
+// timestamp in [fromTs, toTs], newest first. A range tombstone deleting a version of key
+// is returned as a deleted version at its timestamp.
+func (c *CometKV) History(key string, fromTs, toTs time.Time) ([]Version, error) {
+	if err := c.checkRead(toTs); err != nil {
+		return nil, err
+	}
+	from := timestamp.ToUnit64(fromTs)
+
+	// 1. Versions of the memtable, then of the SSTs. A version flushed while still in
+	// the memtable is returned once.
+	versions := c.mem.ScanHistory(key, math.MaxInt, memtable.ScanOptions{SnapshotTs: toTs, Bounds: entry.Bounds{EndKey: key + "\x00"}})
+	sstVersions, err := c.sst.History(key, toTs)
+	if err != nil {
+		return nil, err
+	}
+	versions = append(versions, sstVersions...)
+
+	byTs := make(map[uint64]Version, len(versions))
+	oldest := uint64(math.MaxUint64)
+	for _, version := range versions {
+		ts := entry.ParseTs(version.Key)
+		if ts < oldest {
+			oldest = ts
+		}
+		if _, ok := byTs[ts]; ok || ts < from {
+			continue
+		}
+		v := Version{Ts: time.Unix(0, int64(ts)), Deleted: version.Val == nil}
+		if !v.Deleted {
+			val, expiresAt := entry.DecodeValue(version.Val)
+			v.Val = val
+			if expiresAt != 0 {
+				v.ExpiresAt = time.Unix(0, int64(expiresAt))
+			}
+		}
+		byTs[ts] = v
+	}
+
+	// 2. Range tombstones, unless a version of the same batch overwrites them
+	for _, t := range c.rangeTombstones(toTs) {
+		if _, ok := byTs[t.Ts]; ok || t.Ts < from || !t.Covers([]byte(key), oldest) {
+			continue
+		}
+		byTs[t.Ts] = Version{Ts: time.Unix(0, int64(t.Ts)), Deleted: true}
+	}
+
+	res := make([]Version, 0, len(byTs))
+	for _, v := range byTs {
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Ts.After(res[j].Ts)
+	})
+	return res, nil
+}
@@ -3,23 +3,66 @@ package kv
 import (
 	"context"
 	"fmt"
+	"github.com/dborchard/cometkv/pkg/logservice"
 	"github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/sst"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type KV interface {
-	Put(key string, val []byte)
-	Scan(startKey string, count int, snapshotTs time.Time) []entry.Pair[string, []byte]
+	Put(key string, val []byte, opts ...PutOption) error
+	// Scan returns the first count live keys at or after startKey at snapshotTs, within
+	// the WithEndKey and WithPrefix bounds. WithReverse returns the last count keys at
+	// or before startKey, in descending order.
+	Scan(startKey string, count int, snapshotTs time.Time, opts ...ScanOption) ([]entry.Pair[string, []byte], error)
+	// NewIterator iterates over the live keys at snapshotTs, reading the memtable and
+	// the SSTs a page at a time. It must be closed.
+	NewIterator(snapshotTs time.Time, opts ...ScanOption) (iterator.Iterator, error)
 
-	Get(key string, snapshotTs time.Time) []byte
-	Delete(key string)
-	Close()
+	// Get returns the value of key at snapshotTs. found is false when the key is
+	// missing, with ErrNotFound, or deleted, with ErrDeleted, or when the read fails.
+	Get(key string, snapshotTs time.Time) (val []byte, found bool, err error)
+	// History returns every version of key committed in [fromTs, toTs], newest first,
+	// tombstones included. Versions are only kept for the TTL, older ones may be missing.
+	History(key string, fromTs, toTs time.Time) ([]Version, error)
+	// Watch streams the mutations of the keys at or after startKey, within the
+	// WithEndKey and WithPrefix bounds, committed after fromTs.
+	Watch(ctx context.Context, startKey string, fromTs time.Time, opts ...ScanOption) (*Watcher, error)
+	Delete(key string) error
+	// DeleteRange deletes every key of [start, end) with a single range tombstone.
+	DeleteRange(start, end string) error
+	// Write applies the mutations of b atomically: they share one commit timestamp, and a
+	// snapshot read sees all of them or none.
+	Write(b *WriteBatch) error
+	// CompareAndSwap sets key to val if its value is expected, a nil expected matching a
+	// missing or deleted key. It reports whether the swap happened. Conditional writes
+	// are linearizable with every other write.
+	CompareAndSwap(key string, expected, val []byte, opts ...PutOption) (bool, error)
+	// PutIfAbsent sets key to val if it is missing or deleted.
+	PutIfAbsent(key string, val []byte, opts ...PutOption) (bool, error)
+	// DeleteIfEquals deletes key if its value is expected.
+	DeleteIfEquals(key string, expected []byte) (bool, error)
+	// NewSnapshot pins a snapshot of now, readable past the TTL until it is released.
+	NewSnapshot() (*Snapshot, error)
+	// Begin starts a transaction reading the snapshot of now.
+	Begin(opts TxnOptions) (*Txn, error)
+	// Flush persists the memtable to the SSTs now, instead of at the next flush interval.
+	Flush() error
+	Close() error
 
 	MemTableName() string
 	SstStorageName() string
+	WalStats() logservice.Stats
+	BlockCacheStats() cache.Stats
+	CompressionStats() compress.Stats
 }
 
 var _ KV = new(CometKV)
@@ -27,54 +70,329 @@ var _ KV = new(CometKV)
 type CometKV struct {
 	mem                memtable.IMemtable
 	sst                sst.IO
+	sstTyp             sst.Type
+	wal                *logservice.WAL
 	localInsertCounter int64
+	ttl                time.Duration
+	oracle             *oracle
+
+	// lastFlushTs is the snapshot of the last successful flush. Versions written before
+	// it are already in sst.IO.
+	lastFlushTs atomic.Uint64
+
+	// writeMu is held shared by writers across the WAL append and the memtable apply,
+	// and exclusively by the flush thread to read a consistent WAL checkpoint and by
+	// Close.
+	writeMu sync.RWMutex
+	// flushMu serializes flushes, and Close with them. compactMu does the same for
+	// compactions.
+	flushMu   sync.Mutex
+	compactMu sync.Mutex
+	closed    atomic.Bool
+
+	// watchLog holds the batches committed while watchers are registered that one of
+	// them has yet to read, in commit order but for the concurrent ones; watchLogBase is
+	// the position of its first batch. watchCh, if any, is closed by the next commit to
+	// wake the watchers.
+	watchMu      sync.Mutex
+	watchLog     []committedBatch
+	watchLogBase int
+	watchers     map[*watchCursor]struct{}
+	watchCh      chan struct{}
+
+	// onBackgroundError, if set, is called with the errors of the flush and compaction
+	// threads.
+	onBackgroundError func(err error)
+
+	// snapshots counts the pinned snapshots by timestamp.
+	snapshotsMu sync.Mutex
+	snapshots   map[uint64]int
 }
 
-func NewCometKV(ctx context.Context, mTyp memtable.Typ, dTyp sst.Type, gcInterval, ttl, flushInterval time.Duration) KV {
+func NewCometKV(ctx context.Context, mTyp memtable.Typ, dTyp sst.Type, gcInterval, ttl, flushInterval time.Duration, opts ...Option) KV {
 	kv := CometKV{
 		mem:                NewMemtable(mTyp, gcInterval, ttl, false, ctx),
 		sst:                sst.NewSstIO(dTyp),
+		sstTyp:             dTyp,
 		localInsertCounter: 0,
+		ttl:                ttl,
+		oracle:             newOracle(),
+	}
+	for _, opt := range opts {
+		opt(&kv)
 	}
 	kv.startFlushThread(flushInterval, ctx)
+	kv.startCompactionThread(flushInterval, ctx)
 	return &kv
 }
-func (c *CometKV) Put(key string, val []byte) {
-	c.mem.Put(key, val)
-	c.localInsertCounter++
+func (c *CometKV) Put(key string, val []byte, opts ...PutOption) error {
+	var b WriteBatch
+	b.Put(key, val, opts...)
+	return c.Write(&b)
 }
 
-func (c *CometKV) Scan(startKey string, count int, snapshotTs time.Time) []entry.Pair[string, []byte] {
-	res := c.mem.Scan(startKey, count, memtable.ScanOptions{SnapshotTs: snapshotTs})
-	diff := count - len(res)
-	if diff > 0 {
-		//TODO: this is wrong.
-		res = append(res, c.sst.Scan(startKey, diff, snapshotTs)...)
-	}
-	return res
+func (c *CometKV) Delete(key string) error {
+	var b WriteBatch
+	b.Delete(key)
+	return c.Write(&b)
 }
 
-func (c *CometKV) Get(key string, snapshotTs time.Time) []byte {
-	res := c.mem.Get(key, snapshotTs)
-	if res == nil {
-		// means key is deleted
+func (c *CometKV) DeleteRange(start, end string) error {
+	var b WriteBatch
+	b.DeleteRange(start, end)
+	return c.Write(&b)
+}
+
+func (c *CometKV) Write(b *WriteBatch) error {
+	return c.write(b, nil)
+}
+
+// write commits b. validate, if any, is called with the commit timestamp once every
+// earlier commit is applied, and aborts the commit with its error.
+func (c *CometKV) write(b *WriteBatch, validate func(commitTs uint64) error) error {
+	c.writeMu.RLock()
+	defer c.writeMu.RUnlock()
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	if b.Len() == 0 {
 		return nil
 	}
-	if len(res) == 0 {
+
+	// 1. Commit timestamp. Reads at or above it wait until the batch is applied.
+	ts := c.oracle.begin()
+	defer c.oracle.done(ts)
+	if validate != nil {
+		c.oracle.waitFor(ts - 1)
+		if err := validate(ts); err != nil {
+			return err
+		}
+	}
+
+	// 2. Encode the values
+	ops := resolveBatch(b, ts)
+
+	// 3. Log the batch as one record, and apply it
+	if err := c.appendToWal(batchRecord(ops, ts)); err != nil {
+		return err
+	}
+	logservice.Apply(c.mem, ops, ts)
+	atomic.AddInt64(&c.localInsertCounter, int64(len(ops)))
+	c.publish(ts, ops)
+	return nil
+}
+
+// resolveBatch returns the records of b, with encoded values. A range tombstone does not
+// cover the versions of its own batch, so a DeleteRange drops the records written
+// earlier in the batch within its range.
+func resolveBatch(b *WriteBatch, ts uint64) []logservice.Record {
+	ops := make([]logservice.Record, 0, len(b.ops))
+	for _, op := range b.ops {
+		switch op.typ {
+		case batchPut:
+			var expiresAt uint64
+			if op.ttl > 0 {
+				expiresAt = ts + uint64(op.ttl)
+			}
+			ops = append(ops, logservice.Record{Typ: logservice.RecordPut, Key: op.key, Val: entry.EncodeValue(op.val, expiresAt)})
+		case batchDelete:
+			ops = append(ops, logservice.Record{Typ: logservice.RecordDelete, Key: op.key})
+		case batchDeleteRange:
+			kept := ops[:0]
+			for _, prev := range ops {
+				if prev.Typ == logservice.RecordDeleteRange || prev.Key < op.key || prev.Key >= op.end {
+					kept = append(kept, prev)
+				}
+			}
+			ops = append(kept, logservice.Record{Typ: logservice.RecordDeleteRange, Key: op.key, Val: []byte(op.end)})
+		}
+	}
+	return ops
+}
+
+// batchRecord is the WAL record of the mutations of a batch committed at ts.
+func batchRecord(ops []logservice.Record, ts uint64) logservice.Record {
+	if len(ops) == 1 {
+		rec := ops[0]
+		rec.Ts = ts
+		return rec
+	}
+	return logservice.Record{Typ: logservice.RecordBatch, Ts: ts, Batch: ops}
+}
+
+// Scan merges the memtable and the SSTs: for every key, the newest version at or below
+// snapshotTs wins, and deleted keys are skipped until count live keys are found.
+func (c *CometKV) Scan(startKey string, count int, snapshotTs time.Time, opts ...ScanOption) ([]entry.Pair[string, []byte], error) {
+	if err := c.checkRead(snapshotTs); err != nil {
+		return nil, err
+	}
+	return c.scan(startKey, count, snapshotTs, scanBounds(opts))
+}
+
+func (c *CometKV) scan(startKey string, count int, snapshotTs time.Time, bounds entry.Bounds) ([]entry.Pair[string, []byte], error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	var res []entry.Pair[string, []byte]
+	it := c.newIterator(snapshotTs, count, bounds)
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		res = append(res, entry.Pair[string, []byte]{Key: string(it.Key()), Val: it.Value()})
+		if len(res) == count {
+			break
+		}
+	}
+	if err := it.Close(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *CometKV) NewIterator(snapshotTs time.Time, opts ...ScanOption) (iterator.Iterator, error) {
+	if err := c.checkRead(snapshotTs); err != nil {
+		return nil, err
+	}
+	return c.newIterator(snapshotTs, iterator.DefaultPageSize, scanBounds(opts)), nil
+}
+
+// newIterator merges the memtable and the SSTs within bounds, reading pageSize keys of
+// each at a time.
+func (c *CometKV) newIterator(snapshotTs time.Time, pageSize int, bounds entry.Bounds) *mergeIterator {
+	newPaged := iterator.NewPaged
+	if bounds.Reverse {
+		newPaged = iterator.NewReversePaged
+	}
+	mem := newPaged(pageSize, func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error) {
+		return c.mem.ScanVersions(startKey, count, memtable.ScanOptions{SnapshotTs: snapshotTs, Bounds: bounds}), nil
+	})
+	sst := newPaged(pageSize, func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error) {
+		return c.sst.ScanVersions(startKey, count, snapshotTs, bounds)
+	})
+	it := newMergeIterator(timestamp.ToUnit64(snapshotTs), bounds.Reverse, mem, sst)
+	// each source only applies its own range tombstones
+	it.tombstones = c.rangeTombstones(snapshotTs)
+	return it
+}
+
+// rangeTombstones returns the range tombstones of the memtable and the SSTs visible at
+// snapshotTs.
+func (c *CometKV) rangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	return append(c.mem.RangeTombstones(snapshotTs), c.sst.RangeTombstones(snapshotTs)...)
+}
+
+func (c *CometKV) Get(key string, snapshotTs time.Time) ([]byte, bool, error) {
+	if err := c.checkRead(snapshotTs); err != nil {
+		return nil, false, err
+	}
+	return c.get(key, snapshotTs)
+}
+
+func (c *CometKV) get(key string, snapshotTs time.Time) ([]byte, bool, error) {
+	res := c.mem.Get(key, snapshotTs)
+	if len(res) == 0 && res != nil {
 		// means key not found in memtable. Try sst.
-		res = c.sst.Get(key, snapshotTs)
+		var err error
+		if res, err = c.sst.Get(key, snapshotTs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	switch {
+	case res == nil:
+		return nil, false, ErrDeleted
+	case len(res) == 0:
+		return nil, false, ErrNotFound
+	}
+	val, live := decodeValue(res, timestamp.ToUnit64(snapshotTs))
+	if !live {
+		return nil, false, ErrDeleted
+	}
+
+	// A range tombstone of the memtable may delete the version found in the SSTs, which
+	// only the merge of both sees.
+	for _, t := range c.rangeTombstones(snapshotTs) {
+		if t.Covers([]byte(key), 0) {
+			return c.getMerged(key, snapshotTs)
+		}
+	}
+	return val, true, nil
+}
+
+// getMerged reads key through the merge of the memtable and the SSTs.
+func (c *CometKV) getMerged(key string, snapshotTs time.Time) ([]byte, bool, error) {
+	it := c.newIterator(snapshotTs, 1, entry.Bounds{EndKey: key + "\x00"})
+	it.Seek(key)
+	val, found := it.Value(), it.Valid()
+	if err := it.Close(); err != nil {
+		return nil, false, err
 	}
-	return res
+	if !found {
+		return nil, false, ErrDeleted
+	}
+	return val, true, nil
+}
+
+// decodeValue returns the value of a stored version, and whether it is live at
+// snapshotTs, i.e. neither deleted nor expired.
+func decodeValue(enc []byte, snapshotTs uint64) ([]byte, bool) {
+	if enc == nil {
+		return nil, false
+	}
+	val, expiresAt := entry.DecodeValue(enc)
+	if expiresAt != 0 && expiresAt <= snapshotTs {
+		return nil, false
+	}
+	return val, true
+}
+
+// checkRead fails reads after Close, and at snapshots older than the TTL. Otherwise it
+// waits for the batches committing at or below snapshotTs.
+func (c *CometKV) checkRead(snapshotTs time.Time) error {
+	if c.closed.Load() {
+		return ErrClosed
+	}
+	if snapshotTs.Before(c.oldestSnapshotTs()) {
+		return ErrSnapshotExpired
+	}
+	c.oracle.waitFor(timestamp.ToUnit64(snapshotTs))
+	return nil
 }
 
-func (c *CometKV) Delete(key string) {
-	c.mem.Delete(key)
+// appendToWal makes the mutation durable before it is applied to the memtable. The
+// write cannot be acknowledged if it fails.
+func (c *CometKV) appendToWal(rec logservice.Record) error {
+	if c.wal == nil {
+		return nil
+	}
+	_, err := c.wal.Append(rec)
+	return err
 }
 
-func (c *CometKV) Close() {
+// Close waits for the in-flight writes and releases the WAL, memtable and SSTs.
+func (c *CometKV) Close() error {
+	c.writeMu.Lock()
+	if c.closed.Swap(true) {
+		c.writeMu.Unlock()
+		return ErrClosed
+	}
+	c.writeMu.Unlock()
+	c.notifyWatchers()
+	// wait for an in-flight flush and compaction
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	var err error
+	if c.wal != nil {
+		err = c.wal.Close()
+	}
 	c.mem.Close()
-	c.sst.Destroy()
+	if sstErr := c.sst.Close(); err == nil {
+		err = sstErr
+	}
 	c.localInsertCounter = 0
+	return err
 }
 
 func (c *CometKV) startFlushThread(flushInterval time.Duration, ctx context.Context) {
@@ -87,14 +405,128 @@ func (c *CometKV) startFlushThread(flushInterval time.Duration, ctx context.Cont
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				totalInsertsForLongRangeDuration := c.atomicCasLocalInsertCounter()
-				records := c.mem.Scan("", int(totalInsertsForLongRangeDuration), memtable.ScanOptions{SnapshotTs: time.Now()})
-				_ = c.sst.Create(records)
+				if err := c.flush(); err == ErrClosed {
+					return
+				} else if err != nil {
+					c.backgroundError(fmt.Errorf("kv: flush: %w", err))
+				}
+			}
+		}
+	}()
+}
+
+// Flush persists the memtable to sst.IO and, once the SSTs are durable, truncates the
+// WAL up to the last record they cover. A failed flush is retried by the next one.
+func (c *CometKV) Flush() error {
+	return c.flush()
+}
+
+func (c *CometKV) flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	// 1. Wait for in-flight writes, so that every logged record is in the memtable.
+	c.writeMu.Lock()
+	if c.closed.Load() {
+		c.writeMu.Unlock()
+		return ErrClosed
+	}
+	// commits after the flush snapshot are placed above it
+	checkpoint := logservice.Checkpoint{Ts: c.oracle.fence()}
+	flushTs := time.Unix(0, int64(checkpoint.Ts))
+	if c.wal != nil {
+		checkpoint.Seq = c.wal.LastSeq()
+	}
+	c.writeMu.Unlock()
+
+	totalInsertsSinceLastFlush := c.atomicCasLocalInsertCounter()
+	if totalInsertsSinceLastFlush == 0 {
+		// nothing was written since the last flush
+		c.lastFlushTs.Store(checkpoint.Ts)
+		return nil
+	}
+
+	// 2. Every version since the last flush keeps its write timestamp, so that snapshot
+	// reads stay correct after the flush. Tombstones are flushed too, so that they
+	// shadow older SSTs. A version at exactly lastFlushTs may have been applied after
+	// that flush read the memtable; it is flushed again and deduplicated by compaction.
+	lastFlushTs := c.lastFlushTs.Load()
+	var records []entry.Pair[[]byte, []byte]
+	for _, version := range c.mem.ScanHistory("", math.MaxInt, memtable.ScanOptions{SnapshotTs: flushTs}) {
+		if entry.ParseTs(version.Key) >= lastFlushTs {
+			records = append(records, version)
+		}
+	}
+	var tombstones []entry.RangeTombstone
+	for _, t := range c.mem.RangeTombstones(flushTs) {
+		if t.Ts >= lastFlushTs {
+			tombstones = append(tombstones, t)
+		}
+	}
+	if err := c.sst.Create(records, tombstones, checkpoint.Seq); err != nil {
+		atomic.AddInt64(&c.localInsertCounter, totalInsertsSinceLastFlush)
+		return err
+	}
+	c.lastFlushTs.Store(checkpoint.Ts)
+
+	// 3. Records covered by persisted SSTs are no longer needed for recovery.
+	if c.wal == nil || !c.sstTyp.IsPersistent() {
+		return nil
+	}
+	return c.wal.Checkpoint(checkpoint)
+}
+
+func (c *CometKV) startCompactionThread(compactionInterval time.Duration, ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(compactionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// compact until no compaction is due
+				for {
+					compacted, err := c.compact()
+					if err == ErrClosed {
+						return
+					} else if err != nil {
+						c.backgroundError(fmt.Errorf("kv: compaction: %w", err))
+					}
+					if !compacted || err != nil {
+						break
+					}
+				}
 			}
 		}
 	}()
 }
 
+// compact runs one compaction of sst.IO, unless the store is closed.
+func (c *CometKV) compact() (bool, error) {
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+	if c.closed.Load() {
+		return false, ErrClosed
+	}
+	return c.sst.Compact(c.gcTs())
+}
+
+// backgroundError reports an error of the flush or compaction thread. Both retry on
+// their next tick.
+func (c *CometKV) backgroundError(err error) {
+	if c.onBackgroundError != nil {
+		c.onBackgroundError(err)
+	}
+}
+
+// oldestSnapshotTs is the oldest snapshot reads are served at, but for the pinned ones.
+// Like the memtable GC, compaction keeps every version younger than the TTL.
+func (c *CometKV) oldestSnapshotTs() time.Time {
+	return time.Now().Add(-c.ttl)
+}
+
 func (c *CometKV) atomicCasLocalInsertCounter() int64 {
 	for {
 		currentValue := atomic.LoadInt64(&c.localInsertCounter)
@@ -113,3 +545,21 @@ func (c *CometKV) MemTableName() string {
 func (c *CometKV) SstStorageName() string {
 	return c.sst.Name()
 }
+
+// WalStats returns the group-commit statistics of the WAL, if any.
+func (c *CometKV) WalStats() logservice.Stats {
+	if c.wal == nil {
+		return logservice.Stats{}
+	}
+	return c.wal.Stats()
+}
+
+// BlockCacheStats returns the hit/miss counters of the SST block cache.
+func (c *CometKV) BlockCacheStats() cache.Stats {
+	return c.sst.BlockCacheStats()
+}
+
+// CompressionStats returns the compression ratio of the SSTs.
+func (c *CometKV) CompressionStats() compress.Stats {
+	return c.sst.CompressionStats()
+}
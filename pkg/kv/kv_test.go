@@ -0,0 +1,941 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/logservice"
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/sst"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.MemtableType = memtable.VacuumBTree
+	opts.GcInterval = 15 * time.Second
+	opts.TTL = 60 * time.Second
+	opts.FlushInterval = time.Hour
+	opts.CompactionInterval = time.Hour
+	return opts
+}
+
+func TestOpenRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+	db.Put("1", []byte("a"))
+	db.Put("2", []byte("b"))
+	db.Put("3", []byte("c"))
+	db.Delete("2")
+	db.Close()
+
+	db, err = Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), mustGet(t, db, "1"))
+	_, found, err := db.Get("2", time.Now())
+	assert.False(t, found)
+	assert.ErrorIs(t, err, ErrDeleted)
+	assert.Equal(t, []byte("c"), mustGet(t, db, "3"))
+
+	rows := must(db.Scan("1", 3, time.Now()))
+	assert.Equal(t, 2, len(rows))
+	db.Close()
+}
+
+func TestOpenRecoveryFromSst(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := testOptions()
+
+	db, err := Open(ctx, dir, opts)
+	require.NoError(t, err)
+	db.Put("1", []byte("a"))
+	db.Put("2", []byte("b"))
+	require.NoError(t, db.(*CometKV).flush())
+	db.Put("3", []byte("c"))
+	db.Close()
+
+	db, err = Open(ctx, dir, opts)
+	require.NoError(t, err)
+	// only the write after the flush is replayed
+	assert.Equal(t, 1, db.(*CometKV).mem.Len())
+	assert.Equal(t, []byte("a"), mustGet(t, db, "1"))
+	assert.Equal(t, []byte("b"), mustGet(t, db, "2"))
+	assert.Equal(t, []byte("c"), mustGet(t, db, "3"))
+	db.Close()
+}
+
+func TestOpenRecoveryKeepsTs(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := testOptions()
+	opts.TTL = 200 * time.Millisecond
+
+	db, err := Open(ctx, dir, opts)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, db.Put("k", []byte("a")))
+	require.NoError(t, db.Put("k", []byte("b")))
+	history := must(db.History("k", start, time.Now()))
+	require.NoError(t, db.Close())
+
+	// versions keep their commit timestamps, and those older than the TTL are read
+	// from the SSTs
+	time.Sleep(opts.TTL)
+	db, err = Open(ctx, dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), mustGet(t, db, "k"))
+	require.NoError(t, db.Close())
+
+	opts.TTL = time.Hour
+	db, err = Open(ctx, dir, opts)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, history, must(db.History("k", start, time.Now())))
+	val, _, err := db.Get("k", history[1].Ts)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), val)
+}
+
+func TestMergedScan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Put(fmt.Sprintf("%02d", i), []byte("old"))
+	}
+	require.NoError(t, db.(*CometKV).flush())
+	for i := 0; i < 5; i++ {
+		db.Delete(fmt.Sprintf("%02d", i))
+	}
+	db.Put("07", []byte("new"))
+	db.Put("10", []byte("new"))
+
+	// memtable tombstones shadow the sst, and do not count
+	rows := must(db.Scan("", 3, time.Now()))
+	require.Equal(t, 3, len(rows))
+	assert.Equal(t, "05", rows[0].Key)
+	assert.Equal(t, "06", rows[1].Key)
+	assert.Equal(t, "07", rows[2].Key)
+	assert.Equal(t, []byte("new"), rows[2].Val)
+
+	rows = must(db.Scan("06", 100, time.Now()))
+	require.Equal(t, 5, len(rows))
+	for i, key := range []string{"06", "07", "08", "09", "10"} {
+		assert.Equal(t, key, rows[i].Key)
+	}
+	assert.Equal(t, []byte("old"), rows[0].Val)
+	assert.Equal(t, []byte("new"), rows[4].Val)
+}
+
+func TestFlushKeepsVersions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	c := db.(*CometKV)
+
+	db.Put("1", []byte("a"))
+	db.Put("2", []byte("b"))
+	time.Sleep(time.Millisecond)
+	beforeUpdate := time.Now()
+	time.Sleep(time.Millisecond)
+	db.Put("1", []byte("c"))
+	db.Delete("2")
+	require.NoError(t, c.flush())
+
+	// snapshot reads against the sst see the versions at their write timestamps
+	assert.Equal(t, []byte("a"), value(must(c.sst.Get("1", beforeUpdate))))
+	assert.Equal(t, []byte("b"), value(must(c.sst.Get("2", beforeUpdate))))
+	assert.Equal(t, []byte("c"), value(must(c.sst.Get("1", time.Now()))))
+	assert.Nil(t, value(must(c.sst.Get("2", time.Now()))))
+	versions := must(c.sst.ScanVersions("", 10, time.Now(), entry.Bounds{}))
+	require.Equal(t, 2, len(versions))
+	assert.Nil(t, versions[1].Val)
+
+	// a later flush adds the newer versions only
+	db.Put("3", []byte("d"))
+	require.NoError(t, c.flush())
+	assert.Equal(t, []byte("d"), value(must(c.sst.Get("3", time.Now()))))
+	assert.Equal(t, []byte("a"), value(must(c.sst.Get("1", beforeUpdate))))
+}
+
+func TestWriteBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, db.Put(fmt.Sprintf("%02d", i), []byte("old")))
+	}
+	require.NoError(t, db.Flush())
+	time.Sleep(time.Millisecond)
+	beforeBatch := time.Now()
+
+	var b WriteBatch
+	b.Put("10", []byte("new"))
+	b.Put("03", []byte("new"))
+	b.DeleteRange("01", "04")
+	b.Put("02", []byte("new"))
+	b.Delete("05")
+	require.NoError(t, db.Write(&b))
+
+	rows := must(db.Scan("", 10, time.Now()))
+	require.Equal(t, 4, len(rows))
+	for i, key := range []string{"00", "02", "04", "10"} {
+		assert.Equal(t, key, rows[i].Key)
+	}
+	assert.Equal(t, []byte("new"), rows[1].Val)
+	assert.Equal(t, 6, len(must(db.Scan("", 10, beforeBatch))))
+
+	// every version of the batch has the same timestamp
+	versions := db.(*CometKV).mem.ScanHistory("", 100, memtable.ScanOptions{SnapshotTs: time.Now()})
+	ts := entry.ParseTs(versions[len(versions)-1].Key)
+	for _, version := range versions {
+		if entry.ParseTs(version.Key) > timestamp.ToUnit64(beforeBatch) {
+			assert.Equal(t, ts, entry.ParseTs(version.Key))
+		}
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put(fmt.Sprintf("%02d", i), []byte("old")))
+	}
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Put("05", []byte("new")))
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+
+	// the memtable tombstone deletes versions of the memtable and the sst
+	require.NoError(t, db.DeleteRange("03", "07"))
+	require.NoError(t, db.Put("04", []byte("new")))
+
+	live := []string{"00", "01", "02", "04", "07", "08", "09"}
+	check := func() {
+		for _, key := range []string{"03", "05", "06"} {
+			_, found, err := db.Get(key, time.Now())
+			assert.False(t, found)
+			assert.ErrorIs(t, err, ErrDeleted)
+		}
+		assert.Equal(t, []byte("new"), mustGet(t, db, "04"))
+		assert.Equal(t, []byte("old"), mustGet(t, db, "07"))
+
+		var keys []string
+		for _, row := range must(db.Scan("", 10, time.Now())) {
+			keys = append(keys, row.Key)
+		}
+		assert.Equal(t, live, keys)
+		rows := must(db.Scan("06", 2, time.Now(), WithReverse()))
+		assert.Equal(t, "04", rows[0].Key)
+		assert.Equal(t, "02", rows[1].Key)
+	}
+	check()
+	assert.Equal(t, 10, len(must(db.Scan("", 10, beforeDelete))))
+
+	// flushed as a range tombstone of the sst, and replayed from the WAL
+	require.NoError(t, db.Flush())
+	check()
+	require.NoError(t, db.DeleteRange("08", "09"))
+	live = []string{"00", "01", "02", "04", "07", "09"}
+	require.NoError(t, db.Close())
+
+	db, err = Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	check()
+
+	// a transaction writing into a range deleted after it began conflicts
+	txn := must(db.Begin(TxnOptions{}))
+	require.NoError(t, txn.Put("01", []byte("txn")))
+	require.NoError(t, db.DeleteRange("00", "02"))
+	assert.ErrorIs(t, txn.Commit(), ErrConflict)
+}
+
+func TestWriteBatchAtomic(t *testing.T) {
+	for typ := memtable.SegmentRing; typ <= memtable.HWTCoWBTree; typ++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		db := NewCometKV(ctx, typ, sst.MBtree, 15*time.Second, 60*time.Second, time.Hour)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 200; i++ {
+				var b WriteBatch
+				val := []byte(fmt.Sprintf("%03d", i))
+				b.Put("a", val)
+				b.Put("b", val)
+				b.Put("c", val)
+				require.NoError(t, db.Write(&b))
+			}
+		}()
+
+		// a snapshot sees either all the writes of a batch or none
+		for reading := true; reading; {
+			select {
+			case <-done:
+				reading = false
+			default:
+			}
+			rows := must(db.Scan("", 3, time.Now()))
+			for _, row := range rows {
+				assert.Equal(t, rows[0].Val, row.Val, db.MemTableName())
+			}
+			if len(rows) > 0 {
+				assert.Equal(t, 3, len(rows), db.MemTableName())
+			}
+		}
+
+		require.NoError(t, db.Close())
+		cancel()
+	}
+}
+
+func mustGet(t *testing.T, db KV, key string) []byte {
+	val, found, err := db.Get(key, time.Now())
+	require.NoError(t, err)
+	require.True(t, found)
+	return val
+}
+
+// value decodes a value stored by the KV.
+func value(enc []byte) []byte {
+	val, _ := entry.DecodeValue(enc)
+	return val
+}
+
+// must unwraps the result of a read that is expected to succeed.
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func TestErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := testOptions()
+	opts.SstType = sst.MBtree
+	_, err := Open(ctx, t.TempDir(), opts)
+	assert.ErrorIs(t, err, ErrNotPersistent)
+
+	opts.SstType = sst.Disk
+	db, err := Open(ctx, t.TempDir(), opts)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put("1", []byte("a")))
+	require.NoError(t, db.Put("2", []byte("b")))
+	require.NoError(t, db.Delete("2"))
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Delete("1"))
+
+	// a tombstone, in the memtable or the sst, is told apart from a missing key
+	for _, key := range []string{"1", "2"} {
+		val, found, err := db.Get(key, time.Now())
+		assert.Nil(t, val)
+		assert.False(t, found)
+		assert.ErrorIs(t, err, ErrDeleted)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	_, found, err := db.Get("3", time.Now())
+	assert.False(t, found)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NotErrorIs(t, err, ErrDeleted)
+
+	_, _, err = db.Get("1", time.Now().Add(-2*opts.TTL))
+	assert.ErrorIs(t, err, ErrSnapshotExpired)
+	_, err = db.Scan("", 10, time.Now().Add(-2*opts.TTL))
+	assert.ErrorIs(t, err, ErrSnapshotExpired)
+
+	require.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Put("1", []byte("a")), ErrClosed)
+	assert.ErrorIs(t, db.Delete("1"), ErrClosed)
+	_, _, err = db.Get("1", time.Now())
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Scan("", 10, time.Now())
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, db.Flush(), ErrClosed)
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+}
+
+// failingIO fails every flush.
+type failingIO struct {
+	sst.IO
+}
+
+func (failingIO) Create([]entry.Pair[[]byte, []byte], []entry.RangeTombstone, uint64) error {
+	return errors.New("disk full")
+}
+
+func TestBackgroundError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	db := &CometKV{
+		mem:    NewMemtable(memtable.VacuumBTree, 15*time.Second, 60*time.Second, false, ctx),
+		sst:    failingIO{sst.NewSstIO(sst.MBtree)},
+		ttl:    60 * time.Second,
+		oracle: newOracle(),
+	}
+	WithBackgroundErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})(db)
+	db.startFlushThread(10*time.Millisecond, ctx)
+	defer db.Close()
+
+	require.NoError(t, db.Put("1", []byte("a")))
+	select {
+	case err := <-errs:
+		assert.EqualError(t, err, "kv: flush: disk full")
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush error not reported")
+	}
+	// the write is kept for the next flush
+	assert.Equal(t, []byte("a"), mustGet(t, db, "1"))
+}
+
+// closeCheckingIO records compactions that run after Close.
+type closeCheckingIO struct {
+	sst.IO
+	closed, compactedAfterClose atomic.Bool
+}
+
+func (io *closeCheckingIO) Compact(gcTs time.Time) (bool, error) {
+	if io.closed.Load() {
+		io.compactedAfterClose.Store(true)
+	}
+	return io.IO.Compact(gcTs)
+}
+
+func (io *closeCheckingIO) Close() error {
+	io.closed.Store(true)
+	return io.IO.Close()
+}
+
+func TestCompactionStopsOnClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	io := &closeCheckingIO{IO: sst.NewSstIO(sst.MBtree)}
+	db := &CometKV{
+		mem:    NewMemtable(memtable.VacuumBTree, 15*time.Second, 60*time.Second, false, ctx),
+		sst:    io,
+		ttl:    60 * time.Second,
+		oracle: newOracle(),
+	}
+	db.startCompactionThread(time.Millisecond, ctx)
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Close())
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, io.compactedAfterClose.Load())
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for typ := memtable.SegmentRing; typ <= memtable.HWTCoWBTree; typ++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		db := NewCometKV(ctx, typ, sst.MBtree, 15*time.Second, 60*time.Second, time.Hour)
+
+		swapped, err := db.PutIfAbsent("leader", []byte("a"))
+		require.NoError(t, err)
+		assert.True(t, swapped, db.MemTableName())
+		swapped, _ = db.PutIfAbsent("leader", []byte("b"))
+		assert.False(t, swapped, db.MemTableName())
+		swapped, _ = db.DeleteIfEquals("leader", []byte("b"))
+		assert.False(t, swapped, db.MemTableName())
+		swapped, _ = db.DeleteIfEquals("leader", []byte("a"))
+		assert.True(t, swapped, db.MemTableName())
+		swapped, _ = db.PutIfAbsent("leader", []byte("b"))
+		assert.True(t, swapped, db.MemTableName())
+
+		// an empty value is present, and an empty expected value needs a present key
+		require.NoError(t, db.Put("empty", []byte{}))
+		swapped, _ = db.PutIfAbsent("empty", []byte("b"))
+		assert.False(t, swapped, db.MemTableName())
+		assert.Equal(t, []byte{}, mustGet(t, db, "empty"), db.MemTableName())
+		swapped, _ = db.CompareAndSwap("missing", []byte{}, []byte("b"))
+		assert.False(t, swapped, db.MemTableName())
+		swapped, _ = db.CompareAndSwap("empty", []byte{}, []byte("b"))
+		assert.True(t, swapped, db.MemTableName())
+
+		// concurrent increments of a counter are not lost
+		require.NoError(t, db.Put("counter", []byte("0")))
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 25; {
+					old := mustGet(t, db, "counter")
+					n, _ := strconv.Atoi(string(old))
+					swapped, err := db.CompareAndSwap("counter", old, []byte(strconv.Itoa(n+1)))
+					require.NoError(t, err)
+					if swapped {
+						i++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, []byte("100"), mustGet(t, db, "counter"), db.MemTableName())
+
+		require.NoError(t, db.Close())
+		cancel()
+	}
+}
+
+func TestPutTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put("session", []byte("a"), WithTTL(50*time.Millisecond)))
+	require.NoError(t, db.Put("doc", []byte("b")))
+	require.NoError(t, db.Put("flushed", []byte("c"), WithTTL(50*time.Millisecond)))
+	require.NoError(t, db.Flush())
+	beforeExpiry := time.Now()
+	assert.Equal(t, []byte("a"), mustGet(t, db, "session"))
+	assert.Equal(t, 3, len(must(db.Scan("", 10, time.Now()))))
+
+	// expired entries are hidden, in the memtable and the sst
+	time.Sleep(60 * time.Millisecond)
+	for _, key := range []string{"session", "flushed"} {
+		_, found, err := db.Get(key, time.Now())
+		assert.False(t, found)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	rows := must(db.Scan("", 10, time.Now()))
+	require.Equal(t, 1, len(rows))
+	assert.Equal(t, "doc", rows[0].Key)
+	assert.Equal(t, 3, len(must(db.Scan("", 10, beforeExpiry))))
+
+	// a later Put without TTL does not expire
+	require.NoError(t, db.Put("session", []byte("d")))
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, []byte("d"), mustGet(t, db, "session"))
+}
+
+func TestIterator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Put(fmt.Sprintf("%04d", i), []byte("old")))
+	}
+	require.NoError(t, db.Flush())
+	for i := 0; i < 1000; i += 2 {
+		require.NoError(t, db.Delete(fmt.Sprintf("%04d", i)))
+	}
+	snapshot := time.Now()
+	require.NoError(t, db.Put("0001", []byte("new")))
+
+	// the merged live keys of the snapshot, until the caller stops
+	it := must(db.NewIterator(snapshot))
+	var keys []string
+	for it.Seek("0100"); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Close())
+	require.Equal(t, 450, len(keys))
+	assert.Equal(t, "0101", keys[0])
+	assert.Equal(t, "0999", keys[449])
+
+	it = must(db.NewIterator(snapshot))
+	it.Seek("")
+	require.True(t, it.Valid())
+	assert.Equal(t, []byte("old"), it.Value())
+	require.NoError(t, it.Close())
+}
+
+func TestBoundedScan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for tenant := 1; tenant <= 3; tenant++ {
+		for i := 0; i < 5; i++ {
+			require.NoError(t, db.Put(fmt.Sprintf("user:%d/%d", tenant, i), []byte("old")))
+		}
+	}
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Put("user:2/5", []byte("new")))
+	require.NoError(t, db.Delete("user:2/0"))
+
+	// the neighbouring tenants are not returned, in the memtable or the sst
+	rows := must(db.Scan("", 100, time.Now(), WithPrefix("user:2/")))
+	require.Equal(t, 5, len(rows))
+	assert.Equal(t, "user:2/1", rows[0].Key)
+	assert.Equal(t, "user:2/5", rows[4].Key)
+
+	rows = must(db.Scan("user:1/3", 100, time.Now(), WithEndKey("user:2/2")))
+	require.Equal(t, 3, len(rows))
+	assert.Equal(t, "user:2/1", rows[2].Key)
+
+	it := must(db.NewIterator(time.Now(), WithPrefix("user:3/"), WithEndKey("user:3/2")))
+	count := 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+	}
+	require.NoError(t, it.Close())
+	assert.Equal(t, 2, count)
+}
+
+func TestReverseScan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i += 2 {
+		require.NoError(t, db.Put(fmt.Sprintf("event/%02d", i), []byte("old")))
+	}
+	require.NoError(t, db.Flush())
+	for i := 1; i < 10; i += 2 {
+		require.NoError(t, db.Put(fmt.Sprintf("event/%02d", i), []byte("new")))
+	}
+	require.NoError(t, db.Delete("event/08"))
+	require.NoError(t, db.Put("other", []byte("x")))
+
+	// the most recent events, from the memtable and the sst
+	rows := must(db.Scan("", 3, time.Now(), WithPrefix("event/"), WithReverse()))
+	assert.Equal(t, []entry.Pair[string, []byte]{
+		{Key: "event/09", Val: []byte("new")},
+		{Key: "event/07", Val: []byte("new")},
+		{Key: "event/06", Val: []byte("old")},
+	}, rows)
+
+	// the events before event/05
+	rows = must(db.Scan("event/04", 2, time.Now(), WithReverse()))
+	assert.Equal(t, "event/04", rows[0].Key)
+	assert.Equal(t, "event/03", rows[1].Key)
+
+	it := must(db.NewIterator(time.Now(), WithReverse()))
+	var keys []string
+	for it.Seek(""); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	require.NoError(t, it.Close())
+	assert.Equal(t, []string{"other", "event/09", "event/07", "event/06", "event/05", "event/04", "event/03", "event/02", "event/01", "event/00"}, keys)
+}
+
+func TestHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+
+	start := time.Now()
+	require.NoError(t, db.Put("k", []byte("a")))
+	require.NoError(t, db.Put("k", []byte("b"), WithTTL(time.Hour)))
+	require.NoError(t, db.Put("other", []byte("x")))
+	require.NoError(t, db.Flush())
+	time.Sleep(time.Millisecond)
+	afterFlush := time.Now()
+	require.NoError(t, db.Delete("k"))
+	require.NoError(t, db.DeleteRange("a", "z"))
+	require.NoError(t, db.Put("k", []byte("c")))
+
+	history := must(db.History("k", start, time.Now()))
+	require.Equal(t, 5, len(history))
+	assert.Equal(t, []byte("c"), history[0].Val)
+	assert.True(t, history[1].Deleted)
+	assert.True(t, history[2].Deleted)
+	assert.Equal(t, []byte("b"), history[3].Val)
+	assert.False(t, history[3].ExpiresAt.IsZero())
+	assert.Equal(t, []byte("a"), history[4].Val)
+	assert.True(t, history[4].ExpiresAt.IsZero())
+	for i := 1; i < len(history); i++ {
+		assert.True(t, history[i].Ts.Before(history[i-1].Ts))
+	}
+
+	// the versions flushed to the sst and still in the memtable are returned once
+	assert.Equal(t, 2, len(must(db.History("k", start, afterFlush))))
+	assert.Equal(t, 3, len(must(db.History("k", afterFlush, time.Now()))))
+	assert.Equal(t, 0, len(must(db.History("missing", start, time.Now()))))
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, db.Put("a/1", []byte("x")))
+	require.NoError(t, db.Put("b/1", []byte("y")))
+
+	// catches up from the memtable, then follows the commits
+	w := must(db.Watch(ctx, "", start, WithPrefix("a/")))
+	next := func() Event {
+		select {
+		case e := <-w.Events():
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+	e := next()
+	assert.Equal(t, Event{Typ: EventPut, Key: "a/1", Val: []byte("x"), Ts: e.Ts}, e)
+
+	require.NoError(t, db.Delete("a/1"))
+	require.NoError(t, db.Put("c/1", []byte("z")))
+	var b WriteBatch
+	b.Put("a/3", []byte("w"))
+	b.DeleteRange("a/", "a0")
+	b.Put("a/2", []byte("v"))
+	require.NoError(t, db.Write(&b))
+
+	deleted := next()
+	assert.Equal(t, EventDelete, deleted.Typ)
+	assert.Equal(t, "a/1", deleted.Key)
+	assert.True(t, deleted.Ts.After(e.Ts))
+	// the batch, its DeleteRange first
+	e = next()
+	assert.Equal(t, Event{Typ: EventDeleteRange, Key: "a/", End: "a0", Ts: e.Ts}, e)
+	e = next()
+	assert.Equal(t, Event{Typ: EventPut, Key: "a/2", Val: []byte("v"), Ts: e.Ts}, e)
+
+	// resumes after the last event seen, the DeleteRange overlapping the range
+	resumed := must(db.Watch(ctx, "a/2", e.Ts.Add(-time.Nanosecond), WithEndKey("a0")))
+	var keys []string
+	for len(keys) < 2 {
+		select {
+		case got := <-resumed.Events():
+			keys = append(keys, got.Key)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+	assert.Equal(t, []string{"a/", "a/2"}, keys)
+	resumed.Close()
+
+	require.NoError(t, db.Close())
+	for range w.Events() {
+	}
+	assert.ErrorIs(t, w.Err(), ErrClosed)
+	w.Close()
+
+	_, err = db.Watch(ctx, "", time.Now().Add(-time.Hour))
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// the commits are replayed from the WAL on Open
+	db, err = Open(ctx, dir, testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	w = must(db.Watch(ctx, "", start, WithPrefix("a/")))
+	defer w.Close()
+	var types []EventType
+	for len(types) < 4 {
+		types = append(types, next().Typ)
+	}
+	assert.Equal(t, []EventType{EventPut, EventDelete, EventDeleteRange, EventPut}, types)
+}
+
+func TestWatchLog(t *testing.T) {
+	c := &CometKV{ttl: time.Hour}
+	put := func(key string) []logservice.Record {
+		return []logservice.Record{{Typ: logservice.RecordPut, Key: key, Val: entry.EncodeValue([]byte(key), 0)}}
+	}
+	keys := func(events []Event) []string {
+		var res []string
+		for _, e := range events {
+			res = append(res, e.Key)
+		}
+		return res
+	}
+
+	// nothing is logged without a watcher
+	now := timestamp.Now()
+	c.publish(now, put("unwatched"))
+	assert.Nil(t, c.watchLog)
+
+	// concurrent commits may be logged out of order
+	cursor := c.addWatcher()
+	c.publish(now+30, put("a"))
+	c.publish(now+10, put("b"))
+	c.publish(now+50, put("c"))
+
+	assert.Equal(t, []string{"b"}, keys(c.changes(cursor, "", entry.Bounds{}, now, now+20)))
+	assert.Equal(t, 0, cursor.pos)
+	assert.Equal(t, []string{"a"}, keys(c.changes(cursor, "", entry.Bounds{}, now+20, now+40)))
+	assert.Equal(t, 2, cursor.pos)
+	// the batches read by every watcher are dropped
+	assert.Equal(t, 2, c.watchLogBase)
+	assert.Equal(t, []string{"c"}, keys(c.changes(cursor, "", entry.Bounds{}, now+40, now+60)))
+	assert.Equal(t, 3, cursor.pos)
+	assert.Equal(t, 0, len(c.watchLog))
+
+	// a slower watcher keeps them
+	slow := c.addWatcher()
+	c.publish(now+60, put("d"))
+	assert.Equal(t, []string{"d"}, keys(c.changes(cursor, "", entry.Bounds{}, now+50, now+70)))
+	assert.Equal(t, 1, len(c.watchLog))
+	assert.Equal(t, []string{"d"}, keys(c.changes(slow, "", entry.Bounds{}, now+50, now+70)))
+	assert.Equal(t, 0, len(c.watchLog))
+
+	// and the batches older than the TTL are dropped
+	c.publish(now+80, put("e"))
+	c.ttl = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	c.publish(timestamp.Now(), put("f"))
+	assert.Equal(t, 5, c.watchLogBase)
+	assert.Equal(t, []string{"f"}, keys(c.changes(slow, "", entry.Bounds{}, now+70, timestamp.Now())))
+
+	// the last watcher removed drops the log
+	c.publish(timestamp.Now(), put("g"))
+	c.removeWatcher(cursor)
+	c.removeWatcher(slow)
+	assert.Nil(t, c.watchLog)
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := testOptions()
+	opts.GcInterval = 20 * time.Millisecond
+	opts.TTL = 500 * time.Millisecond
+	db, err := Open(ctx, t.TempDir(), opts)
+	require.NoError(t, err)
+	defer db.Close()
+	c := db.(*CometKV)
+
+	require.NoError(t, db.Put("k", []byte("v0")))
+	require.NoError(t, db.Put("expiring", []byte("x"), WithTTL(50*time.Millisecond)))
+	snap := must(db.NewSnapshot())
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, db.Put("k", []byte(fmt.Sprint("v", i))))
+		require.NoError(t, db.Flush())
+	}
+	require.NoError(t, db.DeleteRange("a", "z"))
+
+	check := func() {
+		for key, want := range map[string]string{"k": "v0", "expiring": "x"} {
+			val, found, err := snap.Get(key)
+			require.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, []byte(want), val)
+		}
+		rows := must(snap.Scan("", 10))
+		assert.Equal(t, 2, len(rows))
+		it := must(snap.NewIterator(WithReverse()))
+		it.Seek("")
+		assert.True(t, it.Valid())
+		assert.Equal(t, "k", string(it.Key()))
+		require.NoError(t, it.Close())
+	}
+
+	// the GC does not reclaim the expired value the snapshot sees
+	time.Sleep(150 * time.Millisecond)
+	check()
+
+	// past the TTL, nor does compaction drop the versions it sees
+	time.Sleep(opts.TTL)
+	for compacted := true; compacted; {
+		compacted, err = c.sst.Compact(c.gcTs())
+		require.NoError(t, err)
+	}
+	check()
+	_, _, err = db.Get("k", snap.Ts())
+	assert.ErrorIs(t, err, ErrSnapshotExpired)
+
+	snap.Release()
+	_, _, err = snap.Get("k")
+	assert.ErrorIs(t, err, ErrSnapshotReleased)
+	assert.True(t, c.gcTs().After(snap.Ts()))
+	snap.Release()
+
+	// without a flush after it, past the TTL, the snapshot is read from the memtable
+	// that keeps its versions
+	require.NoError(t, db.Put("k", []byte("a")))
+	snap = must(db.NewSnapshot())
+	assert.True(t, snap.kept)
+	require.NoError(t, db.Put("k", []byte("b")))
+	time.Sleep(opts.TTL + 2*opts.GcInterval)
+	val, _, err := snap.Get("k")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), val)
+	snap.Release()
+}
+
+func TestSnapshotPastTTL(t *testing.T) {
+	for typ := memtable.SegmentRing; typ <= memtable.HWTCoWBTree; typ++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		db := NewCometKV(ctx, typ, sst.MBtree, time.Second, 2*time.Second, time.Hour)
+
+		require.NoError(t, db.Put("a", []byte("a")))
+		require.NoError(t, db.Flush())
+		require.NoError(t, db.Put("k", []byte("v1")))
+		snap := must(db.NewSnapshot())
+		require.NoError(t, db.Put("k", []byte("v2")))
+
+		// memtables that do not keep the versions of the snapshot are flushed before
+		// they expire
+		time.Sleep(2500 * time.Millisecond)
+		val, _, err := snap.Get("k")
+		require.NoError(t, err, db.MemTableName())
+		assert.Equal(t, []byte("v1"), val, db.MemTableName())
+		rows, err := snap.Scan("", 10)
+		require.NoError(t, err, db.MemTableName())
+		assert.Equal(t, []entry.Pair[string, []byte]{{Key: "a", Val: []byte("a")}, {Key: "k", Val: []byte("v1")}}, rows, db.MemTableName())
+
+		snap.Release()
+		require.NoError(t, db.Close())
+		cancel()
+	}
+}
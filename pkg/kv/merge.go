@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"bytes"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+)
+
+// mergeIterator merges sources iterating over the newest version of every key, with
+// internal keys and tombstones, such as the memtable and the SSTs. It yields the user
+// keys live at snapshotTs with their decoded values, in descending order if reverse.
+// When several sources hold a key, the version with the highest ts wins, the first
+// source on a tie. A version covered by one of tombstones is deleted. A failed source
+// ends the iteration with its error.
+type mergeIterator struct {
+	sources    []iterator.Iterator
+	tombstones []entry.RangeTombstone
+	snapshotTs uint64
+	reverse    bool
+	key, val   []byte
+	valid      bool
+	err        error
+}
+
+var _ iterator.Iterator = new(mergeIterator)
+
+func newMergeIterator(snapshotTs uint64, reverse bool, sources ...iterator.Iterator) *mergeIterator {
+	return &mergeIterator{sources: sources, snapshotTs: snapshotTs, reverse: reverse}
+}
+
+func (m *mergeIterator) Seek(key string) {
+	for _, s := range m.sources {
+		s.Seek(key)
+	}
+	m.advance()
+}
+
+func (m *mergeIterator) Next() {
+	m.advance()
+}
+
+func (m *mergeIterator) advance() {
+	m.valid = false
+	for {
+		for _, s := range m.sources {
+			if err := s.Err(); err != nil {
+				m.err = err
+				return
+			}
+		}
+
+		// 1. Smallest key among the sources, largest in reverse
+		var first []byte
+		for _, s := range m.sources {
+			if s.Valid() && (first == nil || m.before(entry.ParseKey(s.Key()), first)) {
+				first = entry.ParseKey(s.Key())
+			}
+		}
+		if first == nil {
+			return
+		}
+
+		// 2. Newest version of that key
+		var newestKey, newestVal []byte
+		for _, s := range m.sources {
+			if !s.Valid() || !bytes.Equal(entry.ParseKey(s.Key()), first) {
+				continue
+			}
+			if newestKey == nil || entry.ParseTs(s.Key()) > entry.ParseTs(newestKey) {
+				newestKey, newestVal = s.Key(), s.Value()
+			}
+			s.Next()
+		}
+
+		// 3. Deleted and expired keys are skipped
+		if _, covered := entry.CoveringTs(m.tombstones, first, entry.ParseTs(newestKey), m.snapshotTs); covered {
+			continue
+		}
+		if val, live := decodeValue(newestVal, m.snapshotTs); live {
+			m.key, m.val, m.valid = first, val, true
+			return
+		}
+	}
+}
+
+// before reports whether the user key a comes before b in the order of the iteration.
+func (m *mergeIterator) before(a, b []byte) bool {
+	if m.reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+func (m *mergeIterator) Valid() bool {
+	return m.valid
+}
+
+// Key returns the user key.
+func (m *mergeIterator) Key() []byte {
+	return m.key
+}
+
+func (m *mergeIterator) Value() []byte {
+	return m.val
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+func (m *mergeIterator) Close() error {
+	m.valid = false
+	for _, s := range m.sources {
+		if err := s.Close(); m.err == nil {
+			m.err = err
+		}
+	}
+	return m.err
+}
@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"context"
+	"github.com/dborchard/cometkv/pkg/logservice"
+	"github.com/dborchard/cometkv/pkg/sst"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walDirName = "wal"
+	sstDirName = "sst"
+)
+
+// Open starts a CometKV whose writes survive a restart. The SSTs persisted under dir
+// are reloaded and the WAL tail past the last flush checkpoint is replayed, at the
+// commit timestamps of its records, into a new memtable and the SSTs. Torn records
+// left at the end of the WAL by a crash are discarded. opts.SstType must be persistent.
+func Open(ctx context.Context, dir string, opts Options) (KV, error) {
+	if !opts.SstType.IsPersistent() {
+		return nil, ErrNotPersistent
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// 1. Reload SSTs
+	sstIO, err := sst.OpenSstIO(opts.SstType, filepath.Join(dir, sstDirName), opts.Sst)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Open WAL
+	walOpts := opts.WAL
+	walOpts.Dir = filepath.Join(dir, walDirName)
+	wal, err := logservice.Open(walOpts)
+	if err != nil {
+		_ = sstIO.Close()
+		return nil, err
+	}
+
+	// 3. Replay WAL into the memtable
+	kv := CometKV{
+		mem:    NewMemtable(opts.MemtableType, opts.GcInterval, opts.TTL, false, ctx),
+		sst:    sstIO,
+		sstTyp: opts.SstType,
+		wal:    wal,
+		ttl:    opts.TTL,
+		oracle: newOracle(),
+
+		onBackgroundError: opts.OnBackgroundError,
+	}
+	// the WAL checkpoint follows the SST MANIFEST, and may lag behind it after a crash.
+	flushedSeq := wal.LastCheckpoint().Seq
+	if seq := sstIO.FlushedSeq(); seq > flushedSeq {
+		flushedSeq = seq
+	}
+	var versions []entry.Pair[[]byte, []byte]
+	var tombstones []entry.RangeTombstone
+	lastSeq, lastTs := flushedSeq, uint64(0)
+	err = wal.Replay(flushedSeq, func(r logservice.Record) error {
+		logservice.Apply(kv.mem, r.Records(), r.Ts)
+		recVersions, recTombstones := logservice.Versions(r.Records(), r.Ts)
+		versions = append(versions, recVersions...)
+		tombstones = append(tombstones, recTombstones...)
+		lastSeq = r.Seq
+		if r.Ts > lastTs {
+			lastTs = r.Ts
+		}
+		return nil
+	})
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	// new commits are above the replayed ones, even if the clock went back
+	kv.oracle.advance(lastTs)
+	kv.oracle.advance(wal.LastCheckpoint().Ts)
+
+	// 4. Flush the replayed records at their commit timestamps: the memtable no longer
+	// serves those older than the TTL.
+	if lastSeq > flushedSeq {
+		if err = kv.sst.Create(versions, tombstones, lastSeq); err != nil {
+			kv.Close()
+			return nil, err
+		}
+		if err = wal.Checkpoint(logservice.Checkpoint{Seq: lastSeq, Ts: lastTs}); err != nil {
+			kv.Close()
+			return nil, err
+		}
+		kv.lastFlushTs.Store(lastTs)
+	}
+
+	kv.startFlushThread(opts.FlushInterval, ctx)
+	kv.startCompactionThread(opts.CompactionInterval, ctx)
+	return &kv, nil
+}
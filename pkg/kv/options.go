@@ -0,0 +1,106 @@
+package kv
+
+import (
+	"github.com/dborchard/cometkv/pkg/logservice"
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/sst"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"time"
+)
+
+// Option is a function used to configure CometKV
+type Option func(kv *CometKV)
+
+// PutOption is a function used to configure a single Put.
+type PutOption func(op *batchOp)
+
+// WithTTL expires the value d after it is committed, sooner than the store-wide TTL.
+// Reads at later snapshots see the key as deleted, and the memtable GC reclaims it.
+// Once reclaimed, reads at the snapshots before the expiry see it as deleted too.
+func WithTTL(d time.Duration) PutOption {
+	return func(op *batchOp) {
+		op.ttl = d
+	}
+}
+
+// ScanOption is a function used to bound, or reverse, a Scan or an Iterator.
+type ScanOption func(b *entry.Bounds)
+
+// WithEndKey stops the scan before key.
+func WithEndKey(key string) ScanOption {
+	return func(b *entry.Bounds) {
+		b.EndKey = key
+	}
+}
+
+// WithPrefix keeps the scan within the keys starting with prefix. Keys of other
+// prefixes are not read.
+func WithPrefix(prefix string) ScanOption {
+	return func(b *entry.Bounds) {
+		b.Prefix = prefix
+	}
+}
+
+// WithReverse scans in descending key order, from the keys at or before the start
+// key. An empty start key starts at the last key.
+func WithReverse() ScanOption {
+	return func(b *entry.Bounds) {
+		b.Reverse = true
+	}
+}
+
+func scanBounds(opts []ScanOption) entry.Bounds {
+	var b entry.Bounds
+	for _, opt := range opts {
+		opt(&b)
+	}
+	return b
+}
+
+// WithWAL logs every Put and Delete to wal before it is applied to the memtable.
+func WithWAL(wal *logservice.WAL) Option {
+	return func(kv *CometKV) {
+		kv.wal = wal
+	}
+}
+
+// WithBackgroundErrorHandler calls fn with the errors of the background flushes and
+// compactions, which are otherwise dropped.
+func WithBackgroundErrorHandler(fn func(err error)) Option {
+	return func(kv *CometKV) {
+		kv.onBackgroundError = fn
+	}
+}
+
+// Options configures a CometKV started with Open.
+type Options struct {
+	MemtableType memtable.Typ
+	// SstType must be persistent, as the WAL is truncated once the SSTs hold its records.
+	SstType       sst.Type
+	GcInterval    time.Duration
+	TTL           time.Duration
+	FlushInterval time.Duration
+	// CompactionInterval is how often the SSTs are checked for a due compaction.
+	CompactionInterval time.Duration
+
+	// OnBackgroundError, if set, is called with the errors of the background flushes
+	// and compactions. Both are retried on their next tick.
+	OnBackgroundError func(err error)
+
+	// WAL.Dir is ignored, the log always lives in <dir>/wal.
+	WAL logservice.Options
+	Sst sst.Options
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MemtableType:       memtable.HWTBTree,
+		SstType:            sst.Disk,
+		GcInterval:         30 * time.Second,
+		TTL:                3 * time.Minute,
+		FlushInterval:      1 * time.Minute,
+		CompactionInterval: 1 * time.Minute,
+		WAL:                logservice.DefaultOptions(""),
+		Sst:                sst.DefaultOptions(),
+	}
+}
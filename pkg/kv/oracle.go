@@ -0,0 +1,91 @@
+package kv
+
+import (
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"sync"
+)
+
+// oracle hands out the commit timestamps of writes and lets reads wait for the
+// commits at or below their snapshot, so that a batch is seen whole or not at all.
+type oracle struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// lastTs is the highest timestamp handed out or fenced. Commits are always above it.
+	lastTs uint64
+	// pending holds the timestamps of the commits being applied, in ascending order.
+	pending []uint64
+}
+
+func newOracle() *oracle {
+	o := &oracle{}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// begin returns a commit timestamp above every earlier one, pending until done.
+func (o *oracle) begin() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ts := timestamp.Now()
+	if ts <= o.lastTs {
+		ts = o.lastTs + 1
+	}
+	o.lastTs = ts
+	o.pending = append(o.pending, ts)
+	return ts
+}
+
+// done marks the commit at ts as applied.
+func (o *oracle) done(ts uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, p := range o.pending {
+		if p == ts {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+	o.cond.Broadcast()
+}
+
+// waitFor blocks until every commit at or below snapshotTs is applied. Commits that
+// begin later are placed above snapshotTs, unless it is in the future.
+func (o *oracle) waitFor(snapshotTs uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fence := timestamp.Now()
+	if snapshotTs < fence {
+		fence = snapshotTs
+	}
+	if fence > o.lastTs {
+		o.lastTs = fence
+	}
+	for len(o.pending) > 0 && o.pending[0] <= snapshotTs {
+		o.cond.Wait()
+	}
+}
+
+// fence returns a timestamp at or above every commit handed out so far, and places the
+// later commits above it.
+func (o *oracle) fence() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if ts := timestamp.Now(); ts > o.lastTs {
+		o.lastTs = ts
+	}
+	return o.lastTs
+}
+
+// advance places the later commits above ts, the last commit replayed on Open.
+func (o *oracle) advance(ts uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if ts > o.lastTs {
+		o.lastTs = ts
+	}
+}
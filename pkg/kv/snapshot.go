@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a read view of the KV pinned at its timestamp. Until it is released,
+// compaction and the GC of the vacuum memtables keep the versions it sees, so that its
+// reads stay consistent past the TTL. The other memtables are flushed before its
+// versions expire from them. It must be released.
+type Snapshot struct {
+	kv *CometKV
+	ts uint64
+	// kept is set when the memtable keeps the versions of the snapshot past the TTL.
+	kept     bool
+	released atomic.Bool
+}
+
+// NewSnapshot pins a snapshot of every commit so far.
+func (c *CometKV) NewSnapshot() (*Snapshot, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	ts := c.oracle.fence()
+	c.oracle.waitFor(ts)
+	kept := c.pinSnapshot(ts)
+	if !kept {
+		c.flushForSnapshot(ts)
+	}
+	return &Snapshot{kv: c, ts: ts, kept: kept}, nil
+}
+
+// flushForSnapshot flushes the memtable, unless a flush already covers ts, before the
+// versions of the snapshot at ts expire from it. The oldest version not yet flushed
+// expires a TTL after the last flush.
+func (c *CometKV) flushForSnapshot(ts uint64) {
+	deadline := time.Unix(0, int64(c.lastFlushTs.Load())).Add(c.ttl / 2)
+	time.AfterFunc(time.Until(deadline), func() {
+		if c.lastFlushTs.Load() >= ts {
+			return
+		}
+		if err := c.flush(); err != nil && err != ErrClosed {
+			c.backgroundError(fmt.Errorf("kv: flush: %w", err))
+		}
+	})
+}
+
+func (s *Snapshot) Ts() time.Time {
+	return time.Unix(0, int64(s.ts))
+}
+
+func (s *Snapshot) Get(key string) ([]byte, bool, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, false, err
+	}
+	return s.kv.get(key, s.Ts())
+}
+
+func (s *Snapshot) Scan(startKey string, count int, opts ...ScanOption) ([]entry.Pair[string, []byte], error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	return s.kv.scan(startKey, count, s.Ts(), scanBounds(opts))
+}
+
+// NewIterator must be closed before the snapshot is released.
+func (s *Snapshot) NewIterator(opts ...ScanOption) (iterator.Iterator, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	return s.kv.newIterator(s.Ts(), iterator.DefaultPageSize, scanBounds(opts)), nil
+}
+
+// Release unpins the snapshot. Later reads fail with ErrSnapshotReleased.
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+	s.kv.unpinSnapshot(s.ts)
+}
+
+// checkRead fails reads after Release or Close. Past the TTL, a snapshot the memtable
+// does not keep is read from the SSTs alone, which hold every version it sees once a
+// flush ran after it.
+func (s *Snapshot) checkRead() error {
+	if s.released.Load() {
+		return ErrSnapshotReleased
+	}
+	if s.kv.closed.Load() {
+		return ErrClosed
+	}
+	if !s.kept && s.Ts().Before(s.kv.oldestSnapshotTs()) && s.kv.lastFlushTs.Load() < s.ts {
+		return ErrSnapshotExpired
+	}
+	return nil
+}
+
+// pinSnapshot pins the snapshot at ts, and reports whether the memtable keeps its
+// versions.
+func (c *CometKV) pinSnapshot(ts uint64) bool {
+	c.snapshotsMu.Lock()
+	defer c.snapshotsMu.Unlock()
+	if c.snapshots == nil {
+		c.snapshots = make(map[uint64]int)
+	}
+	c.snapshots[ts]++
+	return c.mem.SetOldestSnapshot(c.oldestPinnedTs())
+}
+
+func (c *CometKV) unpinSnapshot(ts uint64) {
+	c.snapshotsMu.Lock()
+	defer c.snapshotsMu.Unlock()
+	if c.snapshots[ts]--; c.snapshots[ts] == 0 {
+		delete(c.snapshots, ts)
+	}
+	c.mem.SetOldestSnapshot(c.oldestPinnedTs())
+}
+
+// oldestPinnedTs returns the oldest pinned snapshot, zero if there is none. The caller
+// holds snapshotsMu.
+func (c *CometKV) oldestPinnedTs() uint64 {
+	var oldest uint64
+	for ts := range c.snapshots {
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	return oldest
+}
+
+// gcTs is the oldest snapshot whose versions compaction keeps: the oldest pinned
+// snapshot, if older than those reads are served at.
+func (c *CometKV) gcTs() time.Time {
+	c.snapshotsMu.Lock()
+	pinned := c.oldestPinnedTs()
+	c.snapshotsMu.Unlock()
+
+	oldest := c.oldestSnapshotTs()
+	if pinned != 0 && pinned < timestamp.ToUnit64(oldest) {
+		return time.Unix(0, int64(pinned))
+	}
+	return oldest
+}
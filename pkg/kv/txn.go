@@ -0,0 +1,256 @@
+package kv
+
+import (
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+	"sort"
+	"time"
+)
+
+// TxnOptions configures a transaction started with Begin.
+type TxnOptions struct {
+	// Serializable also fails the commit when a key read, or a range scanned, by the
+	// transaction was written after it began. Otherwise only the written keys are
+	// checked, which gives snapshot isolation.
+	Serializable bool
+}
+
+// Txn is an optimistic transaction. Reads see the snapshot taken by Begin plus the own
+// writes of the transaction, which are buffered until Commit. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+	kv           *CometKV
+	readTs       uint64
+	serializable bool
+
+	// writes holds the buffered writes, with a nil value for a delete.
+	writes map[string][]byte
+	reads  map[string]struct{}
+	// scans holds the ranges [start, end) scanned up to the last key read. tails holds
+	// the start of the ranges that scans read to the end of the keys, as no key was
+	// visible past them.
+	scans []keyRange
+	tails []string
+	done  bool
+}
+
+type keyRange struct {
+	start, end string
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && key < r.end
+}
+
+func (c *CometKV) Begin(opts TxnOptions) (*Txn, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	return &Txn{
+		kv:           c,
+		readTs:       c.oracle.fence(),
+		serializable: opts.Serializable,
+		writes:       make(map[string][]byte),
+		reads:        make(map[string]struct{}),
+	}, nil
+}
+
+// ReadTs returns the timestamp of the snapshot read by the transaction.
+func (t *Txn) ReadTs() time.Time {
+	return time.Unix(0, int64(t.readTs))
+}
+
+func (t *Txn) Put(key string, val []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[key] = append([]byte{}, val...)
+	return nil
+}
+
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[key] = nil
+	return nil
+}
+
+// Get is KV.Get at the snapshot of the transaction, over its own writes.
+func (t *Txn) Get(key string) ([]byte, bool, error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+	if val, ok := t.writes[key]; ok {
+		if val == nil {
+			return nil, false, ErrDeleted
+		}
+		return val, true, nil
+	}
+
+	t.reads[key] = struct{}{}
+	return t.kv.Get(key, t.ReadTs())
+}
+
+// Scan is KV.Scan at the snapshot of the transaction, over its own writes.
+func (t *Txn) Scan(startKey string, count int) ([]entry.Pair[string, []byte], error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	// 1. Own deletes hide at most len(t.writes) of the stored keys
+	limit := count + len(t.writes)
+	rows, err := t.kv.Scan(startKey, limit, t.ReadTs())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Overlay the own writes up to the last stored key read
+	merged := make(map[string][]byte, len(rows))
+	for _, row := range rows {
+		merged[row.Key] = row.Val
+	}
+	for key, val := range t.writes {
+		if key < startKey || (len(rows) == limit && key > rows[len(rows)-1].Key) {
+			continue
+		}
+		if val == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = val
+		}
+	}
+	res := make([]entry.Pair[string, []byte], 0, len(merged))
+	for key, val := range merged {
+		res = append(res, entry.Pair[string, []byte]{Key: key, Val: val})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	if len(res) > count {
+		res = res[:count]
+	}
+
+	// 3. The range read, for serializable commits. A short scan also read that no key
+	// follows the last stored one.
+	switch {
+	case len(res) == count:
+		t.scans = append(t.scans, keyRange{start: startKey, end: res[len(res)-1].Key + "\x00"})
+	case len(rows) > 0:
+		end := rows[len(rows)-1].Key + "\x00"
+		t.scans = append(t.scans, keyRange{start: startKey, end: end})
+		t.tails = append(t.tails, end)
+	default:
+		t.tails = append(t.tails, startKey)
+	}
+	return res, nil
+}
+
+// Commit applies the writes of the transaction atomically, as KV.Write. It fails with
+// ErrConflict if a written key, or with Serializable a key read, was committed by
+// someone else after the transaction began.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	if len(t.writes) == 0 {
+		// read-only transactions read a consistent snapshot, and always commit
+		return nil
+	}
+	if t.ReadTs().Before(t.kv.oldestSnapshotTs()) {
+		// the versions to check against may be garbage collected
+		return ErrSnapshotExpired
+	}
+
+	keys := make([]string, 0, len(t.writes))
+	for key := range t.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b WriteBatch
+	for _, key := range keys {
+		if val := t.writes[key]; val == nil {
+			b.Delete(key)
+		} else {
+			b.Put(key, val)
+		}
+	}
+	return t.kv.write(&b, t.validate)
+}
+
+// Discard drops the writes of the transaction.
+func (t *Txn) Discard() {
+	t.done = true
+}
+
+// validate runs once every commit below commitTs is applied, and fails if one of them
+// wrote a key the transaction depends on after its read timestamp.
+func (t *Txn) validate(commitTs uint64) error {
+	check := make([]keyRange, 0, len(t.writes)+len(t.reads)+len(t.scans))
+	for key := range t.writes {
+		check = append(check, keyRange{start: key, end: key + "\x00"})
+	}
+	if t.serializable {
+		for key := range t.reads {
+			check = append(check, keyRange{start: key, end: key + "\x00"})
+		}
+		check = append(check, t.scans...)
+	}
+
+	for _, r := range check {
+		changed, err := t.kv.changedBetween(r, t.readTs, commitTs)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return ErrConflict
+		}
+	}
+
+	// a tail had no visible key at the read timestamp, so it still has none if nothing
+	// was inserted in it since
+	if t.serializable {
+		for _, start := range t.tails {
+			rows, err := t.kv.scan(start, 1, time.Unix(0, int64(commitTs-1)), entry.Bounds{})
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
+
+// changedBetween reports whether a key of r has a version or a range tombstone in
+// (fromTs, toTs], in the memtable or the SSTs.
+func (c *CometKV) changedBetween(r keyRange, fromTs, toTs uint64) (bool, error) {
+	latest := time.Unix(0, int64(toTs))
+	for _, t := range c.rangeTombstones(latest) {
+		if t.Ts > fromTs && t.Overlaps(r.start, r.end) {
+			return true, nil
+		}
+	}
+
+	sources := []iterator.Iterator{
+		c.mem.NewIterator(memtable.ScanOptions{SnapshotTs: latest}),
+		c.sst.NewIterator(latest, entry.Bounds{}),
+	}
+	for _, it := range sources {
+		changed := false
+		for it.Seek(r.start); it.Valid() && r.contains(string(entry.ParseKey(it.Key()))); it.Next() {
+			if entry.ParseTs(it.Key()) > fromTs {
+				changed = true
+				break
+			}
+		}
+		if err := it.Close(); err != nil || changed {
+			return changed, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+package kv
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTxn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put("1", []byte("a")))
+	require.NoError(t, db.Put("2", []byte("b")))
+
+	txn := must(db.Begin(TxnOptions{}))
+	require.NoError(t, db.Put("3", []byte("c")))
+
+	// the snapshot of Begin, over the own writes
+	require.NoError(t, txn.Put("4", []byte("d")))
+	require.NoError(t, txn.Delete("1"))
+	_, found, err := txn.Get("1")
+	assert.False(t, found)
+	assert.ErrorIs(t, err, ErrDeleted)
+	_, _, err = txn.Get("3")
+	assert.ErrorIs(t, err, ErrNotFound)
+	rows := must(txn.Scan("", 10))
+	require.Equal(t, 2, len(rows))
+	assert.Equal(t, "2", rows[0].Key)
+	assert.Equal(t, "4", rows[1].Key)
+	_, _, err = db.Get("4", time.Now())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, txn.Commit())
+	assert.ErrorIs(t, txn.Commit(), ErrTxnDone)
+	rows = must(db.Scan("", 10, time.Now()))
+	require.Equal(t, 3, len(rows))
+	assert.Equal(t, "2", rows[0].Key)
+	assert.Equal(t, "3", rows[1].Key)
+	assert.Equal(t, "4", rows[2].Key)
+}
+
+func TestTxnConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := Open(ctx, t.TempDir(), testOptions())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put("x", []byte("0")))
+	require.NoError(t, db.Put("y", []byte("0")))
+
+	// write-write conflicts fail the later commit
+	t1 := must(db.Begin(TxnOptions{}))
+	t2 := must(db.Begin(TxnOptions{}))
+	require.NoError(t, t1.Put("x", []byte("1")))
+	require.NoError(t, t2.Put("x", []byte("2")))
+	require.NoError(t, t1.Commit())
+	assert.ErrorIs(t, t2.Commit(), ErrConflict)
+	assert.Equal(t, []byte("1"), mustGet(t, db, "x"))
+
+	// write skew commits under snapshot isolation, but not when serializable
+	for _, serializable := range []bool{false, true} {
+		t1 = must(db.Begin(TxnOptions{Serializable: serializable}))
+		t2 = must(db.Begin(TxnOptions{Serializable: serializable}))
+		_, _, err = t1.Get("y")
+		require.NoError(t, err)
+		_, _, err = t2.Get("x")
+		require.NoError(t, err)
+		require.NoError(t, t1.Put("x", []byte("3")))
+		require.NoError(t, t2.Put("y", []byte("3")))
+		require.NoError(t, t1.Commit())
+		if serializable {
+			assert.ErrorIs(t, t2.Commit(), ErrConflict)
+		} else {
+			assert.NoError(t, t2.Commit())
+		}
+	}
+
+	// a key inserted in a scanned range is a conflict when serializable
+	t1 = must(db.Begin(TxnOptions{Serializable: true}))
+	_ = must(t1.Scan("a", 10))
+	require.NoError(t, t1.Put("b", []byte("1")))
+	require.NoError(t, db.Put("z", []byte("1")))
+	assert.ErrorIs(t, t1.Commit(), ErrConflict)
+
+	// past the last key of a short scan, only keys that become visible conflict
+	t1 = must(db.Begin(TxnOptions{Serializable: true}))
+	_ = must(t1.Scan("a", 10))
+	require.NoError(t, t1.Put("b", []byte("2")))
+	require.NoError(t, db.Delete("zz"))
+	require.NoError(t, db.Put("zzz", []byte("1")))
+	require.NoError(t, db.Delete("zzz"))
+	assert.NoError(t, t1.Commit())
+
+	// a full scan read up to its last key only
+	t1 = must(db.Begin(TxnOptions{Serializable: true}))
+	_ = must(t1.Scan("a", 2))
+	require.NoError(t, t1.Put("c", []byte("1")))
+	require.NoError(t, db.Put("z", []byte("2")))
+	assert.NoError(t, t1.Commit())
+}
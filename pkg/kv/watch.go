@@ -0,0 +1,331 @@
+package kv
+
+import (
+	"context"
+	"github.com/dborchard/cometkv/pkg/logservice"
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"math"
+	"sort"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	// EventDeleteRange deletes the keys of [Key, End).
+	EventDeleteRange
+)
+
+// Event is a mutation streamed by a Watcher.
+type Event struct {
+	Typ EventType
+	Key string
+	// End is the exclusive end of an EventDeleteRange.
+	End string
+	// Val is the value of an EventPut.
+	Val []byte
+	// Ts is the commit timestamp of the mutation.
+	Ts time.Time
+}
+
+// Watcher streams the events of a Watch. It must be closed.
+type Watcher struct {
+	events chan Event
+	cancel context.CancelFunc
+	err    error
+}
+
+// Events returns the events, in commit order. It is closed when the watcher stops,
+// after which Err tells why.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns ErrSnapshotExpired if the watcher fell behind the TTL, and ErrClosed if
+// the KV was closed. It is only set once Events is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.cancel()
+	// drain, so that the stream stops
+	for range w.events {
+	}
+}
+
+// Watch streams the Put, Delete and DeleteRange mutations of the keys at or after
+// startKey, within the WithEndKey and WithPrefix bounds, committed after fromTs. The
+// events up to the Watch are read from the versions of the memtable, rebuilt from the
+// WAL on Open, so fromTs must be within the TTL. The later ones are read from the log of
+// the commits kept while watchers are registered. The watcher stops when ctx is done.
+func (c *CometKV) Watch(ctx context.Context, startKey string, fromTs time.Time, opts ...ScanOption) (*Watcher, error) {
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	if fromTs.Before(c.oldestSnapshotTs()) {
+		return nil, ErrSnapshotExpired
+	}
+
+	bounds := scanBounds(opts)
+	bounds.Reverse = false
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{events: make(chan Event, iterator.DefaultPageSize), cancel: cancel}
+	go func() {
+		defer close(w.events)
+		w.err = c.watch(ctx, startKey, bounds, timestamp.ToUnit64(fromTs), w.events)
+	}()
+	return w, nil
+}
+
+// minWatchInterval bounds the ticker of the watchers under a short TTL.
+const minWatchInterval = time.Millisecond
+
+// watch sends the events after lastTs to events until ctx is done. Every commit wakes
+// it, and so does a ticker, so that lastTs keeps up with the TTL on an idle range.
+func (c *CometKV) watch(ctx context.Context, startKey string, bounds entry.Bounds, lastTs uint64, events chan<- Event) error {
+	interval := c.ttl / 4
+	if interval < minWatchInterval {
+		interval = minWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	cursor := c.addWatcher()
+	defer c.removeWatcher(cursor)
+
+	backfilled := false
+	for {
+		// 1. Every commit at or below safeTs is applied, and later ones are above it
+		notify := c.watchNotify()
+		safeTs := c.oracle.fence()
+		c.oracle.waitFor(safeTs)
+		if c.closed.Load() {
+			return ErrClosed
+		}
+		if time.Unix(0, int64(lastTs)).Before(c.oldestSnapshotTs()) {
+			return ErrSnapshotExpired
+		}
+
+		// 2. Send the events of (lastTs, safeTs], from the memtable the first time as the
+		// log only holds the commits since the watcher was added
+		var changes []Event
+		if backfilled {
+			changes = c.changes(cursor, startKey, bounds, lastTs, safeTs)
+		} else {
+			changes = c.history(startKey, bounds, lastTs, safeTs)
+			backfilled = true
+		}
+		for _, e := range changes {
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		lastTs = safeTs
+
+		select {
+		case <-notify:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// committedBatch is a batch of the watch log.
+type committedBatch struct {
+	ts  uint64
+	ops []logservice.Record
+}
+
+// watchCursor is the position in the watch log of the first batch a watcher does not
+// yet know to be at or below what it sent: concurrent commits may be logged out of
+// order.
+type watchCursor struct {
+	pos int
+}
+
+// addWatcher registers a watcher, so that the next commits are logged for it.
+func (c *CometKV) addWatcher() *watchCursor {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	if c.watchers == nil {
+		c.watchers = make(map[*watchCursor]struct{})
+	}
+	cursor := &watchCursor{pos: c.watchLogBase + len(c.watchLog)}
+	c.watchers[cursor] = struct{}{}
+	return cursor
+}
+
+func (c *CometKV) removeWatcher(cursor *watchCursor) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	delete(c.watchers, cursor)
+	c.trimWatchLog()
+}
+
+// publish adds the batch committed at ts to the watch log if a watcher is registered,
+// and wakes the watchers.
+func (c *CometKV) publish(ts uint64, ops []logservice.Record) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	if len(c.watchers) > 0 {
+		c.watchLog = append(c.watchLog, committedBatch{ts: ts, ops: ops})
+		c.trimWatchLog()
+	}
+	if c.watchCh != nil {
+		close(c.watchCh)
+		c.watchCh = nil
+	}
+}
+
+// trimWatchLog drops the batches every watcher has read, and the ones older than the
+// TTL, which a watcher so far behind fails on. It is called with watchMu held.
+func (c *CometKV) trimWatchLog() {
+	end := c.watchLogBase + len(c.watchLog)
+	for cursor := range c.watchers {
+		if cursor.pos < end {
+			end = cursor.pos
+		}
+	}
+	expiredTs := timestamp.ToUnit64(c.oldestSnapshotTs())
+	n := 0
+	for n < len(c.watchLog) && (c.watchLogBase+n < end || c.watchLog[n].ts < expiredTs) {
+		c.watchLog[n] = committedBatch{}
+		n++
+	}
+	c.watchLog = c.watchLog[n:]
+	c.watchLogBase += n
+	if len(c.watchLog) == 0 {
+		c.watchLog = nil
+	}
+}
+
+// changes returns the events of the watch log committed in (fromTs, toTs], ordered by
+// commit timestamp, and moves cursor past the batches read.
+func (c *CometKV) changes(cursor *watchCursor, startKey string, bounds entry.Bounds, fromTs, toTs uint64) []Event {
+	start := bounds.Start(startKey)
+
+	c.watchMu.Lock()
+	if cursor.pos < c.watchLogBase {
+		cursor.pos = c.watchLogBase
+	}
+	next := -1
+	var events []Event
+	for i, b := range c.watchLog[cursor.pos-c.watchLogBase:] {
+		if b.ts > toTs {
+			if next < 0 {
+				next = cursor.pos + i
+			}
+			continue
+		}
+		if b.ts > fromTs {
+			events = appendEvents(events, b, start, bounds)
+		}
+	}
+	if next < 0 {
+		next = c.watchLogBase + len(c.watchLog)
+	}
+	cursor.pos = next
+	c.trimWatchLog()
+	c.watchMu.Unlock()
+
+	sortEvents(events)
+	return events
+}
+
+// history returns the events of the memtable committed in (fromTs, toTs], ordered by
+// commit timestamp.
+func (c *CometKV) history(startKey string, bounds entry.Bounds, fromTs, toTs uint64) []Event {
+	snapshotTs := time.Unix(0, int64(toTs))
+
+	var events []Event
+	for _, version := range c.mem.ScanHistory(startKey, math.MaxInt, memtable.ScanOptions{SnapshotTs: snapshotTs, Bounds: bounds}) {
+		ts := entry.ParseTs(version.Key)
+		if ts <= fromTs {
+			continue
+		}
+		e := Event{Typ: EventDelete, Key: string(entry.ParseKey(version.Key)), Ts: time.Unix(0, int64(ts))}
+		if version.Val != nil {
+			e.Typ = EventPut
+			e.Val, _ = entry.DecodeValue(version.Val)
+		}
+		events = append(events, e)
+	}
+	for _, t := range c.mem.RangeTombstones(snapshotTs) {
+		if t.Ts > fromTs && t.Overlaps(bounds.Start(startKey), bounds.End()) {
+			events = append(events, Event{Typ: EventDeleteRange, Key: t.Start, End: t.End, Ts: time.Unix(0, int64(t.Ts))})
+		}
+	}
+
+	sortEvents(events)
+	return events
+}
+
+// sortEvents orders events by commit timestamp. Within a batch, a DeleteRange comes
+// first, as it does not delete the keys the batch puts.
+func sortEvents(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Ts.Equal(events[j].Ts) {
+			return events[i].Ts.Before(events[j].Ts)
+		}
+		if (events[i].Typ == EventDeleteRange) != (events[j].Typ == EventDeleteRange) {
+			return events[i].Typ == EventDeleteRange
+		}
+		return events[i].Key < events[j].Key
+	})
+}
+
+// appendEvents appends the events of b within [start, bounds.End()). Like in the
+// memtable, the last mutation of a key in the batch wins.
+func appendEvents(events []Event, b committedBatch, start string, bounds entry.Bounds) []Event {
+	ts := time.Unix(0, int64(b.ts))
+	last := make(map[string]int, len(b.ops))
+	for i, r := range b.ops {
+		last[r.Key] = i
+	}
+	for i, r := range b.ops {
+		switch {
+		case r.Typ == logservice.RecordDeleteRange:
+			t := entry.RangeTombstone{Start: r.Key, End: string(r.Val), Ts: b.ts}
+			if t.Overlaps(start, bounds.End()) {
+				events = append(events, Event{Typ: EventDeleteRange, Key: t.Start, End: t.End, Ts: ts})
+			}
+		case last[r.Key] != i || r.Key < start || !bounds.Contains(r.Key):
+		case r.Typ == logservice.RecordDelete:
+			events = append(events, Event{Typ: EventDelete, Key: r.Key, Ts: ts})
+		default:
+			val, _ := entry.DecodeValue(r.Val)
+			events = append(events, Event{Typ: EventPut, Key: r.Key, Val: val, Ts: ts})
+		}
+	}
+	return events
+}
+
+// watchNotify returns a channel closed by the next commit.
+func (c *CometKV) watchNotify() <-chan struct{} {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	if c.watchCh == nil {
+		c.watchCh = make(chan struct{})
+	}
+	return c.watchCh
+}
+
+// notifyWatchers wakes the watchers on Close.
+func (c *CometKV) notifyWatchers() {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	if c.watchCh != nil {
+		close(c.watchCh)
+		c.watchCh = nil
+	}
+}
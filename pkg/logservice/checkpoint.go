@@ -0,0 +1,108 @@
+package logservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const checkpointFileName = "CHECKPOINT"
+
+// Checkpoint is the high-water mark of the writes persisted outside the WAL.
+// Every record with Seq <= Checkpoint.Seq is no longer needed for recovery.
+type Checkpoint struct {
+	Seq uint64
+	Ts  uint64
+}
+
+// Checkpoint persists cp and deletes the segments it fully covers. The active
+// segment is never deleted.
+func (w *WAL) Checkpoint(cp Checkpoint) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if cp.Seq <= w.checkpoint.Seq {
+		return nil
+	}
+	if err := writeCheckpoint(w.opts.Dir, cp); err != nil {
+		return err
+	}
+	w.checkpoint = cp
+
+	// segments[i] holds seqs [segments[i], segments[i+1]-1]
+	removed := 0
+	for i := 0; i+1 < len(w.segments); i++ {
+		if w.segments[i+1]-1 > cp.Seq {
+			break
+		}
+		if err := os.Remove(w.segmentPath(w.segments[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	w.segments = w.segments[removed:]
+	if removed > 0 {
+		return syncDir(w.opts.Dir)
+	}
+	return nil
+}
+
+// LastCheckpoint returns the checkpoint recorded by the latest Checkpoint call,
+// including the one found on disk by Open.
+func (w *WAL) LastCheckpoint() Checkpoint {
+	w.Lock()
+	defer w.Unlock()
+	return w.checkpoint
+}
+
+// writeCheckpoint atomically replaces the checkpoint file.
+// Layout: | crc32c | seq | ts |
+func writeCheckpoint(dir string, cp Checkpoint) error {
+	buf := make([]byte, 4, 20)
+	buf = binary.BigEndian.AppendUint64(buf, cp.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, cp.Ts)
+	binary.BigEndian.PutUint32(buf, crc32.Checksum(buf[4:], crcTable))
+
+	tmpPath := filepath.Join(dir, checkpointFileName+".tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(dir, checkpointFileName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readCheckpoint returns the zero Checkpoint when none was written yet.
+func readCheckpoint(dir string) (Checkpoint, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, checkpointFileName))
+	if os.IsNotExist(err) {
+		return Checkpoint{}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	if len(buf) != 20 || crc32.Checksum(buf[4:], crcTable) != binary.BigEndian.Uint32(buf) {
+		return Checkpoint{}, fmt.Errorf("%s: %w", checkpointFileName, ErrCorruptRecord)
+	}
+	return Checkpoint{
+		Seq: binary.BigEndian.Uint64(buf[4:]),
+		Ts:  binary.BigEndian.Uint64(buf[12:]),
+	}, nil
+}
@@ -0,0 +1,184 @@
+package logservice
+
+import (
+	movingaverage "github.com/RobinUS2/golang-moving-average"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"sync"
+	"time"
+)
+
+// statsWindow is the number of batches the moving averages are computed over.
+const statsWindow = 1024
+
+type commitReq struct {
+	rec     Record
+	startTs time.Time
+	err     error
+	done    chan struct{}
+}
+
+// Stats describes the group-commit pipeline. Averages cover the last statsWindow batches.
+type Stats struct {
+	Batches          uint64
+	Records          uint64
+	MaxBatchSize     int
+	AvgBatchSize     float64
+	AvgSyncLatency   time.Duration // one write + fsync of a batch
+	AvgCommitLatency time.Duration // Append call until the record is durable
+}
+
+type commitStats struct {
+	sync.Mutex
+	batches       uint64
+	records       uint64
+	maxBatchSize  int
+	batchSize     *movingaverage.MovingAverage
+	syncLatency   *movingaverage.MovingAverage
+	commitLatency *movingaverage.MovingAverage
+}
+
+func newCommitStats() *commitStats {
+	return &commitStats{
+		batchSize:     movingaverage.New(statsWindow),
+		syncLatency:   movingaverage.New(statsWindow),
+		commitLatency: movingaverage.New(statsWindow),
+	}
+}
+
+// Stats returns a snapshot of the group-commit statistics. It is empty unless the
+// SyncGroupCommit policy is used.
+func (w *WAL) Stats() Stats {
+	s := w.stats
+	s.Lock()
+	defer s.Unlock()
+
+	return Stats{
+		Batches:          s.batches,
+		Records:          s.records,
+		MaxBatchSize:     s.maxBatchSize,
+		AvgBatchSize:     s.batchSize.Avg(),
+		AvgSyncLatency:   time.Duration(s.syncLatency.Avg()),
+		AvgCommitLatency: time.Duration(s.commitLatency.Avg()),
+	}
+}
+
+// groupCommit hands rec to the commit thread and waits until its batch is durable.
+func (w *WAL) groupCommit(rec Record) (uint64, error) {
+	req := &commitReq{rec: rec, startTs: time.Now(), done: make(chan struct{})}
+
+	select {
+	case w.commitCh <- req:
+	case <-w.done:
+		return 0, ErrClosed
+	}
+
+	<-req.done
+	return req.rec.Seq, req.err
+}
+
+// startCommitThread coalesces concurrent appenders into batches of at most
+// Options.MaxBatchSize records, each written with one write and one fsync.
+func (w *WAL) startCommitThread() {
+	defer w.wg.Done()
+
+	batch := make([]*commitReq, 0, w.opts.MaxBatchSize)
+	for {
+		// 1. Block for the batch leader
+		select {
+		case req := <-w.commitCh:
+			batch = append(batch, req)
+		case <-w.done:
+			return
+		}
+
+		// 2. Collect followers
+		if w.opts.MaxBatchDelay > 0 {
+			timer := time.NewTimer(w.opts.MaxBatchDelay)
+			batch = w.collect(batch, timer.C)
+			timer.Stop()
+		} else {
+			batch = w.collect(batch, nil)
+		}
+
+		// 3. Commit
+		w.commitBatch(batch)
+		for i := range batch {
+			batch[i] = nil
+		}
+		batch = batch[:0]
+	}
+}
+
+// collect adds waiting appenders to batch until it is full. A nil timeout stops at the
+// first moment nobody is waiting; otherwise collect waits until timeout fires.
+func (w *WAL) collect(batch []*commitReq, timeout <-chan time.Time) []*commitReq {
+	for len(batch) < w.opts.MaxBatchSize {
+		if timeout == nil {
+			select {
+			case req := <-w.commitCh:
+				batch = append(batch, req)
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case req := <-w.commitCh:
+				batch = append(batch, req)
+			case <-timeout:
+				return batch
+			}
+		}
+	}
+	return batch
+}
+
+func (w *WAL) commitBatch(batch []*commitReq) {
+	syncStartTs := time.Now()
+
+	// 1. Assign sequences and write the batch at once
+	w.Lock()
+	firstSeq := w.lastSeq + 1
+	w.buf = w.buf[:0]
+	for i, req := range batch {
+		req.rec.Seq = firstSeq + uint64(i)
+		if req.rec.Ts == 0 {
+			req.rec.Ts = timestamp.ToUnit64(req.startTs)
+		}
+		w.buf = encodeRecord(w.buf, &req.rec)
+	}
+	err := w.writeLocked(w.buf, firstSeq)
+	if err == nil {
+		w.lastSeq = firstSeq + uint64(len(batch)) - 1
+	}
+	f := w.active
+	w.Unlock()
+
+	// 2. One fsync for every record of the batch
+	if err == nil {
+		if err = f.Sync(); err == nil {
+			w.advanceSynced(firstSeq + uint64(len(batch)) - 1)
+		}
+	}
+	endTs := time.Now()
+
+	// 3. Release the appenders
+	for _, req := range batch {
+		req.err = err
+		close(req.done)
+	}
+
+	w.stats.Lock()
+	w.stats.batches++
+	w.stats.records += uint64(len(batch))
+	if len(batch) > w.stats.maxBatchSize {
+		w.stats.maxBatchSize = len(batch)
+	}
+	w.stats.batchSize.Add(float64(len(batch)))
+	w.stats.syncLatency.Add(float64(endTs.Sub(syncStartTs)))
+	var commitLatency time.Duration
+	for _, req := range batch {
+		commitLatency += endTs.Sub(req.startTs)
+	}
+	w.stats.commitLatency.Add(float64(commitLatency) / float64(len(batch)))
+	w.stats.Unlock()
+}
@@ -0,0 +1,184 @@
+package logservice
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+type RecordType byte
+
+const (
+	RecordPut RecordType = iota + 1
+	RecordDelete
+	// RecordBatch holds the Put, Delete and DeleteRange mutations of Batch, committed at
+	// a single Ts.
+	RecordBatch
+	// RecordDeleteRange deletes the keys of [Key, Val).
+	RecordDeleteRange
+)
+
+// Record is a single mutation persisted in the WAL.
+type Record struct {
+	Seq uint64
+	Ts  uint64
+	Typ RecordType
+	Key string
+	Val []byte
+	// Batch is only set on a RecordBatch. Seq and Ts of its records are unused.
+	Batch []Record
+}
+
+// Records returns the mutations of r: the records of a RecordBatch, or r itself.
+func (r Record) Records() []Record {
+	if r.Typ == RecordBatch {
+		return r.Batch
+	}
+	return []Record{r}
+}
+
+// ErrCorruptRecord is returned when a record fails its checksum or cannot be decoded.
+var ErrCorruptRecord = errors.New("logservice: corrupt record")
+
+// headerSize is crc(4) + payload length(4)
+const headerSize = 8
+
+// fixedPayloadSize is seq(8) + ts(8) + typ(1)
+const fixedPayloadSize = 17
+
+// maxPayloadSize guards against allocating garbage lengths read from a damaged log.
+const maxPayloadSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecord appends the framed record to buf.
+// Layout: | crc32c | len | seq | ts | typ | keyLen(uvarint) | key | val |
+func encodeRecord(buf []byte, r *Record) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, headerSize)...)
+
+	buf = binary.BigEndian.AppendUint64(buf, r.Seq)
+	buf = binary.BigEndian.AppendUint64(buf, r.Ts)
+	buf = append(buf, byte(r.Typ))
+	buf = binary.AppendUvarint(buf, uint64(len(r.Key)))
+	buf = append(buf, r.Key...)
+	if r.Typ == RecordBatch {
+		buf = encodeBatch(buf, r.Batch)
+	} else {
+		buf = append(buf, r.Val...)
+	}
+
+	payload := buf[start+headerSize:]
+	binary.BigEndian.PutUint32(buf[start:], crc32.Checksum(payload, crcTable))
+	binary.BigEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+func decodeRecord(payload []byte) (Record, error) {
+	if len(payload) < fixedPayloadSize {
+		return Record{}, ErrCorruptRecord
+	}
+
+	r := Record{
+		Seq: binary.BigEndian.Uint64(payload[0:]),
+		Ts:  binary.BigEndian.Uint64(payload[8:]),
+		Typ: RecordType(payload[16]),
+	}
+
+	keyLen, n := binary.Uvarint(payload[fixedPayloadSize:])
+	if n <= 0 {
+		return Record{}, ErrCorruptRecord
+	}
+	keyStart := fixedPayloadSize + n
+	if uint64(len(payload)-keyStart) < keyLen {
+		return Record{}, ErrCorruptRecord
+	}
+	keyEnd := keyStart + int(keyLen)
+	r.Key = string(payload[keyStart:keyEnd])
+
+	switch r.Typ {
+	case RecordPut, RecordDeleteRange:
+		r.Val = append([]byte{}, payload[keyEnd:]...)
+	case RecordBatch:
+		batch, err := decodeBatch(payload[keyEnd:])
+		if err != nil {
+			return Record{}, err
+		}
+		r.Batch = batch
+	}
+	return r, nil
+}
+
+// encodeBatch appends the mutations of a batch to buf.
+// Layout of each: | typ | keyLen(uvarint) | key | valLen(uvarint) | val |
+func encodeBatch(buf []byte, batch []Record) []byte {
+	for i := range batch {
+		buf = append(buf, byte(batch[i].Typ))
+		buf = binary.AppendUvarint(buf, uint64(len(batch[i].Key)))
+		buf = append(buf, batch[i].Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(batch[i].Val)))
+		buf = append(buf, batch[i].Val...)
+	}
+	return buf
+}
+
+func decodeBatch(buf []byte) ([]Record, error) {
+	var batch []Record
+	for len(buf) > 0 {
+		r := Record{Typ: RecordType(buf[0])}
+		if r.Typ != RecordPut && r.Typ != RecordDelete && r.Typ != RecordDeleteRange {
+			return nil, ErrCorruptRecord
+		}
+		buf = buf[1:]
+
+		keyLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < keyLen {
+			return nil, ErrCorruptRecord
+		}
+		r.Key = string(buf[n : n+int(keyLen)])
+		buf = buf[n+int(keyLen):]
+
+		valLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < valLen {
+			return nil, ErrCorruptRecord
+		}
+		if r.Typ != RecordDelete {
+			r.Val = append([]byte{}, buf[n:n+int(valLen)]...)
+		}
+		buf = buf[n+int(valLen):]
+
+		batch = append(batch, r)
+	}
+	return batch, nil
+}
+
+// readRecord reads the next record from rd. It returns the number of bytes consumed.
+// io.EOF is returned on a clean end of the log, io.ErrUnexpectedEOF on a partially
+// written record and ErrCorruptRecord on a checksum mismatch.
+func readRecord(rd io.Reader) (Record, int, error) {
+	var header [headerSize]byte
+	if n, err := io.ReadFull(rd, header[:]); err != nil {
+		if err == io.EOF && n == 0 {
+			return Record{}, 0, io.EOF
+		}
+		return Record{}, n, io.ErrUnexpectedEOF
+	}
+
+	crc := binary.BigEndian.Uint32(header[0:])
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > maxPayloadSize {
+		return Record{}, headerSize, ErrCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(rd, payload); err != nil {
+		return Record{}, headerSize + n, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, crcTable) != crc {
+		return Record{}, headerSize + int(length), ErrCorruptRecord
+	}
+
+	r, err := decodeRecord(payload)
+	return r, headerSize + int(length), err
+}
@@ -0,0 +1,72 @@
+package logservice
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const segmentExt = ".wal"
+
+// segmentName names a segment file by the sequence of its first record.
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, segmentExt)
+}
+
+// listSegments returns the first sequence of every segment in dir, ascending.
+func listSegments(dir string) ([]uint64, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, de := range dirEntries {
+		name := de.Name()
+		if de.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, firstSeq)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// scanSegment calls fn for every valid record of the segment file. It returns the
+// byte offset just past the last valid record, along with the error that stopped the scan.
+// A clean end of file is not an error.
+func scanSegment(path string, fn func(r Record) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	var offset int64
+	for {
+		r, n, err := readRecord(rd)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("%s@%d: %w", filepath.Base(path), offset, err)
+		}
+		if err = fn(r); err != nil {
+			return offset, err
+		}
+		offset += int64(n)
+	}
+}
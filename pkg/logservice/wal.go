@@ -1 +1,411 @@
 package logservice
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dborchard/cometkv/pkg/memtable"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+)
+
+type SyncPolicy int
+
+const (
+	// SyncEveryWrite fsyncs the log before every Append returns.
+	SyncEveryWrite SyncPolicy = iota
+	// SyncGroupCommit coalesces concurrent appenders into a single write and fsync.
+	// See Options.MaxBatchSize and Options.MaxBatchDelay.
+	SyncGroupCommit
+	// SyncInterval fsyncs the log in the background every Options.SyncInterval.
+	// Writes acknowledged since the last fsync can be lost on a crash.
+	SyncInterval
+)
+
+type Options struct {
+	Dir          string
+	SegmentSize  int64
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+
+	// MaxBatchSize caps the records committed by one fsync.
+	MaxBatchSize int
+	// MaxBatchDelay is how long a batch waits for more appenders before it is
+	// committed. Zero commits as soon as no appender is waiting.
+	MaxBatchDelay time.Duration
+}
+
+func DefaultOptions(dir string) Options {
+	return Options{
+		Dir:           dir,
+		SegmentSize:   64 << 20, // 64MB
+		SyncPolicy:    SyncGroupCommit,
+		SyncInterval:  100 * time.Millisecond,
+		MaxBatchSize:  1024,
+		MaxBatchDelay: 0,
+	}
+}
+
+var ErrClosed = errors.New("logservice: wal is closed")
+
+// WAL is an append-only, segmented write-ahead log.
+type WAL struct {
+	sync.Mutex
+	opts Options
+
+	segments   []uint64 // first seq of every segment, ascending
+	active     *os.File
+	activeSize int64
+	lastSeq    uint64
+	buf        []byte
+	checkpoint Checkpoint
+
+	syncMu    sync.Mutex
+	syncedSeq atomic.Uint64
+
+	commitCh chan *commitReq
+	stats    *commitStats
+
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func Open(opts Options) (*WAL, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 1
+	}
+	w := &WAL{
+		opts:     opts,
+		done:     make(chan struct{}),
+		commitCh: make(chan *commitReq),
+		stats:    newCommitStats(),
+	}
+
+	// 1. Find the last persisted sequence
+	checkpoint, err := readCheckpoint(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	w.checkpoint = checkpoint
+
+	segments, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	w.segments = segments
+	if len(segments) > 0 {
+		if err = w.recoverTail(segments[len(segments)-1]); err != nil {
+			return nil, err
+		}
+	}
+	if w.lastSeq < checkpoint.Seq {
+		w.lastSeq = checkpoint.Seq
+	}
+	w.syncedSeq.Store(w.lastSeq)
+
+	// 2. Appends always go to a fresh segment
+	if err = w.openSegment(w.lastSeq + 1); err != nil {
+		return nil, err
+	}
+
+	switch opts.SyncPolicy {
+	case SyncGroupCommit:
+		w.wg.Add(1)
+		go w.startCommitThread()
+	case SyncInterval:
+		w.wg.Add(1)
+		go w.startSyncThread()
+	}
+	return w, nil
+}
+
+// Append writes the record to the log and returns its sequence. A zero rec.Ts is
+// stamped with the current time. The record is durable when Append returns, unless
+// the SyncInterval policy is used.
+func (w *WAL) Append(rec Record) (uint64, error) {
+	if w.opts.SyncPolicy == SyncGroupCommit {
+		return w.groupCommit(rec)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	rec.Seq = w.lastSeq + 1
+	if rec.Ts == 0 {
+		rec.Ts = timestamp.Now()
+	}
+	w.buf = encodeRecord(w.buf[:0], &rec)
+	if err := w.writeLocked(w.buf, rec.Seq); err != nil {
+		return 0, err
+	}
+	w.lastSeq = rec.Seq
+
+	if w.opts.SyncPolicy == SyncEveryWrite {
+		if err := w.active.Sync(); err != nil {
+			return 0, err
+		}
+		w.syncedSeq.Store(rec.Seq)
+	}
+	return rec.Seq, nil
+}
+
+// writeLocked writes encoded records, starting at firstSeq, to the active segment.
+// Must hold w.Lock.
+func (w *WAL) writeLocked(buf []byte, firstSeq uint64) error {
+	if w.activeSize > 0 && w.activeSize+int64(len(buf)) > w.opts.SegmentSize {
+		if err := w.rotate(firstSeq); err != nil {
+			return err
+		}
+	}
+	if _, err := w.active.Write(buf); err != nil {
+		return err
+	}
+	w.activeSize += int64(len(buf))
+	return nil
+}
+
+// Sync makes every appended record durable.
+func (w *WAL) Sync() error {
+	w.Lock()
+	lastSeq := w.lastSeq
+	w.Unlock()
+
+	return w.syncUpTo(lastSeq)
+}
+
+// syncUpTo fsyncs the active segment unless a concurrent caller has already made seq
+// durable. Callers waiting on syncMu are covered by a single fsync.
+func (w *WAL) syncUpTo(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if w.syncedSeq.Load() >= seq {
+		return nil
+	}
+
+	w.Lock()
+	target, f := w.lastSeq, w.active
+	w.Unlock()
+
+	if err := f.Sync(); err != nil {
+		// The segment was rotated (and synced) underneath us.
+		if errors.Is(err, os.ErrClosed) && w.syncedSeq.Load() >= seq {
+			return nil
+		}
+		return err
+	}
+	w.advanceSynced(target)
+	return nil
+}
+
+func (w *WAL) advanceSynced(seq uint64) {
+	for {
+		curr := w.syncedSeq.Load()
+		if curr >= seq || w.syncedSeq.CompareAndSwap(curr, seq) {
+			return
+		}
+	}
+}
+
+func (w *WAL) startSyncThread() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			_ = w.Sync()
+		}
+	}
+}
+
+// Replay calls fn, in order, for every record whose sequence is greater than afterSeq.
+// It is meant to be used on startup, before new records are appended.
+func (w *WAL) Replay(afterSeq uint64, fn func(r Record) error) error {
+	w.Lock()
+	segments := append([]uint64{}, w.segments...)
+	w.Unlock()
+
+	for i, firstSeq := range segments {
+		// skip segments entirely covered by afterSeq
+		if i+1 < len(segments) && segments[i+1]-1 <= afterSeq {
+			continue
+		}
+		_, err := scanSegment(w.segmentPath(firstSeq), func(r Record) error {
+			if r.Seq <= afterSeq {
+				return nil
+			}
+			return fn(r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayInto re-applies every record after afterSeq to mem at its commit timestamp, and
+// returns the sequence of the last applied record. Records may be logged out of commit
+// order; the versions are ordered by their timestamp.
+func (w *WAL) ReplayInto(mem memtable.IMemtable, afterSeq uint64) (uint64, error) {
+	lastSeq := afterSeq
+	err := w.Replay(afterSeq, func(r Record) error {
+		Apply(mem, r.Records(), r.Ts)
+		lastSeq = r.Seq
+		return nil
+	})
+	return lastSeq, err
+}
+
+// Apply puts the Put, Delete and DeleteRange records of a batch into mem at version ts.
+// Values are encoded with entry.EncodeValue; those with an expiry are scheduled for
+// reclaim, unless a later record of the batch overwrites them.
+func Apply(mem memtable.IMemtable, batch []Record, ts uint64) {
+	last := make(map[string]int, len(batch))
+	for i, r := range batch {
+		last[r.Key] = i
+	}
+	for i, r := range batch {
+		switch r.Typ {
+		case RecordDelete:
+			mem.PutWithTs(r.Key, nil, ts)
+			continue
+		case RecordDeleteRange:
+			mem.DeleteRange(r.Key, string(r.Val), ts)
+			continue
+		}
+		mem.PutWithTs(r.Key, r.Val, ts)
+		if _, expiresAt := entry.DecodeValue(r.Val); expiresAt != 0 && last[r.Key] == i {
+			mem.ExpireAt(r.Key, ts, expiresAt)
+		}
+	}
+}
+
+// Versions returns the versions Apply puts into a memtable, keyed by internal key, and
+// the range tombstones of the batch.
+func Versions(batch []Record, ts uint64) ([]entry.Pair[[]byte, []byte], []entry.RangeTombstone) {
+	var versions []entry.Pair[[]byte, []byte]
+	var tombstones []entry.RangeTombstone
+	for _, r := range batch {
+		switch r.Typ {
+		case RecordDelete:
+			versions = append(versions, entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(r.Key), ts)})
+		case RecordDeleteRange:
+			tombstones = append(tombstones, entry.RangeTombstone{Start: r.Key, End: string(r.Val), Ts: ts})
+		default:
+			versions = append(versions, entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(r.Key), ts), Val: r.Val})
+		}
+	}
+	return versions, tombstones
+}
+
+func (w *WAL) LastSeq() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.lastSeq
+}
+
+func (w *WAL) Close() error {
+	w.Lock()
+	if w.closed {
+		w.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+
+	w.Lock()
+	defer w.Unlock()
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+	w.advanceSynced(w.lastSeq)
+	return w.active.Close()
+}
+
+// rotate seals the active segment and starts a new one at firstSeq. Must hold w.Lock.
+func (w *WAL) rotate(firstSeq uint64) error {
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+	w.advanceSynced(w.lastSeq)
+	if err := w.active.Close(); err != nil {
+		return err
+	}
+	return w.openSegment(firstSeq)
+}
+
+func (w *WAL) openSegment(firstSeq uint64) error {
+	f, err := os.OpenFile(w.segmentPath(firstSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// An empty last segment is reused instead of listed twice.
+	if n := len(w.segments); n == 0 || w.segments[n-1] != firstSeq {
+		w.segments = append(w.segments, firstSeq)
+	}
+	w.active = f
+	w.activeSize = stat.Size()
+	return syncDir(w.opts.Dir)
+}
+
+// recoverTail finds the last valid record of the final segment and discards the torn
+// record (partially written or failing its checksum) that a crash may have left after it.
+func (w *WAL) recoverTail(firstSeq uint64) error {
+	path := w.segmentPath(firstSeq)
+
+	w.lastSeq = firstSeq - 1
+	validSize, err := scanSegment(path, func(r Record) error {
+		w.lastSeq = r.Seq
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, ErrCorruptRecord) {
+		return err
+	}
+
+	if err = os.Truncate(path, validSize); err != nil {
+		return err
+	}
+	return syncDir(w.opts.Dir)
+}
+
+func (w *WAL) segmentPath(firstSeq uint64) string {
+	return filepath.Join(w.opts.Dir, segmentName(firstSeq))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
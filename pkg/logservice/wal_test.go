@@ -0,0 +1,306 @@
+package logservice
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dborchard/cometkv/pkg/memtable/vacuum_btree"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendReplay(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncEveryWrite, SyncGroupCommit, SyncInterval} {
+		opts := DefaultOptions(t.TempDir())
+		opts.SyncPolicy = policy
+
+		w, err := Open(opts)
+		require.NoError(t, err)
+		for i := 1; i <= 10; i++ {
+			seq, err := w.Append(Record{Typ: RecordPut, Key: fmt.Sprint(i), Val: []byte{byte(i)}})
+			require.NoError(t, err)
+			assert.Equal(t, uint64(i), seq)
+		}
+		_, err = w.Append(Record{Typ: RecordDelete, Key: "1"})
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		w, err = Open(opts)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(11), w.LastSeq())
+
+		var records []Record
+		require.NoError(t, w.Replay(5, func(r Record) error {
+			records = append(records, r)
+			return nil
+		}))
+		assert.Equal(t, 6, len(records))
+		assert.Equal(t, uint64(6), records[0].Seq)
+		assert.Equal(t, "6", records[0].Key)
+		assert.Equal(t, []byte{6}, records[0].Val)
+		assert.Equal(t, RecordDelete, records[5].Typ)
+		assert.Nil(t, records[5].Val)
+		require.NoError(t, w.Close())
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = w.Append(Record{Typ: RecordPut, Key: fmt.Sprintf("%05d", i), Val: []byte("value")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	segments, err := listSegments(opts.Dir)
+	require.NoError(t, err)
+	assert.True(t, len(segments) > 1)
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	count := 0
+	require.NoError(t, w.Replay(0, func(r Record) error {
+		count++
+		assert.Equal(t, uint64(count), r.Seq)
+		return nil
+	}))
+	assert.Equal(t, 100, count)
+	require.NoError(t, w.Close())
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	w, err := Open(DefaultOptions(t.TempDir()))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(8)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := w.Append(Record{Typ: RecordPut, Key: fmt.Sprintf("%d-%d", g, i)})
+				assert.NoError(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(800), w.LastSeq())
+	require.NoError(t, w.Close())
+}
+
+func TestCorruptRecord(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	w, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = w.Append(Record{Typ: RecordPut, Key: fmt.Sprint(i), Val: []byte("value")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// a second run moves the appends to a new segment
+	w, err = Open(opts)
+	require.NoError(t, err)
+	_, err = w.Append(Record{Typ: RecordPut, Key: "3", Val: []byte("value")})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// flip a byte inside the second record of the first segment
+	path := filepath.Join(opts.Dir, segmentName(1))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	err = w.Replay(0, func(r Record) error { return nil })
+	assert.ErrorIs(t, err, ErrCorruptRecord)
+	require.NoError(t, w.Close())
+}
+
+func TestTornTail(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	w, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = w.Append(Record{Typ: RecordPut, Key: fmt.Sprint(i), Val: []byte("value")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// cut the last record in half
+	path := filepath.Join(opts.Dir, segmentName(1))
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, stat.Size()-5))
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), w.LastSeq())
+
+	seq, err := w.Append(Record{Typ: RecordPut, Key: "2", Val: []byte("again")})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	require.NoError(t, w.Close())
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	var records []Record
+	require.NoError(t, w.Replay(0, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, []byte("again"), records[2].Val)
+	require.NoError(t, w.Close())
+}
+
+func TestReplayInto(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	w, err := Open(opts)
+	require.NoError(t, err)
+	_, _ = w.Append(Record{Typ: RecordPut, Key: "1", Val: []byte("a")})
+	_, _ = w.Append(Record{Typ: RecordPut, Key: "2", Val: []byte("b")})
+	_, _ = w.Append(Record{Typ: RecordDelete, Key: "1"})
+	// group commit may log a commit before an older one
+	ts := timestamp.Now()
+	_, _ = w.Append(Record{Typ: RecordPut, Key: "3", Val: []byte("new"), Ts: ts})
+	_, _ = w.Append(Record{Typ: RecordPut, Key: "3", Val: []byte("old"), Ts: ts - 10})
+	require.NoError(t, w.Close())
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	mem := vacuum_btree.New(15*time.Second, 60*time.Second, false, context.Background())
+	lastSeq, err := w.ReplayInto(mem, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), lastSeq)
+
+	assert.Equal(t, []byte(nil), mem.Get("1", time.Now()))
+	assert.Equal(t, []byte("b"), mem.Get("2", time.Now()))
+	// versions are replayed at their commit timestamp
+	assert.Equal(t, []byte("new"), mem.Get("3", time.Now()))
+	assert.Equal(t, []byte("old"), mem.Get("3", time.Unix(0, int64(ts-1))))
+	mem.Close()
+	require.NoError(t, w.Close())
+}
+
+func TestBatchRecord(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	w, err := Open(opts)
+	require.NoError(t, err)
+	ts := timestamp.Now()
+	_, err = w.Append(Record{Typ: RecordBatch, Ts: ts, Batch: []Record{
+		{Typ: RecordPut, Key: "1", Val: []byte("a")},
+		{Typ: RecordPut, Key: "2", Val: []byte("b")},
+		{Typ: RecordDelete, Key: "1"},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	var records []Record
+	require.NoError(t, w.Replay(0, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Equal(t, 1, len(records))
+	assert.Equal(t, ts, records[0].Ts)
+	require.Equal(t, 3, len(records[0].Batch))
+	assert.Equal(t, []byte("b"), records[0].Batch[1].Val)
+	assert.Equal(t, RecordDelete, records[0].Batch[2].Typ)
+
+	// the mutations of the batch share one version, the last one of a key wins
+	mem := vacuum_btree.New(15*time.Second, 60*time.Second, false, context.Background())
+	_, err = w.ReplayInto(mem, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(nil), mem.Get("1", time.Now()))
+	assert.Equal(t, []byte("b"), mem.Get("2", time.Now()))
+	mem.Close()
+	require.NoError(t, w.Close())
+}
+
+func TestCheckpoint(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err = w.Append(Record{Typ: RecordPut, Key: fmt.Sprintf("%05d", i), Val: []byte("value")})
+		require.NoError(t, err)
+	}
+	before, err := listSegments(opts.Dir)
+	require.NoError(t, err)
+
+	require.NoError(t, w.Checkpoint(Checkpoint{Seq: 50, Ts: 1}))
+	after, err := listSegments(opts.Dir)
+	require.NoError(t, err)
+	assert.True(t, len(after) < len(before))
+	assert.True(t, after[0] <= 51)
+	require.NoError(t, w.Close())
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	assert.Equal(t, Checkpoint{Seq: 50, Ts: 1}, w.LastCheckpoint())
+	assert.Equal(t, uint64(100), w.LastSeq())
+
+	var first uint64
+	require.NoError(t, w.Replay(w.LastCheckpoint().Seq, func(r Record) error {
+		if first == 0 {
+			first = r.Seq
+		}
+		return nil
+	}))
+	assert.Equal(t, uint64(51), first)
+	require.NoError(t, w.Close())
+}
+
+func TestGroupCommit(t *testing.T) {
+	opts := DefaultOptions(t.TempDir())
+	opts.MaxBatchSize = 64
+	opts.MaxBatchDelay = 5 * time.Millisecond
+
+	w, err := Open(opts)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(32)
+	for g := 0; g < 32; g++ {
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, err := w.Append(Record{Typ: RecordPut, Key: fmt.Sprintf("%d-%d", g, i)})
+				assert.NoError(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := w.Stats()
+	assert.Equal(t, uint64(640), stats.Records)
+	assert.True(t, stats.Batches < stats.Records)
+	assert.True(t, stats.MaxBatchSize > 1 && stats.MaxBatchSize <= 64)
+	assert.True(t, stats.AvgBatchSize > 1)
+	assert.True(t, stats.AvgCommitLatency > 0)
+	require.NoError(t, w.Close())
+
+	_, err = w.Append(Record{Typ: RecordPut, Key: "closed"})
+	assert.ErrorIs(t, err, ErrClosed)
+
+	w, err = Open(opts)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(640), w.LastSeq())
+	require.NoError(t, w.Close())
+}
@@ -1,24 +1,55 @@
 package base
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
 	"fmt"
 	movingaverage "github.com/RobinUS2/golang-moving-average"
 	memtable "github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Memtable is implemented by the memtables built on EMBase, which provides their
+// MVCC read path.
+type Memtable interface {
+	memtable.IMemtable
+
+	// Ascend calls fn on the versions stored at or after the internal key start, in
+	// internal key order, until fn returns false. Segmented memtables read the
+	// segments holding snapshotTs.
+	Ascend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool)
+	// Descend is Ascend in reverse internal key order, from the versions stored at or
+	// before start. A nil start starts at the last version.
+	Descend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool)
+}
+
 type EMBase struct {
 	TTL      time.Duration
-	derived  memtable.IMemtable
+	derived  Memtable
 	moAvg    *movingaverage.MovingAverage
 	logStats bool
+
+	// expiring holds the versions put with their own TTL, soonest expiry first.
+	expiringMu sync.Mutex
+	expiring   expiryHeap
+
+	rangeMu         sync.RWMutex
+	rangeTombstones []entry.RangeTombstone
+
+	// oldestSnapshot, if not zero, is the oldest snapshot pinned by a reader. keptSnapshot
+	// is set to it when the derived memtable also keeps the versions it reads.
+	oldestSnapshot atomic.Uint64
+	keptSnapshot   atomic.Uint64
 }
 
-func NewBase(bt memtable.IMemtable, gc, ttl time.Duration, logStats bool) *EMBase {
+func NewBase(bt Memtable, gc, ttl time.Duration, logStats bool) *EMBase {
 	return &EMBase{
 		derived:  bt,
 		TTL:      ttl,
@@ -45,8 +76,13 @@ func (e *EMBase) StartGc(interval time.Duration, ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			expiredTs := time.Now().Add(-1 * e.TTL)
-			e.Prune(timestamp.ToUnit64(expiredTs))
+			nowTs := timestamp.Now()
+			if pinned := e.oldestSnapshot.Load(); pinned != 0 && pinned < nowTs {
+				// the pinned snapshots still see the values expiring after them
+				nowTs = pinned
+			}
+			e.reclaimExpired(nowTs)
+			e.Prune(e.expiredTs())
 		case <-ctx.Done():
 			return
 		}
@@ -58,6 +94,7 @@ func (e *EMBase) Prune(expiredTs uint64) int {
 
 	// ref call.
 	delCount := e.derived.Prune(expiredTs)
+	delCount += e.pruneRangeTombstones(expiredTs)
 
 	endTs := time.Now()
 	diff := endTs.Sub(startTs)
@@ -72,9 +109,283 @@ func (e *EMBase) Prune(expiredTs uint64) int {
 	}
 	return delCount
 }
+
+// ExpireAt schedules the version of key at ts to be reclaimed by the GC once
+// expiresAt has passed. Its value is then dropped, and the version reads as deleted at
+// every snapshot.
+func (e *EMBase) ExpireAt(key string, ts, expiresAt uint64) {
+	e.expiringMu.Lock()
+	defer e.expiringMu.Unlock()
+	heap.Push(&e.expiring, expiringVersion{key: key, ts: ts, expiresAt: expiresAt})
+}
+
+// SetOldestSnapshot keeps the GC from reclaiming the values that have not expired at ts.
+// Zero unpins. It reports false, the versions older than the TTL are still dropped.
+func (e *EMBase) SetOldestSnapshot(ts uint64) bool {
+	e.oldestSnapshot.Store(ts)
+	return false
+}
+
+// KeepSnapshot is SetOldestSnapshot for the memtables whose Prune only drops the
+// versions at or below its expiredTs: the versions a snapshot at ts reads, those newer
+// than the TTL before it, are also kept and read. It reports true.
+func (e *EMBase) KeepSnapshot(ts uint64) bool {
+	e.oldestSnapshot.Store(ts)
+	e.keptSnapshot.Store(ts)
+	return true
+}
+
+// expiredTs is the timestamp at or below which versions are pruned and no longer read:
+// the TTL before now, or before the kept snapshot.
+func (e *EMBase) expiredTs() uint64 {
+	expiredTs := timestamp.ToUnit64(time.Now().Add(-e.TTL))
+	if kept := e.keptSnapshot.Load(); kept != 0 && kept-uint64(e.TTL) < expiredTs {
+		expiredTs = kept - uint64(e.TTL)
+	}
+	return expiredTs
+}
+
+// reclaimExpired replaces the versions expired at nowTs by tombstones. Versions at or
+// below expiredTs are left to Prune.
+func (e *EMBase) reclaimExpired(nowTs uint64) int {
+	e.expiringMu.Lock()
+	var expired []expiringVersion
+	for e.expiring.Len() > 0 && e.expiring[0].expiresAt <= nowTs {
+		expired = append(expired, heap.Pop(&e.expiring).(expiringVersion))
+	}
+	e.expiringMu.Unlock()
+
+	reclaimed := 0
+	expiredTs := e.expiredTs()
+	for _, v := range expired {
+		if v.ts > expiredTs {
+			e.derived.PutWithTs(v.key, nil, v.ts)
+			reclaimed++
+		}
+	}
+	return reclaimed
+}
+
+// DeleteRange records a range tombstone, read by the scans of the derived memtable.
+func (e *EMBase) DeleteRange(start, end string, ts uint64) {
+	e.rangeMu.Lock()
+	defer e.rangeMu.Unlock()
+	e.rangeTombstones = append(e.rangeTombstones, entry.RangeTombstone{Start: start, End: end, Ts: ts})
+}
+
+// RangeTombstones returns the range tombstones visible at snapshotTs, and not older
+// than the TTL.
+func (e *EMBase) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	e.rangeMu.RLock()
+	defer e.rangeMu.RUnlock()
+
+	var res []entry.RangeTombstone
+	expiredTs := e.expiredTs()
+	for _, t := range entry.VisibleTombstones(e.rangeTombstones, timestamp.ToUnit64(snapshotTs)) {
+		if t.Ts > expiredTs {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// pruneRangeTombstones drops the range tombstones written at or before expiredTs. The
+// versions they cover are older, and pruned as well.
+func (e *EMBase) pruneRangeTombstones(expiredTs uint64) int {
+	e.rangeMu.Lock()
+	defer e.rangeMu.Unlock()
+
+	kept := e.rangeTombstones[:0]
+	for _, t := range e.rangeTombstones {
+		if t.Ts > expiredTs {
+			kept = append(kept, t)
+		}
+	}
+	delCount := len(e.rangeTombstones) - len(kept)
+	e.rangeTombstones = kept
+	return delCount
+}
+
 func (e *EMBase) Put(key string, val []byte) { panic("not implemented") }
-func (e *EMBase) Scan(k string, c int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	panic("not implemented")
+
+func (e *EMBase) PutWithTs(key string, val []byte, ts uint64) { panic("not implemented") }
+
+// Scan returns the first count keys at or after startKey, at or before it with
+// opt.Reverse, with their newest version at or below opt.SnapshotTs. Tombstones are
+// returned, and counted, only with opt.IncludeFull.
+func (e *EMBase) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
+	var res []entry.Pair[string, []byte]
+	e.visible(startKey, opt, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		if opt.IncludeFull || val != nil {
+			res = append(res, entry.Pair[string, []byte]{Key: string(entry.ParseKey(key)), Val: val})
+		}
+		return true
+	})
+	return res
+}
+
+// ScanVersions is Scan with IncludeFull, returning internal keys so that the version
+// of every row is known.
+func (e *EMBase) ScanVersions(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	var res []entry.Pair[[]byte, []byte]
+	e.visible(startKey, opt, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		res = append(res, entry.Pair[[]byte, []byte]{Key: key, Val: val})
+		return true
+	})
+	return res
+}
+
+// NewIterator pages through ScanVersions of the derived memtable, so that its locking
+// applies.
+func (e *EMBase) NewIterator(opt memtable.ScanOptions) iterator.Iterator {
+	scan := func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error) {
+		return e.derived.ScanVersions(startKey, count, opt), nil
+	}
+	if opt.Reverse {
+		return iterator.NewReversePaged(iterator.DefaultPageSize, scan)
+	}
+	return iterator.NewPaged(iterator.DefaultPageSize, scan)
+}
+
+// ScanHistory returns every version at or below opt.SnapshotTs of the keys at or after
+// startKey, at most count, in internal key order. Tombstones are included. With
+// opt.Reverse, the keys at or before startKey are returned in reverse order.
+func (e *EMBase) ScanHistory(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	var res []entry.Pair[[]byte, []byte]
+	e.versions(startKey, opt, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		res = append(res, entry.Pair[[]byte, []byte]{Key: key, Val: val})
+		return true
+	})
+	return res
+}
+
+// visible walks the newest versions in key order, descending with opt.Reverse. A
+// version covered by a range tombstone is walked as a tombstone at the ts of the range.
+func (e *EMBase) visible(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	if tombstones := e.RangeTombstones(opt.SnapshotTs); len(tombstones) > 0 {
+		snapshotTsNano := timestamp.ToUnit64(opt.SnapshotTs)
+		next := fn
+		fn = func(key, val []byte) bool {
+			userKey := entry.ParseKey(key)
+			if ts, ok := entry.CoveringTs(tombstones, userKey, entry.ParseTs(key), snapshotTsNano); ok {
+				return next(entry.KeyWithTs(userKey, ts), nil)
+			}
+			return next(key, val)
+		}
+	}
+
+	if opt.Reverse {
+		e.descendVisible(startKey, opt, fn)
+		return
+	}
+	e.ascendVisible(startKey, opt, fn)
+}
+
+// versions walks every version in internal key order, reversed with opt.Reverse.
+func (e *EMBase) versions(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	if opt.Reverse {
+		e.descendVersions(startKey, opt, fn)
+		return
+	}
+	e.ascendVersions(startKey, opt, fn)
+}
+
+// ascendVisible calls fn, in key order, on the newest version at or below
+// opt.SnapshotTs of every key at or after startKey, within opt.Bounds.
+func (e *EMBase) ascendVisible(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	// Versions of a key are adjacent, newest first.
+	var lastKey []byte
+	e.ascendVersions(startKey, opt, func(key, val []byte) bool {
+		userKey := entry.ParseKey(key)
+		if lastKey != nil && bytes.Equal(userKey, lastKey) {
+			return true
+		}
+		lastKey = userKey
+		return fn(key, val)
+	})
+}
+
+// ascendVersions calls fn, in internal key order, on every version at or below
+// opt.SnapshotTs of the keys at or after startKey, within opt.Bounds. Versions older
+// than the TTL, or than the TTL before the kept snapshot, are ignored.
+func (e *EMBase) ascendVersions(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	//0. Check if snapshotTs has already expired
+	snapshotTs := opt.SnapshotTs
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	expiredTs := e.expiredTs()
+	if snapshotTsNano <= expiredTs {
+		return
+	}
+
+	// 1. Do range scan
+	internalKey := entry.KeyWithTs([]byte(opt.Start(startKey)), snapshotTsNano)
+	e.derived.Ascend(internalKey, snapshotTs, func(key, val []byte) bool {
+		if opt.Past(entry.ParseKey(key)) {
+			return false
+		}
+
+		// expiredTs < ItemTs <= snapshotTs
+		itemTs := entry.ParseTs(key)
+		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
+		greaterThanExpiredTs := itemTs > expiredTs
+		if !lessThanOrEqualToSnapshotTs || !greaterThanExpiredTs {
+			return true
+		}
+		return fn(key, val)
+	})
+}
+
+// descendVisible calls fn, in descending key order, on the newest version at or below
+// opt.SnapshotTs of every key at or before startKey, within opt.Bounds.
+func (e *EMBase) descendVisible(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	// Versions of a key are adjacent, oldest first, so a key is known once the next
+	// one is reached.
+	var lastKey, lastVal []byte
+	stopped := false
+	e.descendVersions(startKey, opt, func(key, val []byte) bool {
+		if lastKey != nil && !bytes.Equal(entry.ParseKey(key), entry.ParseKey(lastKey)) && !fn(lastKey, lastVal) {
+			stopped = true
+			return false
+		}
+		lastKey, lastVal = key, val
+		return true
+	})
+	if lastKey != nil && !stopped {
+		fn(lastKey, lastVal)
+	}
+}
+
+// descendVersions is ascendVersions in reverse internal key order, on the keys at or
+// before startKey.
+func (e *EMBase) descendVersions(startKey string, opt memtable.ScanOptions, fn func(key, val []byte) bool) {
+	snapshotTs := opt.SnapshotTs
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	expiredTs := e.expiredTs()
+	if snapshotTsNano <= expiredTs {
+		return
+	}
+
+	e.derived.Descend(opt.Last(startKey), snapshotTs, func(key, val []byte) bool {
+		if opt.Past(entry.ParseKey(key)) {
+			return false
+		}
+
+		// expiredTs < ItemTs <= snapshotTs
+		itemTs := entry.ParseTs(key)
+		if itemTs > snapshotTsNano || itemTs <= expiredTs {
+			return true
+		}
+		return fn(key, val)
+	})
 }
 
 func (e *EMBase) Name() string {
@@ -83,3 +394,23 @@ func (e *EMBase) Name() string {
 
 func (e *EMBase) Len() int { panic("not implemented") }
 func (e *EMBase) Close()   { panic("not implemented") }
+
+type expiringVersion struct {
+	key       string
+	ts        uint64
+	expiresAt uint64
+}
+
+type expiryHeap []expiringVersion
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any)        { *h = append(*h, x.(expiringVersion)) }
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -15,6 +15,8 @@ type IBTreeGCoW[T any] interface {
 	Set(item T) (T, bool)
 	Delete(key T) (T, bool)
 	Ascend(pivot T, iter func(item T) bool)
+	Descend(pivot T, iter func(item T) bool)
+	Reverse(iter func(item T) bool)
 	Len() int
 	Scan(iter func(item T) bool)
 }
@@ -54,6 +56,14 @@ func (tr *BTreeGCoW[T]) Ascend(pivot T, iter func(item T) bool) {
 	tr.state.Load().Ascend(pivot, iter)
 }
 
+func (tr *BTreeGCoW[T]) Descend(pivot T, iter func(item T) bool) {
+	tr.state.Load().Descend(pivot, iter)
+}
+
+func (tr *BTreeGCoW[T]) Reverse(iter func(item T) bool) {
+	tr.state.Load().Reverse(iter)
+}
+
 func (tr *BTreeGCoW[T]) Len() int {
 	return tr.state.Load().Len()
 }
@@ -2,10 +2,12 @@ package mor_cow
 
 import (
 	"github.com/tidwall/btree"
+	"sync"
 	"sync/atomic"
 )
 
 type BTreeGCoW[T any] struct {
+	sync.Mutex
 	state atomic.Pointer[btree.BTreeG[T]]
 }
 
@@ -24,9 +26,13 @@ func NewBTreeGCoW[T any](less func(a, b T) bool) *BTreeGCoW[T] {
 }
 
 func (tr *BTreeGCoW[T]) Set(item T) (T, bool) {
+	tr.Lock() // To serialize concurrent Sets
+
 	newState := tr.state.Load().Copy()
 	res1, res2 := newState.Set(item)
 	tr.state.Store(newState)
+
+	tr.Unlock()
 	return res1, res2
 }
 
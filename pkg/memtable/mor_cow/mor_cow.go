@@ -6,6 +6,7 @@ import (
 	memtable "github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/memtable/base"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"github.com/tidwall/btree"
 	"math"
@@ -51,11 +52,14 @@ func (s *MoRCoW) Name() string {
 }
 
 func (s *MoRCoW) Put(key string, val []byte) {
-	//1. Find curr segment
-	currTs := time.Now()
-	activeSegmentIdx := s.findSegmentIdx(currTs)
+	s.PutWithTs(key, val, timestamp.Now())
+}
+
+func (s *MoRCoW) PutWithTs(key string, val []byte, ts uint64) {
+	//1. Find the segment of ts
+	activeSegmentIdx := s.findSegmentIdx(time.Unix(0, int64(ts)))
 
-	internalKey := entry.KeyWithTs([]byte(key), timestamp.Now())
+	internalKey := entry.KeyWithTs([]byte(key), ts)
 
 	s.segments[activeSegmentIdx].Set(entry.Pair[[]byte, []byte]{
 		Key: internalKey,
@@ -64,24 +68,32 @@ func (s *MoRCoW) Put(key string, val []byte) {
 }
 
 func (s *MoRCoW) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	snapshotTs := opt.SnapshotTs
-	//0. Check if snapshotTs has already expired
-	if !timestamp.IsValidTs(snapshotTs, s.base.TTL) {
-		return []entry.Pair[string, []byte]{}
-	}
+	return s.base.Scan(startKey, count, opt)
+}
+
+func (s *MoRCoW) ScanVersions(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return s.base.ScanVersions(startKey, count, opt)
+}
+
+func (s *MoRCoW) ScanHistory(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return s.base.ScanHistory(startKey, count, opt)
+}
 
+func (s *MoRCoW) NewIterator(opt memtable.ScanOptions) iterator.Iterator {
+	return s.base.NewIterator(opt)
+}
+
+// Ascend merges the segments that may hold versions visible at snapshotTs.
+func (s *MoRCoW) Ascend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool) {
 	//1. Get the Starting Segment
 	segmentIdx := s.findSegmentIdx(snapshotTs)
+	startRow := entry.Pair[[]byte, []byte]{Key: start}
 
-	// 2.a Create Start Key
-	internalKey := entry.KeyWithTs([]byte(startKey), timestamp.ToUnit64(snapshotTs))
-	startRow := entry.Pair[[]byte, []byte]{Key: internalKey}
-
-	//2.b Init Heap
+	//2.a Init Heap
 	mh := &MinHeap{}
 	heap.Init(mh)
 
-	// 2.c Fetch all iterators and add to PQ
+	// 2.b Fetch all iterators and add to PQ
 	for i := 0; i < s.ttlValidSegmentsCount+1; i++ {
 		pos := segmentIdx - i
 		if pos < 0 {
@@ -94,12 +106,7 @@ func (s *MoRCoW) Scan(startKey string, count int, opt memtable.ScanOptions) []en
 		heap.Push(mh, &iter)
 	}
 
-	// 3.a Variable
-	seenKeys := make(map[string]any)
-	uniqueKVs := make(map[string][]byte)
-	idx := 1
-	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
-
+	// 3. Merge
 	for mh.Len() > 0 {
 		smallestIter := heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]])
 		item := smallestIter.Item()
@@ -109,33 +116,74 @@ func (s *MoRCoW) Scan(startKey string, count int, opt memtable.ScanOptions) []en
 			smallestIter.Release()
 		}
 
-		// 3.b scan logic
-		if idx > count {
+		if item.Key == nil {
+			// iterator seeked past its last item
+			continue
+		}
+		if !fn(item.Key, item.Val) {
 			break
 		}
-		// expiredTs < ItemTs < snapshotTs
-		itemTs := entry.ParseTs(item.Key)
-		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
-		greaterThanExpiredTs := timestamp.IsValidTsUint(itemTs, s.base.TTL)
-
-		if lessThanOrEqualToSnapshotTs && greaterThanExpiredTs {
-			strKey := string(entry.ParseKey(item.Key))
-			if _, seen := seenKeys[strKey]; !seen {
-				seenKeys[strKey] = true
-				if opt.IncludeFull || item.Val != nil {
-					uniqueKVs[strKey] = item.Val
-					idx++
-				}
-			}
+	}
+
+	for mh.Len() > 0 {
+		heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]]).Release()
+	}
+}
+
+// Descend is Ascend in reverse, from the versions at or before start.
+func (s *MoRCoW) Descend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool) {
+	//1. Get the Starting Segment
+	segmentIdx := s.findSegmentIdx(snapshotTs)
+
+	//2.a Init Heap
+	mh := &MaxHeap{}
+	heap.Init(mh)
+
+	// 2.b Fetch all iterators and add to PQ
+	for i := 0; i < s.ttlValidSegmentsCount+1; i++ {
+		pos := segmentIdx - i
+		if pos < 0 {
+			pos += len(s.segments)
+		}
+
+		iter := s.segments[pos].Copy().Iter()
+		if seekLast(&iter, start) {
+			heap.Push(mh, &iter)
+		} else {
+			iter.Release()
+		}
+	}
+
+	// 3. Merge
+	for mh.Len() > 0 {
+		largestIter := heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]])
+		item := largestIter.Item()
+		if largestIter.Prev() {
+			heap.Push(mh, largestIter)
+		} else {
+			largestIter.Release()
+		}
+
+		if !fn(item.Key, item.Val) {
+			break
 		}
 	}
 
 	for mh.Len() > 0 {
 		heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]]).Release()
 	}
+}
 
-	// 2. Range Scan delegation
-	return entry.MapToArray(uniqueKVs)
+// seekLast moves iter to the last item at or before start, the last item if start is
+// nil, and reports whether there is one.
+func seekLast(iter *btree.IterG[entry.Pair[[]byte, []byte]], start []byte) bool {
+	if start == nil || !iter.Seek(entry.Pair[[]byte, []byte]{Key: start}) {
+		return iter.Last()
+	}
+	if entry.CompareKeys(iter.Item().Key, start) > 0 {
+		return iter.Prev()
+	}
+	return true
 }
 
 func (s *MoRCoW) Prune(_ uint64) int {
@@ -189,6 +237,22 @@ func (s *MoRCoW) Delete(key string) {
 	s.base.Delete(key)
 }
 
+func (s *MoRCoW) ExpireAt(key string, ts, expiresAt uint64) {
+	s.base.ExpireAt(key, ts, expiresAt)
+}
+
+func (s *MoRCoW) SetOldestSnapshot(ts uint64) bool {
+	return s.base.SetOldestSnapshot(ts)
+}
+
+func (s *MoRCoW) DeleteRange(start, end string, ts uint64) {
+	s.base.DeleteRange(start, end, ts)
+}
+
+func (s *MoRCoW) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	return s.base.RangeTombstones(snapshotTs)
+}
+
 func (s *MoRCoW) StartGc(interval time.Duration, ctx context.Context) {
 	s.base.StartGc(interval, ctx)
 }
@@ -2,10 +2,12 @@ package segment_ring
 
 import (
 	"github.com/tidwall/btree"
+	"sync"
 	"sync/atomic"
 )
 
 type BTreeGCoW[T any] struct {
+	sync.Mutex
 	state atomic.Pointer[btree.BTreeG[T]]
 }
 
@@ -13,6 +15,8 @@ type IBTreeGCoW[T any] interface {
 	Set(item T) (T, bool)
 	Clear()
 	Ascend(pivot T, iter func(item T) bool)
+	Descend(pivot T, iter func(item T) bool)
+	Reverse(iter func(item T) bool)
 	Len() int
 }
 
@@ -25,9 +29,13 @@ func NewBTreeGCoW[T any](less func(a, b T) bool) *BTreeGCoW[T] {
 }
 
 func (tr *BTreeGCoW[T]) Set(item T) (T, bool) {
+	tr.Lock() // To serialize concurrent Sets
+
 	newState := tr.state.Load().Copy()
 	res1, res2 := newState.Set(item)
 	tr.state.Store(newState)
+
+	tr.Unlock()
 	return res1, res2
 }
 
@@ -39,6 +47,14 @@ func (tr *BTreeGCoW[T]) Ascend(pivot T, iter func(item T) bool) {
 	tr.state.Load().Ascend(pivot, iter)
 }
 
+func (tr *BTreeGCoW[T]) Descend(pivot T, iter func(item T) bool) {
+	tr.state.Load().Descend(pivot, iter)
+}
+
+func (tr *BTreeGCoW[T]) Reverse(iter func(item T) bool) {
+	tr.state.Load().Reverse(iter)
+}
+
 func (tr *BTreeGCoW[T]) Len() int {
 	return tr.state.Load().Len()
 }
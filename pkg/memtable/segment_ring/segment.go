@@ -4,19 +4,19 @@ import (
 	"container/list"
 	"context"
 	"github.com/alphadose/zenq/v2"
-	"github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/y/entry"
-	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Segment struct {
 	// Original Structure
-	tree *BTreeGCoW[entry.Pair[[]byte, *list.Element]]
-	vlog *list.List
-	ctx  context.Context
+	tree   *BTreeGCoW[entry.Pair[[]byte, *list.Element]]
+	vlog   *list.List
+	vlogMu sync.Mutex
+	ctx    context.Context
 
 	// Ring Enhancement
 	nextPtr *Segment
@@ -32,7 +32,8 @@ type ISegment interface {
 	AddIndex(entry *entry.Pair[[]byte, *list.Element])
 	AddIndexAsync(entry *entry.Pair[[]byte, *list.Element])
 
-	Scan(startKey string, count int, snapshotTs time.Time) []entry.Pair[string, []byte]
+	Ascend(start []byte, fn func(key, val []byte) bool)
+	Descend(start []byte, fn func(key, val []byte) bool)
 	Free() int
 
 	Len() int
@@ -88,6 +89,8 @@ func (s *Segment) StartListener() {
 }
 
 func (s *Segment) AddValue(val []byte) (lePtr *list.Element) {
+	s.vlogMu.Lock()
+	defer s.vlogMu.Unlock()
 	return s.vlog.PushFront(val)
 }
 
@@ -104,51 +107,50 @@ func (s *Segment) AddIndex(entry *entry.Pair[[]byte, *list.Element]) {
 }
 
 func (s *Segment) AddIndexAsync(entry *entry.Pair[[]byte, *list.Element]) {
-	s.asyncKeyPtrChan.Write(entry)
+	// counted before it is queued, so that Ascend cannot miss it
 	s.pendingUpdates.Add(1)
+	s.asyncKeyPtrChan.Write(entry)
+}
+
+// Ascend waits for the pending async index updates, then walks the versions at or after
+// the internal key start.
+func (s *Segment) Ascend(start []byte, fn func(key, val []byte) bool) {
+	s.waitPendingUpdates()
+
+	startRow := entry.Pair[[]byte, *list.Element]{Key: start}
+	s.tree.Ascend(startRow, s.visitor(fn))
+}
+
+// Descend is Ascend in reverse, from the versions at or before start. A nil start
+// starts at the last version.
+func (s *Segment) Descend(start []byte, fn func(key, val []byte) bool) {
+	s.waitPendingUpdates()
+
+	if start == nil {
+		s.tree.Reverse(s.visitor(fn))
+		return
+	}
+	startRow := entry.Pair[[]byte, *list.Element]{Key: start}
+	s.tree.Descend(startRow, s.visitor(fn))
 }
 
-func (s *Segment) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	snapshotTs := opt.SnapshotTs
+func (s *Segment) waitPendingUpdates() {
 	delay := time.Duration(1)
 	for s.pendingUpdates.Load() > 0 {
 		// Waiting time was generally between 10-250ms
 		time.Sleep(delay * time.Millisecond)
 		delay = delay * 2
 	}
+}
 
-	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
-
-	// 1. Do range scan
-	internalKey := entry.KeyWithTs([]byte(startKey), timestamp.ToUnit64(snapshotTs))
-	startRow := entry.Pair[[]byte, *list.Element]{Key: internalKey}
-	uniqueKVs := make(map[string][]byte)
-	seenKeys := make(map[string]any)
-
-	idx := 1
-	s.tree.Ascend(startRow, func(item entry.Pair[[]byte, *list.Element]) bool {
-		if idx > count {
-			return false
-		}
-
-		// expiredTs < ItemTs < snapshotTs
-		itemTs := entry.ParseTs(item.Key)
-		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
-
-		if lessThanOrEqualToSnapshotTs {
-			strKey := string(entry.ParseKey(item.Key))
-			if _, seen := seenKeys[strKey]; !seen {
-				seenKeys[strKey] = true
-				if item.Val != nil && (opt.IncludeFull || item.Val.Value.([]byte) != nil) {
-					uniqueKVs[strKey] = item.Val.Value.([]byte)
-					idx++
-				}
-			}
+// visitor calls fn on the value of the index entries.
+func (s *Segment) visitor(fn func(key, val []byte) bool) func(item entry.Pair[[]byte, *list.Element]) bool {
+	return func(item entry.Pair[[]byte, *list.Element]) bool {
+		if item.Val == nil {
+			return true
 		}
-		return true
-	})
-
-	return entry.MapToArray(uniqueKVs)
+		return fn(item.Key, item.Val.Value.([]byte))
+	}
 }
 
 func (s *Segment) Free() int {
@@ -156,7 +158,9 @@ func (s *Segment) Free() int {
 	removedCount := s.Len()
 
 	s.tree.Clear()
+	s.vlogMu.Lock()
 	s.vlog.Init()
+	s.vlogMu.Unlock()
 
 	return removedCount
 }
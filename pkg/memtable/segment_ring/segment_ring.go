@@ -6,6 +6,7 @@ import (
 	memtable "github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/memtable/base"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"math"
 	"time"
@@ -67,15 +68,18 @@ func (s *SegmentRing) Name() string {
 }
 
 func (s *SegmentRing) Put(key string, val []byte) {
-	//1. Find curr segment
-	currTs := time.Now()
-	activeSegmentIdx := s.findSegmentIdx(currTs)
+	s.PutWithTs(key, val, timestamp.Now())
+}
+
+func (s *SegmentRing) PutWithTs(key string, val []byte, ts uint64) {
+	//1. Find the segment of ts
+	activeSegmentIdx := s.findSegmentIdx(time.Unix(0, int64(ts)))
 
 	// 2. Add to Segment "VLOG"
 	rPtr := s.segments[activeSegmentIdx].AddValue(val)
 
 	// 3. Create entry for "Index"
-	internalKey := entry.KeyWithTs([]byte(key), timestamp.ToUnit64(currTs))
+	internalKey := entry.KeyWithTs([]byte(key), ts)
 	entry := &entry.Pair[[]byte, *list.Element]{Key: internalKey, Val: rPtr}
 
 	// 4.a Add to Curr segment in sync.
@@ -92,17 +96,35 @@ func (s *SegmentRing) Put(key string, val []byte) {
 }
 
 func (s *SegmentRing) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	snapshotTs := opt.SnapshotTs
-	//0. Check if snapshotTs has already expired
-	if !timestamp.IsValidTs(snapshotTs, s.base.TTL) {
-		return []entry.Pair[string, []byte]{}
-	}
+	return s.base.Scan(startKey, count, opt)
+}
+
+func (s *SegmentRing) ScanVersions(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return s.base.ScanVersions(startKey, count, opt)
+}
+
+func (s *SegmentRing) ScanHistory(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return s.base.ScanHistory(startKey, count, opt)
+}
+
+func (s *SegmentRing) NewIterator(opt memtable.ScanOptions) iterator.Iterator {
+	return s.base.NewIterator(opt)
+}
+
+func (s *SegmentRing) Ascend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool) {
+	//1. Get Segment
+	segmentIdx := s.findSegmentIdx(snapshotTs)
 
+	// 2. Range Scan delegation
+	s.segments[segmentIdx].Ascend(start, fn)
+}
+
+func (s *SegmentRing) Descend(start []byte, snapshotTs time.Time, fn func(key, val []byte) bool) {
 	//1. Get Segment
 	segmentIdx := s.findSegmentIdx(snapshotTs)
 
 	// 2. Range Scan delegation
-	return s.segments[segmentIdx].Scan(startKey, count, opt)
+	s.segments[segmentIdx].Descend(start, fn)
 }
 
 func (s *SegmentRing) Prune(_ uint64) int {
@@ -145,6 +167,22 @@ func (s *SegmentRing) Delete(key string) {
 	s.base.Delete(key)
 }
 
+func (s *SegmentRing) ExpireAt(key string, ts, expiresAt uint64) {
+	s.base.ExpireAt(key, ts, expiresAt)
+}
+
+func (s *SegmentRing) SetOldestSnapshot(ts uint64) bool {
+	return s.base.SetOldestSnapshot(ts)
+}
+
+func (s *SegmentRing) DeleteRange(start, end string, ts uint64) {
+	s.base.DeleteRange(start, end, ts)
+}
+
+func (s *SegmentRing) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	return s.base.RangeTombstones(snapshotTs)
+}
+
 func (s *SegmentRing) StartGc(interval time.Duration, ctx context.Context) {
 	s.base.StartGc(interval, ctx)
 }
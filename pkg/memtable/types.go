@@ -3,12 +3,38 @@ package memtable
 import (
 	"context"
 	common "github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"time"
 )
 
 type IMemtable interface {
 	Put(key string, val []byte)
+	// PutWithTs is Put at the version ts chosen by the caller, so that several writes
+	// can share one. A nil val is a tombstone.
+	PutWithTs(key string, val []byte, ts uint64)
+	// ExpireAt makes the GC reclaim the version of key at ts once expiresAt has passed,
+	// before the TTL of the memtable.
+	ExpireAt(key string, ts, expiresAt uint64)
+	// SetOldestSnapshot keeps the GC from reclaiming the values put with their own TTL
+	// that have not expired at ts, the oldest snapshot pinned by a reader. Zero unpins.
+	// It reports whether the versions the snapshot reads, those newer than the TTL
+	// before ts, are kept and read as well; otherwise they are dropped after the TTL.
+	SetOldestSnapshot(ts uint64) bool
+	// DeleteRange deletes the keys of [start, end) written before ts with a range
+	// tombstone. Scans and Get read the versions it covers as deleted at ts.
+	DeleteRange(start, end string, ts uint64)
+	// RangeTombstones returns the range tombstones visible at snapshotTs.
+	RangeTombstones(snapshotTs time.Time) []common.RangeTombstone
 	Scan(startKey string, count int, opt ScanOptions) []common.Pair[string, []byte] //TODO: Could use , ...opt ScanOpt
+	// ScanVersions is Scan with IncludeFull, returning internal keys so that the version
+	// of every row is known.
+	ScanVersions(startKey string, count int, opt ScanOptions) []common.Pair[[]byte, []byte]
+	// ScanHistory returns every version at or below SnapshotTs of the keys at or after
+	// startKey, at most count, in internal key order. Tombstones are included.
+	ScanHistory(startKey string, count int, opt ScanOptions) []common.Pair[[]byte, []byte]
+	// NewIterator iterates over what ScanVersions returns, at opt.SnapshotTs, a page at
+	// a time.
+	NewIterator(opt ScanOptions) iterator.Iterator
 	Prune(expiredTs uint64) int
 
 	Get(key string, snapshotTs time.Time) []byte
@@ -26,6 +52,9 @@ type ScanOptions struct {
 	// And you can set the default value of SnapshotTs as time.Now()
 	SnapshotTs  time.Time
 	IncludeFull bool
+	// Bounds stops scans at EndKey, exclusive, and keeps them within Prefix. With
+	// Reverse, scans return the keys at or before their start key, in descending order.
+	common.Bounds
 }
 
 type Typ int
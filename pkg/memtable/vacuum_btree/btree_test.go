@@ -84,3 +84,38 @@ func Test11(t *testing.T) {
 		return New(gcInterval, ttl, true, ctx)
 	}, t)
 }
+
+func Test12(t *testing.T) {
+	tests.Test12(func(gcInterval, ttl time.Duration) memtable.IMemtable {
+		ctx := context.Background()
+		return New(gcInterval, ttl, true, ctx)
+	}, t)
+}
+
+func Test13(t *testing.T) {
+	tests.Test13(func(gcInterval, ttl time.Duration) memtable.IMemtable {
+		ctx := context.Background()
+		return New(gcInterval, ttl, true, ctx)
+	}, t)
+}
+
+func Test14(t *testing.T) {
+	tests.Test14(func(gcInterval, ttl time.Duration) memtable.IMemtable {
+		ctx := context.Background()
+		return New(gcInterval, ttl, true, ctx)
+	}, t)
+}
+
+func Test15(t *testing.T) {
+	tests.Test15(func(gcInterval, ttl time.Duration) memtable.IMemtable {
+		ctx := context.Background()
+		return New(gcInterval, ttl, true, ctx)
+	}, t)
+}
+
+func Test16(t *testing.T) {
+	tests.Test16(func(gcInterval, ttl time.Duration) memtable.IMemtable {
+		ctx := context.Background()
+		return New(gcInterval, ttl, true, ctx)
+	}, t)
+}
@@ -5,6 +5,7 @@ import (
 	memtable "github.com/dborchard/cometkv/pkg/memtable"
 	"github.com/dborchard/cometkv/pkg/memtable/base"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"time"
 )
@@ -34,7 +35,11 @@ func (e *EphemeralMemtable) Name() string {
 }
 
 func (e *EphemeralMemtable) Put(key string, val []byte) {
-	internalKey := entry.KeyWithTs([]byte(key), timestamp.Now())
+	e.PutWithTs(key, val, timestamp.Now())
+}
+
+func (e *EphemeralMemtable) PutWithTs(key string, val []byte, ts uint64) {
+	internalKey := entry.KeyWithTs([]byte(key), ts)
 
 	e.tree.Set(entry.Pair[[]byte, []byte]{
 		Key: internalKey,
@@ -43,46 +48,36 @@ func (e *EphemeralMemtable) Put(key string, val []byte) {
 }
 
 func (e *EphemeralMemtable) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	snapshotTs := opt.SnapshotTs
-	//0. Check if snapshotTs has already expired
-	if !timestamp.IsValidTs(snapshotTs, e.base.TTL) {
-		return []entry.Pair[string, []byte]{}
-	}
-
-	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	return e.base.Scan(startKey, count, opt)
+}
 
-	// 1. Do range scan
-	internalKey := entry.KeyWithTs([]byte(startKey), timestamp.ToUnit64(snapshotTs))
-	startRow := entry.Pair[[]byte, []byte]{Key: internalKey}
-	seenKeys := make(map[string]any)
-	uniqueKVs := make(map[string][]byte)
-	idx := 1
-	e.tree.Ascend(startRow, func(item entry.Pair[[]byte, []byte]) bool {
+func (e *EphemeralMemtable) ScanVersions(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return e.base.ScanVersions(startKey, count, opt)
+}
 
-		if idx > count {
-			return false
-		}
+func (e *EphemeralMemtable) ScanHistory(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return e.base.ScanHistory(startKey, count, opt)
+}
 
-		// expiredTs < ItemTs < snapshotTs
-		itemTs := entry.ParseTs(item.Key)
-		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
-		greaterThanExpiredTs := timestamp.IsValidTsUint(itemTs, e.base.TTL)
-
-		if lessThanOrEqualToSnapshotTs && greaterThanExpiredTs {
-			strKey := string(entry.ParseKey(item.Key))
-			if _, seen := seenKeys[strKey]; !seen {
-				seenKeys[strKey] = true
-				if opt.IncludeFull || item.Val != nil {
-					uniqueKVs[strKey] = item.Val
-					idx++
-				}
-			}
-		}
+func (e *EphemeralMemtable) NewIterator(opt memtable.ScanOptions) iterator.Iterator {
+	return e.base.NewIterator(opt)
+}
 
-		return true
+func (e *EphemeralMemtable) Ascend(start []byte, _ time.Time, fn func(key, val []byte) bool) {
+	e.tree.Ascend(entry.Pair[[]byte, []byte]{Key: start}, func(item entry.Pair[[]byte, []byte]) bool {
+		return fn(item.Key, item.Val)
 	})
+}
 
-	return entry.MapToArray(uniqueKVs)
+func (e *EphemeralMemtable) Descend(start []byte, _ time.Time, fn func(key, val []byte) bool) {
+	iter := func(item entry.Pair[[]byte, []byte]) bool {
+		return fn(item.Key, item.Val)
+	}
+	if start == nil {
+		e.tree.Reverse(iter)
+		return
+	}
+	e.tree.Descend(entry.Pair[[]byte, []byte]{Key: start}, iter)
 }
 
 func (e *EphemeralMemtable) Prune(expiredTs uint64) int {
@@ -123,3 +118,19 @@ func (e *EphemeralMemtable) Get(key string, snapshotTs time.Time) []byte {
 func (e *EphemeralMemtable) Delete(key string) {
 	e.base.Delete(key)
 }
+
+func (e *EphemeralMemtable) ExpireAt(key string, ts, expiresAt uint64) {
+	e.base.ExpireAt(key, ts, expiresAt)
+}
+
+func (e *EphemeralMemtable) SetOldestSnapshot(ts uint64) bool {
+	return e.base.KeepSnapshot(ts)
+}
+
+func (e *EphemeralMemtable) DeleteRange(start, end string, ts uint64) {
+	e.base.DeleteRange(start, end, ts)
+}
+
+func (e *EphemeralMemtable) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	return e.base.RangeTombstones(snapshotTs)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/dborchard/cometkv/pkg/memtable/base"
 	"github.com/dborchard/cometkv/pkg/memtable/vacuum_skiplist/sl"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"time"
 )
@@ -33,51 +34,45 @@ func (e *EphemeralMemtable) Name() string {
 }
 
 func (e *EphemeralMemtable) Put(key string, val []byte) {
-	internalKey := entry.KeyWithTs([]byte(key), timestamp.Now())
+	e.PutWithTs(key, val, timestamp.Now())
+}
+
+func (e *EphemeralMemtable) PutWithTs(key string, val []byte, ts uint64) {
+	internalKey := entry.KeyWithTs([]byte(key), ts)
 	e.list.Set(internalKey, val)
 }
 
 func (e *EphemeralMemtable) Scan(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[string, []byte] {
-	snapshotTs := opt.SnapshotTs
-	//0. Check if snapshotTs has already expired
-	if !timestamp.IsValidTs(snapshotTs, e.base.TTL) {
-		return []entry.Pair[string, []byte]{}
-	}
-
-	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	return e.base.Scan(startKey, count, opt)
+}
 
-	// 1. Do range scan 	{startKey, snapshotTs} <= item <= {endKey, snapshotTs}
-	internalKey := entry.KeyWithTs([]byte(startKey), snapshotTsNano)
-	uniqueKVs := make(map[string][]byte)
-	seenKeys := make(map[string]any)
-	idx := 1
+func (e *EphemeralMemtable) ScanVersions(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return e.base.ScanVersions(startKey, count, opt)
+}
 
-	e.list.Scan(internalKey, func(item *sl.Element[[]byte, []byte]) bool {
-		if idx > count {
-			return false
-		}
+func (e *EphemeralMemtable) ScanHistory(startKey string, count int, opt memtable.ScanOptions) []entry.Pair[[]byte, []byte] {
+	return e.base.ScanHistory(startKey, count, opt)
+}
 
-		// expiredTs < ItemTs < snapshotTs
-		itemTs := entry.ParseTs(item.Key())
-		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
-		greaterThanExpiredTs := timestamp.IsValidTsUint(itemTs, e.base.TTL)
-
-		if lessThanOrEqualToSnapshotTs && greaterThanExpiredTs {
-			strKey := string(entry.ParseKey(item.Key()))
-			if _, seen := seenKeys[strKey]; !seen {
-				seenKeys[strKey] = true
-				if opt.IncludeFull || item.Value != nil {
-					uniqueKVs[strKey] = item.Value
-					idx++
-				}
-			}
-		}
+func (e *EphemeralMemtable) NewIterator(opt memtable.ScanOptions) iterator.Iterator {
+	return e.base.NewIterator(opt)
+}
 
-		return true
+func (e *EphemeralMemtable) Ascend(start []byte, _ time.Time, fn func(key, val []byte) bool) {
+	e.list.Scan(start, func(item *sl.Element[[]byte, []byte]) bool {
+		return fn(item.Key(), item.Value)
 	})
+}
 
-	// 2. Sorted key set
-	return entry.MapToArray(uniqueKVs)
+func (e *EphemeralMemtable) Descend(start []byte, _ time.Time, fn func(key, val []byte) bool) {
+	iter := func(item *sl.Element[[]byte, []byte]) bool {
+		return fn(item.Key(), item.Value)
+	}
+	if start == nil {
+		e.list.Reverse(iter)
+		return
+	}
+	e.list.ScanReverse(start, iter)
 }
 
 func (e *EphemeralMemtable) Prune(expiredTs uint64) int {
@@ -111,6 +106,22 @@ func (e *EphemeralMemtable) Delete(key string) {
 	e.base.Delete(key)
 }
 
+func (e *EphemeralMemtable) ExpireAt(key string, ts, expiresAt uint64) {
+	e.base.ExpireAt(key, ts, expiresAt)
+}
+
+func (e *EphemeralMemtable) SetOldestSnapshot(ts uint64) bool {
+	return e.base.KeepSnapshot(ts)
+}
+
+func (e *EphemeralMemtable) DeleteRange(start, end string, ts uint64) {
+	e.base.DeleteRange(start, end, ts)
+}
+
+func (e *EphemeralMemtable) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	return e.base.RangeTombstones(snapshotTs)
+}
+
 func (e *EphemeralMemtable) StartGc(interval time.Duration, ctx context.Context) {
 	e.base.StartGc(interval, ctx)
 }
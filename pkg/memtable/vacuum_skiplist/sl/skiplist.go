@@ -75,6 +75,8 @@ type SkipList[K, V any] interface {
 	Keys() (keys []K)
 	SetMaxLevel(level int) (old int)
 	Scan(key K, iter func(element *Element[K, V]) bool)
+	ScanReverse(key K, iter func(element *Element[K, V]) bool)
+	Reverse(iter func(element *Element[K, V]) bool)
 }
 
 var _ = SkipList[int, int](&skipListUnSafe[int, int]{})
@@ -278,6 +280,32 @@ func (list *skipListUnSafe[K, V]) Scan(key K, iter func(element *Element[K, V])
 	}
 }
 
+// ScanReverse is Scan in reverse order, from the last element that is less or equal
+// to key.
+func (list *skipListUnSafe[K, V]) ScanReverse(key K, iter func(element *Element[K, V]) bool) {
+	item := list.Find(key)
+	if item == nil {
+		item = list.Back()
+	} else if list.comparable(item.key, key) > 0 {
+		item = item.Prev()
+	}
+	list.scanBack(item, iter)
+}
+
+// Reverse scans all the records in reverse order, from the back.
+func (list *skipListUnSafe[K, V]) Reverse(iter func(element *Element[K, V]) bool) {
+	list.scanBack(list.Back(), iter)
+}
+
+func (list *skipListUnSafe[K, V]) scanBack(item *Element[K, V], iter func(element *Element[K, V]) bool) {
+	for item != nil {
+		if iter(item) == false {
+			break
+		}
+		item = item.Prev()
+	}
+}
+
 // Get returns an element with the key.
 // If the key is not found, returns nil.
 //
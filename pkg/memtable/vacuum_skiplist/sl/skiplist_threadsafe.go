@@ -101,6 +101,21 @@ func (list *safeSkipList[K, V]) Scan(key K, iter func(element *Element[K, V]) bo
 	list.skipListUnSafe.Scan(key, iter)
 }
 
+// ScanReverse is Scan in reverse order, from the last element that is less or equal
+// to key.
+func (list *safeSkipList[K, V]) ScanReverse(key K, iter func(element *Element[K, V]) bool) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	list.skipListUnSafe.ScanReverse(key, iter)
+}
+
+// Reverse scans all the records in reverse order, from the back.
+func (list *safeSkipList[K, V]) Reverse(iter func(element *Element[K, V]) bool) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	list.skipListUnSafe.Reverse(iter)
+}
+
 // Get returns an element with the key.
 // If the key is not found, returns nil.
 //
@@ -0,0 +1,104 @@
+package bloom
+
+import "math"
+
+// Filter is a bloom filter over user keys. The last byte holds the number of probes.
+// An empty Filter matches every key.
+type Filter []byte
+
+// Builder collects key hashes and builds a Filter of bitsPerKey bits per key.
+type Builder struct {
+	bitsPerKey int
+	hashes     []uint32
+}
+
+func NewBuilder(bitsPerKey int) *Builder {
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+func (b *Builder) Add(key []byte) {
+	b.hashes = append(b.hashes, hash(key))
+}
+
+func (b *Builder) Build() Filter {
+	if b.bitsPerKey <= 0 || len(b.hashes) == 0 {
+		return nil
+	}
+
+	// k = ln(2) * bitsPerKey minimizes the false positive rate
+	k := int(math.Round(float64(b.bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+
+	nBits := len(b.hashes) * b.bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+
+	filter := make(Filter, nBytes+1)
+	filter[nBytes] = byte(k)
+	for _, h := range b.hashes {
+		// double hashing, as in LevelDB
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % uint32(nBits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// MayContain returns false only if key was never added.
+func (f Filter) MayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	nBytes := len(f) - 1
+	nBits := uint32(nBytes * 8)
+	k := int(f[nBytes])
+
+	h := hash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % nBits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// hash is the 32-bit murmur-like hash used by LevelDB's filters.
+func hash(data []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+	h := uint32(seed) ^ uint32(len(data))*m
+
+	for ; len(data) >= 4; data = data[4:] {
+		h += uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(data) {
+	case 3:
+		h += uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(data[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
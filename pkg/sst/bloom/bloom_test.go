@@ -0,0 +1,33 @@
+package bloom
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	b := NewBuilder(10)
+	for i := 0; i < 10000; i++ {
+		b.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	f := b.Build()
+
+	for i := 0; i < 10000; i++ {
+		assert.True(t, f.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	// ~1% for 10 bits per key
+	assert.True(t, falsePositives < 300, "false positives %d", falsePositives)
+}
+
+func TestEmptyFilter(t *testing.T) {
+	assert.True(t, NewBuilder(0).Build().MayContain([]byte("any")))
+	assert.True(t, NewBuilder(10).Build().MayContain([]byte("any")))
+}
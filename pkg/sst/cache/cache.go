@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const numShards = 16
+
+// Key identifies a block: the cache ID of its file, from NewID, and its offset.
+type Key struct {
+	ID     uint64
+	Offset uint64
+}
+
+// Cache is a sharded LRU cache of SST blocks bounded by the total size of the blocks.
+// Cached blocks are shared and must not be modified. A nil Cache caches nothing.
+type Cache struct {
+	shards   [numShards]shard
+	capacity int64
+	nextID   atomic.Uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type Stats struct {
+	Hits     uint64
+	Misses   uint64
+	Entries  int
+	Size     int64 // bytes
+	Capacity int64 // bytes
+}
+
+// HitRatio is the fraction of the lookups served from the cache.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// New returns a cache holding up to capacity bytes of blocks, or nil if capacity is
+// not positive.
+func New(capacity int64) *Cache {
+	if capacity <= 0 {
+		return nil
+	}
+	c := &Cache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i].init(capacity / numShards)
+	}
+	return c
+}
+
+// NewID returns a cache ID for a new file. IDs are never reused, so that the blocks
+// of a deleted file are never served for another one.
+func (c *Cache) NewID() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.nextID.Add(1)
+}
+
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	block, ok := c.shard(key).get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return block, ok
+}
+
+// Insert adds block, evicting the least recently used blocks of its shard to make room.
+// Blocks larger than a shard are not cached.
+func (c *Cache) Insert(key Key, block []byte) {
+	if c == nil {
+		return
+	}
+	c.shard(key).insert(key, block)
+}
+
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	s := Stats{Hits: c.hits.Load(), Misses: c.misses.Load(), Capacity: c.capacity}
+	for i := range c.shards {
+		entries, size := c.shards[i].usage()
+		s.Entries += entries
+		s.Size += size
+	}
+	return s
+}
+
+func (c *Cache) shard(key Key) *shard {
+	// fibonacci hashing spreads the consecutive IDs and offsets
+	h := (key.ID*31 + key.Offset) * 0x9e3779b97f4a7c15
+	return &c.shards[h>>60]
+}
+
+type shard struct {
+	sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // front is the most recently used
+	items    map[Key]*list.Element
+}
+
+type item struct {
+	key   Key
+	block []byte
+}
+
+func (s *shard) init(capacity int64) {
+	s.capacity = capacity
+	s.lru = list.New()
+	s.items = make(map[Key]*list.Element)
+}
+
+func (s *shard) get(key Key) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*item).block, true
+}
+
+func (s *shard) insert(key Key, block []byte) {
+	size := int64(len(block))
+	if size > s.capacity {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.size += size - int64(len(e.Value.(*item).block))
+		e.Value.(*item).block = block
+		s.lru.MoveToFront(e)
+	} else {
+		s.items[key] = s.lru.PushFront(&item{key: key, block: block})
+		s.size += size
+	}
+
+	for s.size > s.capacity {
+		e := s.lru.Back()
+		it := e.Value.(*item)
+		s.lru.Remove(e)
+		delete(s.items, it.key)
+		s.size -= int64(len(it.block))
+	}
+}
+
+func (s *shard) usage() (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.items), s.size
+}
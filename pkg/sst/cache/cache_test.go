@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := New(numShards * 100)
+	id := c.NewID()
+
+	_, ok := c.Get(Key{ID: id, Offset: 0})
+	assert.False(t, ok)
+	c.Insert(Key{ID: id, Offset: 0}, make([]byte, 60))
+	block, ok := c.Get(Key{ID: id, Offset: 0})
+	assert.True(t, ok)
+	assert.Equal(t, 60, len(block))
+
+	// another file never sees the block
+	_, ok = c.Get(Key{ID: c.NewID(), Offset: 0})
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, int64(60), stats.Size)
+	assert.Equal(t, 1, stats.Entries)
+
+	// blocks larger than a shard are not cached
+	c.Insert(Key{ID: id, Offset: 1}, make([]byte, 101))
+	_, ok = c.Get(Key{ID: id, Offset: 1})
+	assert.False(t, ok)
+}
+
+func TestEviction(t *testing.T) {
+	c := New(numShards * 100)
+	var keys []Key
+	for offset := uint64(0); len(keys) < 3; offset++ {
+		key := Key{ID: 1, Offset: offset}
+		if len(keys) == 0 || c.shard(key) == c.shard(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+
+	c.Insert(keys[0], make([]byte, 40))
+	c.Insert(keys[1], make([]byte, 40))
+	c.Get(keys[0])
+	// keys[1] is the least recently used
+	c.Insert(keys[2], make([]byte, 40))
+
+	_, ok := c.Get(keys[0])
+	assert.True(t, ok)
+	_, ok = c.Get(keys[1])
+	assert.False(t, ok)
+	_, ok = c.Get(keys[2])
+	assert.True(t, ok)
+	assert.LessOrEqual(t, c.Stats().Size, int64(numShards*100))
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache
+	assert.Nil(t, New(0))
+	c.Insert(Key{}, []byte("a"))
+	_, ok := c.Get(Key{})
+	assert.False(t, ok)
+	assert.Equal(t, Stats{}, c.Stats())
+}
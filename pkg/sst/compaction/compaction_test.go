@@ -0,0 +1,182 @@
+package compaction
+
+import (
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func file(id uint64, level int, size uint64, smallest, largest string) FileInfo {
+	return FileInfo{ID: id, Level: level, Size: size, Smallest: []byte(smallest), Largest: []byte(largest)}
+}
+
+func ids(files []FileInfo) []uint64 {
+	var res []uint64
+	for _, f := range files {
+		res = append(res, f.ID)
+	}
+	return res
+}
+
+func TestLeveledPick(t *testing.T) {
+	p := DefaultLeveledPolicy()
+	p.BaseLevelSize = 100
+
+	files := []FileInfo{
+		file(1, 1, 10, "a", "c"),
+		file(2, 1, 10, "d", "f"),
+		file(3, 1, 10, "x", "z"),
+		file(4, 0, 10, "b", "e"),
+		file(5, 0, 10, "c", "d"),
+		file(6, 0, 10, "b", "b"),
+	}
+	assert.Nil(t, p.Pick(files))
+
+	// L0 trigger: all of L0 and the overlapping L1 files
+	files = append(files, file(7, 0, 10, "a", "a"))
+	task := p.Pick(files)
+	require.NotNil(t, task)
+	assert.ElementsMatch(t, []uint64{4, 5, 6, 7, 1, 2}, ids(task.Inputs))
+	assert.Equal(t, 1, task.OutputLevel)
+	assert.True(t, task.Bottom)
+
+	// L1 over its target size: the oldest file is pushed down
+	files = []FileInfo{
+		file(1, 1, 60, "a", "c"),
+		file(2, 1, 60, "d", "f"),
+		file(3, 2, 10, "b", "b"),
+		file(4, 2, 10, "e", "e"),
+		file(5, 3, 10, "a", "z"),
+	}
+	task = p.Pick(files)
+	require.NotNil(t, task)
+	assert.Equal(t, []uint64{1, 3}, ids(task.Inputs))
+	assert.Equal(t, 2, task.OutputLevel)
+	assert.False(t, task.Bottom)
+}
+
+func TestSizeTieredPick(t *testing.T) {
+	p := DefaultSizeTieredPolicy()
+
+	files := []FileInfo{
+		file(1, 0, 1000, "a", "z"),
+		file(2, 0, 10, "a", "c"),
+		file(3, 0, 12, "b", "d"),
+		file(4, 0, 9, "c", "e"),
+	}
+	assert.Nil(t, p.Pick(files))
+
+	files = append(files, file(5, 0, 11, "d", "f"))
+	task := p.Pick(files)
+	require.NotNil(t, task)
+	assert.ElementsMatch(t, []uint64{2, 3, 4, 5}, ids(task.Inputs))
+	assert.Equal(t, 0, task.OutputLevel)
+	assert.False(t, task.Bottom)
+}
+
+type sliceIterator struct {
+	pairs []entry.Pair[[]byte, []byte]
+}
+
+func (it *sliceIterator) Valid() bool   { return len(it.pairs) > 0 }
+func (it *sliceIterator) Key() []byte   { return it.pairs[0].Key }
+func (it *sliceIterator) Value() []byte { return it.pairs[0].Val }
+func (it *sliceIterator) Next()         { it.pairs = it.pairs[1:] }
+
+type sliceWriter struct {
+	pairs      []entry.Pair[[]byte, []byte]
+	tombstones []entry.RangeTombstone
+	size       uint64
+}
+
+func (w *sliceWriter) Add(key, val []byte) error {
+	w.pairs = append(w.pairs, entry.Pair[[]byte, []byte]{Key: append([]byte{}, key...), Val: val})
+	w.size += uint64(len(key) + len(val))
+	return nil
+}
+func (w *sliceWriter) AddRangeTombstone(t entry.RangeTombstone) error {
+	w.tombstones = append(w.tombstones, t)
+	return nil
+}
+func (w *sliceWriter) EstimatedSize() uint64 { return w.size }
+func (w *sliceWriter) Finish() error         { return nil }
+
+func kv(key string, ts uint64, val string) entry.Pair[[]byte, []byte] {
+	pair := entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(key), ts)}
+	if val != "" {
+		pair.Val = []byte(val)
+	}
+	return pair
+}
+
+func run(t *testing.T, task *Task, oldestSnapshotTs uint64, inputs ...[]entry.Pair[[]byte, []byte]) []*sliceWriter {
+	return runWithTombstones(t, task, nil, oldestSnapshotTs, inputs...)
+}
+
+func runWithTombstones(t *testing.T, task *Task, tombstones []entry.RangeTombstone, oldestSnapshotTs uint64, inputs ...[]entry.Pair[[]byte, []byte]) []*sliceWriter {
+	var iters []Iterator
+	for _, input := range inputs {
+		iters = append(iters, &sliceIterator{pairs: input})
+	}
+	var outputs []*sliceWriter
+	require.NoError(t, Run(task, iters, tombstones, oldestSnapshotTs, func() (Writer, error) {
+		w := &sliceWriter{}
+		outputs = append(outputs, w)
+		return w, nil
+	}))
+	return outputs
+}
+
+func TestRun(t *testing.T) {
+	newer := []entry.Pair[[]byte, []byte]{kv("a", 30, "a3"), kv("b", 30, ""), kv("c", 30, "c3")}
+	older := []entry.Pair[[]byte, []byte]{kv("a", 20, "a2"), kv("a", 10, "a1"), kv("b", 10, "b1"), kv("c", 30, "c3")}
+
+	// a@10 is shadowed by a@20 at snapshot 25, a@30 is newer than every snapshot
+	outputs := run(t, &Task{}, 25, newer, older)
+	require.Equal(t, 1, len(outputs))
+	assert.Equal(t, []entry.Pair[[]byte, []byte]{
+		kv("a", 30, "a3"), kv("a", 20, "a2"), kv("b", 30, ""), kv("b", 10, "b1"), kv("c", 30, "c3"),
+	}, outputs[0].pairs)
+
+	// the tombstone of b is the oldest visible version and nothing is below it
+	outputs = run(t, &Task{Bottom: true}, 40, newer, older)
+	assert.Equal(t, []entry.Pair[[]byte, []byte]{kv("a", 30, "a3"), kv("c", 30, "c3")}, outputs[0].pairs)
+
+	// not at the bottom, the tombstone still shadows older files
+	outputs = run(t, &Task{}, 40, newer, older)
+	assert.Equal(t, []entry.Pair[[]byte, []byte]{kv("a", 30, "a3"), kv("b", 30, ""), kv("c", 30, "c3")}, outputs[0].pairs)
+
+	// one file per key once MaxFileSize is reached
+	outputs = run(t, &Task{MaxFileSize: 1}, 0, newer, older)
+	assert.Equal(t, 3, len(outputs))
+	assert.Equal(t, 3, len(outputs[0].pairs))
+}
+
+func TestRunRangeTombstones(t *testing.T) {
+	input := []entry.Pair[[]byte, []byte]{kv("a", 10, "a1"), kv("b", 30, "b3"), kv("b", 10, "b1"), kv("c", 10, "c1")}
+	tombstones := []entry.RangeTombstone{{Start: "a", End: "c", Ts: 20}, {Start: "a", End: "c", Ts: 20}}
+
+	// a@10 and b@10 are deleted for every snapshot, b@30 is written after the range
+	outputs := runWithTombstones(t, &Task{}, tombstones, 25, input)
+	assert.Equal(t, []entry.Pair[[]byte, []byte]{kv("b", 30, "b3"), kv("c", 10, "c1")}, outputs[0].pairs)
+	assert.Equal(t, []entry.RangeTombstone{{Start: "a", End: "c", Ts: 20}}, outputs[0].tombstones)
+
+	// a snapshot older than the range still reads the versions it covers
+	outputs = runWithTombstones(t, &Task{Bottom: true}, tombstones, 15, input)
+	assert.Equal(t, input, outputs[0].pairs)
+	assert.Equal(t, 1, len(outputs[0].tombstones))
+
+	// at the bottom, nothing is left for the range to delete
+	outputs = runWithTombstones(t, &Task{Bottom: true}, tombstones, 25, input)
+	assert.Empty(t, outputs[0].tombstones)
+
+	// split across files, the range is clipped to the key range of every file
+	input = []entry.Pair[[]byte, []byte]{kv("b", 30, "b3"), kv("c", 30, "c3"), kv("d", 30, "d3")}
+	tombstones = []entry.RangeTombstone{{Start: "a", End: "z", Ts: 20}}
+	outputs = runWithTombstones(t, &Task{MaxFileSize: 1}, tombstones, 25, input)
+	require.Equal(t, 3, len(outputs))
+	assert.Equal(t, []entry.RangeTombstone{{Start: "a", End: "c", Ts: 20}}, outputs[0].tombstones)
+	assert.Equal(t, []entry.RangeTombstone{{Start: "c", End: "d", Ts: 20}}, outputs[1].tombstones)
+	assert.Equal(t, []entry.RangeTombstone{{Start: "d", End: "z", Ts: 20}}, outputs[2].tombstones)
+}
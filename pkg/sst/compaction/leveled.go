@@ -0,0 +1,58 @@
+package compaction
+
+// LeveledPolicy keeps level 0 for flushed files, which may overlap, and levels >= 1 as
+// sorted runs of non-overlapping files, each level LevelMultiplier times bigger than the
+// previous one.
+type LeveledPolicy struct {
+	// L0Trigger is the number of level 0 files that triggers a merge into level 1.
+	L0Trigger       int
+	BaseLevelSize   uint64
+	LevelMultiplier int
+	MaxLevels       int
+	TargetFileSize  uint64
+}
+
+func DefaultLeveledPolicy() *LeveledPolicy {
+	return &LeveledPolicy{
+		L0Trigger:       4,
+		BaseLevelSize:   10 << 20, // 10MB
+		LevelMultiplier: 10,
+		MaxLevels:       7,
+		TargetFileSize:  2 << 20, // 2MB
+	}
+}
+
+func (p *LeveledPolicy) Pick(files []FileInfo) *Task {
+	levels := make([][]FileInfo, p.MaxLevels)
+	for _, f := range files {
+		lvl := f.Level
+		if lvl >= p.MaxLevels {
+			lvl = p.MaxLevels - 1
+		}
+		levels[lvl] = append(levels[lvl], f)
+	}
+
+	// 1. Level 0 is merged with the overlapping part of level 1
+	if len(levels[0]) >= p.L0Trigger {
+		smallest, largest := keyRange(levels[0])
+		inputs := append(levels[0], overlapping(levels[1], smallest, largest)...)
+		return newTask(files, inputs, 1, p.TargetFileSize)
+	}
+
+	// 2. The first level over its target size pushes its oldest file down
+	target := p.BaseLevelSize
+	for lvl := 1; lvl < p.MaxLevels-1; lvl++ {
+		if totalSize(levels[lvl]) > target {
+			oldest := levels[lvl][0]
+			for _, f := range levels[lvl] {
+				if f.ID < oldest.ID {
+					oldest = f
+				}
+			}
+			inputs := append([]FileInfo{oldest}, overlapping(levels[lvl+1], oldest.Smallest, oldest.Largest)...)
+			return newTask(files, inputs, lvl+1, p.TargetFileSize)
+		}
+		target *= uint64(p.LevelMultiplier)
+	}
+	return nil
+}
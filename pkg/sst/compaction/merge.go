@@ -0,0 +1,175 @@
+package compaction
+
+import (
+	"bytes"
+	"container/heap"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+)
+
+// Iterator walks the entries of an SST file in internal key order. Value is nil for a
+// tombstone.
+type Iterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next()
+}
+
+// Writer receives the output of a compaction.
+type Writer interface {
+	Add(key, val []byte) error
+	AddRangeTombstone(t entry.RangeTombstone) error
+	EstimatedSize() uint64
+	Finish() error
+}
+
+// Run merges iters into the files returned by newWriter. For every key it keeps the
+// versions newer than oldestSnapshotTs and the newest version at or below it, which is
+// dropped too if it is a tombstone and the task is at the bottom. Versions covered by
+// one of the range tombstones of the inputs at or below oldestSnapshotTs are dropped.
+// The range tombstones are kept, unless the task is at the bottom and they are at or
+// below oldestSnapshotTs, clipped to the key range of every file, so that the files do
+// not overlap. A new file is started once the current one reaches task.MaxFileSize,
+// never in the middle of a key.
+func Run(task *Task, iters []Iterator, tombstones []entry.RangeTombstone, oldestSnapshotTs uint64, newWriter func() (Writer, error)) error {
+	// 1. Init Heap
+	mh := &minHeap{}
+	for _, iter := range iters {
+		if iter.Valid() {
+			heap.Push(mh, iter)
+		}
+	}
+
+	var kept []entry.RangeTombstone
+	seen := make(map[entry.RangeTombstone]struct{}, len(tombstones))
+	for _, t := range tombstones {
+		if _, dup := seen[t]; dup || (task.Bottom && t.Ts <= oldestSnapshotTs) {
+			continue
+		}
+		seen[t] = struct{}{}
+		kept = append(kept, t)
+	}
+
+	// 2. Merge. The file being written holds the keys from fileStart up to the first
+	// key of the next file.
+	var w Writer
+	var fileStart string
+	var prevKey, prevUserKey []byte
+	started, keptVisible := false, false
+	for mh.Len() > 0 {
+		iter := (*mh)[0]
+		key, val := iter.Key(), iter.Value()
+		userKey := entry.ParseKey(key)
+
+		drop := false
+		if started && bytes.Equal(key, prevKey) {
+			// same version found in two files
+			drop = true
+		} else {
+			newUserKey := !started || !bytes.Equal(userKey, prevUserKey)
+			if newUserKey {
+				keptVisible = false
+			}
+
+			if _, covered := entry.CoveringTs(tombstones, userKey, entry.ParseTs(key), oldestSnapshotTs); covered {
+				// deleted for every live snapshot
+				drop, keptVisible = true, true
+			} else if entry.ParseTs(key) <= oldestSnapshotTs {
+				if keptVisible {
+					// shadowed for every live snapshot
+					drop = true
+				} else {
+					keptVisible = true
+					drop = val == nil && task.Bottom
+				}
+			}
+
+			if !drop {
+				if w != nil && newUserKey && task.MaxFileSize > 0 && w.EstimatedSize() >= task.MaxFileSize {
+					if err := addRangeTombstones(w, kept, fileStart, string(userKey)); err != nil {
+						return err
+					}
+					if err := w.Finish(); err != nil {
+						return err
+					}
+					w, fileStart = nil, string(userKey)
+				}
+				if w == nil {
+					var err error
+					if w, err = newWriter(); err != nil {
+						return err
+					}
+				}
+				if err := w.Add(key, val); err != nil {
+					return err
+				}
+			}
+			prevUserKey = append(prevUserKey[:0], userKey...)
+		}
+		prevKey = append(prevKey[:0], key...)
+		started = true
+
+		iter.Next()
+		if iter.Valid() {
+			heap.Fix(mh, 0)
+		} else {
+			heap.Pop(mh)
+		}
+	}
+
+	// 3. The last file holds the range tombstones past its start
+	if w == nil && len(kept) > 0 {
+		var err error
+		if w, err = newWriter(); err != nil {
+			return err
+		}
+	}
+	if w == nil {
+		return nil
+	}
+	if err := addRangeTombstones(w, kept, fileStart, ""); err != nil {
+		return err
+	}
+	return w.Finish()
+}
+
+// addRangeTombstones adds the part of tombstones within [start, end) to w. An empty end
+// does not limit the range.
+func addRangeTombstones(w Writer, tombstones []entry.RangeTombstone, start, end string) error {
+	for _, t := range tombstones {
+		if t.Start < start {
+			t.Start = start
+		}
+		if end != "" && t.End > end {
+			t.End = end
+		}
+		if t.Start >= t.End {
+			continue
+		}
+		if err := w.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type minHeap []Iterator
+
+func (m *minHeap) Len() int { return len(*m) }
+func (m *minHeap) Less(i, j int) bool {
+	return entry.CompareKeys((*m)[i].Key(), (*m)[j].Key()) < 0
+}
+func (m *minHeap) Swap(i, j int) { (*m)[i], (*m)[j] = (*m)[j], (*m)[i] }
+
+func (m *minHeap) Push(x interface{}) {
+	*m = append(*m, x.(Iterator))
+}
+
+func (m *minHeap) Pop() interface{} {
+	old := *m
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*m = old[0 : n-1]
+	return x
+}
@@ -0,0 +1,107 @@
+package compaction
+
+import "bytes"
+
+// FileInfo describes an SST file to a Policy. Smallest and Largest are user keys. The
+// range of a file includes its range tombstones, whose exclusive end may be the
+// Smallest of the next file of the level.
+type FileInfo struct {
+	ID       uint64
+	Level    int
+	Size     uint64
+	Smallest []byte
+	Largest  []byte
+}
+
+func (f FileInfo) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(f.Smallest, largest) <= 0 && bytes.Compare(smallest, f.Largest) <= 0
+}
+
+// Task is a compaction picked by a Policy.
+type Task struct {
+	Inputs      []FileInfo
+	OutputLevel int
+	// MaxFileSize splits the output into files of about this size. Zero writes a
+	// single file.
+	MaxFileSize uint64
+	// Bottom is set when no other file overlaps the inputs, so tombstones no longer
+	// shadow anything and can be dropped.
+	Bottom bool
+}
+
+// Policy decides which files to merge next.
+type Policy interface {
+	// Pick returns the next compaction of files, or nil if none is needed.
+	Pick(files []FileInfo) *Task
+}
+
+type Style int
+
+const (
+	Leveled Style = iota
+	SizeTiered
+)
+
+// NewPolicy returns the policy of style s with its default tuning.
+func NewPolicy(s Style) Policy {
+	switch s {
+	case Leveled:
+		return DefaultLeveledPolicy()
+	case SizeTiered:
+		return DefaultSizeTieredPolicy()
+	default:
+		panic("unknown compaction style")
+	}
+}
+
+func newTask(files, inputs []FileInfo, outputLevel int, maxFileSize uint64) *Task {
+	task := &Task{Inputs: inputs, OutputLevel: outputLevel, MaxFileSize: maxFileSize, Bottom: true}
+
+	smallest, largest := keyRange(inputs)
+	for _, f := range files {
+		if !task.IsInput(f.ID) && f.overlaps(smallest, largest) {
+			task.Bottom = false
+			break
+		}
+	}
+	return task
+}
+
+func (t *Task) IsInput(id uint64) bool {
+	for _, f := range t.Inputs {
+		if f.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func keyRange(files []FileInfo) (smallest, largest []byte) {
+	for i, f := range files {
+		if i == 0 || bytes.Compare(f.Smallest, smallest) < 0 {
+			smallest = f.Smallest
+		}
+		if i == 0 || bytes.Compare(f.Largest, largest) > 0 {
+			largest = f.Largest
+		}
+	}
+	return smallest, largest
+}
+
+func overlapping(files []FileInfo, smallest, largest []byte) []FileInfo {
+	var res []FileInfo
+	for _, f := range files {
+		if f.overlaps(smallest, largest) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func totalSize(files []FileInfo) uint64 {
+	var size uint64
+	for _, f := range files {
+		size += f.Size
+	}
+	return size
+}
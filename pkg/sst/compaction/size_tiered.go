@@ -0,0 +1,56 @@
+package compaction
+
+import "sort"
+
+// SizeTieredPolicy buckets files of similar size and merges a bucket into a single file
+// once it holds MinThreshold files. Every file stays in level 0.
+type SizeTieredPolicy struct {
+	MinThreshold int
+	MaxThreshold int
+	// A file joins a bucket if its size is within [BucketLow, BucketHigh] times the
+	// average size of the bucket.
+	BucketLow  float64
+	BucketHigh float64
+}
+
+func DefaultSizeTieredPolicy() *SizeTieredPolicy {
+	return &SizeTieredPolicy{
+		MinThreshold: 4,
+		MaxThreshold: 32,
+		BucketLow:    0.5,
+		BucketHigh:   1.5,
+	}
+}
+
+func (p *SizeTieredPolicy) Pick(files []FileInfo) *Task {
+	// 1. Bucket by size
+	sorted := append([]FileInfo{}, files...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Size < sorted[j].Size
+	})
+
+	var buckets [][]FileInfo
+	var bucketAvg float64
+	for _, f := range sorted {
+		last := len(buckets) - 1
+		if last >= 0 && float64(f.Size) >= bucketAvg*p.BucketLow && float64(f.Size) <= bucketAvg*p.BucketHigh {
+			buckets[last] = append(buckets[last], f)
+			bucketAvg = float64(totalSize(buckets[last])) / float64(len(buckets[last]))
+			continue
+		}
+		buckets = append(buckets, []FileInfo{f})
+		bucketAvg = float64(f.Size)
+	}
+
+	// 2. The bucket of the smallest files that is full enough is the cheapest to merge
+	for _, bucket := range buckets {
+		if len(bucket) < p.MinThreshold {
+			continue
+		}
+		if len(bucket) > p.MaxThreshold {
+			bucket = bucket[:p.MaxThreshold]
+		}
+		return newTask(files, bucket, 0, 0)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec identifies how a block is compressed. It is stored in the block trailer, so
+// values must never be renumbered.
+type Codec byte
+
+const (
+	// None stores blocks as is.
+	None Codec = iota
+	// LZ is a snappy-style byte oriented LZ77: fast, with a moderate ratio.
+	LZ
+	// Flate is DEFLATE (RFC 1951), from compress/flate: LZ77 followed by Huffman
+	// coding, slower than LZ but with a better ratio.
+	Flate
+	// Zstd is a zstd-style LZ77, with a larger window, repeated offsets and lazy
+	// matching, whose literals and sequences are Huffman coded. Its ratio is close to
+	// Flate's.
+	Zstd
+)
+
+var ErrCorrupt = errors.New("compress: corrupt input")
+
+func (c Codec) String() string {
+	switch c {
+	case None:
+		return "none"
+	case LZ:
+		return "lz"
+	case Flate:
+		return "flate"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// Compress appends src compressed with c to dst.
+func Compress(c Codec, dst, src []byte) []byte {
+	switch c {
+	case None:
+		return append(dst, src...)
+	case LZ:
+		return encodeLZ(dst, src)
+	case Flate:
+		return encodeFlate(dst, src)
+	case Zstd:
+		return encodeZstd(dst, src)
+	default:
+		panic(fmt.Sprintf("compress: unknown %s", c))
+	}
+}
+
+// Decompress returns src decompressed with c. With None, src itself is returned.
+func Decompress(c Codec, src []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return src, nil
+	case LZ:
+		return decodeLZ(src)
+	case Flate:
+		return decodeFlate(src)
+	case Zstd:
+		return decodeZstd(src)
+	default:
+		return nil, fmt.Errorf("compress: unknown %s", c)
+	}
+}
+
+// Stats compares the size of the data before and after compression.
+type Stats struct {
+	RawBytes    uint64
+	StoredBytes uint64
+}
+
+// Ratio is RawBytes / StoredBytes, 1 when nothing was stored.
+func (s Stats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+// flate writers allocate several hundred KB, reuse them across blocks.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+func encodeFlate(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(buf)
+	// writes to a bytes.Buffer never fail
+	_, _ = w.Write(src)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func decodeFlate(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	dst, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,96 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	var doc bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&doc, `{"id":%d,"name":"user-%d","tags":["a","b"]}`, i, i%7)
+	}
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("x"), 70000),
+		random,
+		doc.Bytes(),
+		append(append(append([]byte{}, random[:100]...), doc.Bytes()...), random[:100]...),
+	}
+
+	for _, codec := range []Codec{None, LZ, Flate, Zstd} {
+		for _, input := range inputs {
+			compressed := Compress(codec, nil, input)
+			decoded, err := Decompress(codec, compressed)
+			require.NoError(t, err, codec.String())
+			assert.Equal(t, len(input), len(decoded))
+			assert.True(t, bytes.Equal(input, decoded), codec.String())
+		}
+
+		if codec != None {
+			assert.Less(t, len(Compress(codec, nil, doc.Bytes())), doc.Len()/2, codec.String())
+		}
+	}
+
+	// entropy coding beats LZ alone
+	assert.Less(t, len(Compress(Zstd, nil, doc.Bytes())), len(Compress(LZ, nil, doc.Bytes())))
+
+	// appends to dst
+	assert.Equal(t, []byte("prefix"), Compress(LZ, []byte("prefix"), doc.Bytes())[:6])
+	assert.Equal(t, []byte("prefix"), Compress(Zstd, []byte("prefix"), doc.Bytes())[:6])
+}
+
+func TestCorrupt(t *testing.T) {
+	compressed := Compress(LZ, nil, bytes.Repeat([]byte("abcd"), 100))
+	for _, bad := range [][]byte{
+		nil,
+		compressed[:len(compressed)-1],
+		// a copy before any output
+		{4, tagCopy, 1, 0},
+		// a length far beyond the input
+		{0xff, 0xff, 0x03},
+	} {
+		_, err := Decompress(LZ, bad)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	}
+
+	// a truncated zstd block never decodes
+	var doc bytes.Buffer
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&doc, `{"id":%d,"name":"user-%d"}`, i, i%7)
+	}
+	compressed = Compress(Zstd, nil, doc.Bytes())
+	for i := range compressed {
+		_, err := Decompress(Zstd, compressed[:i])
+		assert.ErrorIs(t, err, ErrCorrupt, i)
+	}
+	for _, bad := range [][]byte{
+		// an unknown stream mode
+		{1, 0, 9, 0},
+		// an offset before any output
+		{4, 1, streamRaw, 0, streamRLE, 1, 0, streamRLE, 1, 0, streamRLE, 1, 4, 0},
+		// an over-subscribed Huffman code
+		{2, 0, streamHuffman, 2, 3, 0x11, 0x01, 1, 0, streamRaw, 0, streamRaw, 0, streamRaw, 0, 0},
+	} {
+		_, err := Decompress(Zstd, bad)
+		assert.ErrorIs(t, err, ErrCorrupt)
+	}
+
+	_, err := Decompress(Flate, []byte("not flate"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	_, err = Decompress(Codec(9), compressed)
+	assert.Error(t, err)
+}
+
+func TestStats(t *testing.T) {
+	assert.Equal(t, 1.0, Stats{}.Ratio())
+	assert.Equal(t, 2.0, Stats{RawBytes: 200, StoredBytes: 100}.Ratio())
+}
@@ -0,0 +1,151 @@
+package compress
+
+import (
+	"encoding/binary"
+)
+
+// LZ format, close to snappy's:
+//
+//	| decoded length(uvarint) | element | ... | element |
+//
+// Literal element: | tag | extra length bytes | literal |, tag = (length-1)<<2 | 0b00.
+// Lengths above 60 store 60 + n in the tag, followed by length-1 in n little endian bytes.
+//
+// Copy element: | tag | offset(2, little endian) |, tag = (length-1)<<2 | 0b10, copying
+// length (1..64) bytes starting offset bytes back in the output.
+const (
+	tagLiteral = 0b00
+	tagCopy    = 0b10
+
+	minMatch     = 4
+	maxCopyLen   = 64
+	maxOffset    = 1<<16 - 1
+	hashLogSize  = 14
+	maxExpansion = 22 // a 3 byte copy element decodes to up to 64 bytes
+)
+
+func encodeLZ(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	// table maps the hash of 4 bytes to 1 + their last position
+	var table [1 << hashLogSize]int32
+	lit := 0
+	for i := 0; i+minMatch <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hashLZ(cur)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > maxOffset || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+
+		n := minMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = emitLiteral(dst, src[lit:i])
+		dst = emitCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return emitLiteral(dst, src[lit:])
+}
+
+func hashLZ(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - hashLogSize)
+}
+
+func emitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func emitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > maxCopyLen {
+			n = maxCopyLen
+		}
+		dst = append(dst, byte(n-1)<<2|tagCopy, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+func decodeLZ(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > uint64(len(src))*maxExpansion {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		switch tag & 0b11 {
+		case tagLiteral:
+			length := int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for j := 0; j < extra; j++ {
+					length |= int(src[j]) << (8 * j)
+				}
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+		case tagCopy:
+			length := int(tag>>2) + 1
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			offset := int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+			if offset == 0 || offset > len(dst) {
+				return nil, ErrCorrupt
+			}
+			// byte by byte, the copy may overlap its own output
+			for j := 0; j < length; j++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, ErrCorrupt
+		}
+
+		if uint64(len(dst)) > size {
+			return nil, ErrCorrupt
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,600 @@
+package compress
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// Zstd format, a simplified zstd: LZ77 sequences whose literals and codes are entropy
+// coded.
+//
+//	| decoded length(uvarint) | sequence count(uvarint) | literals | literal length codes |
+//	| match length codes | offset codes | extra bits length(uvarint) | extra bits |
+//
+// A sequence copies literal length bytes from the literals, then match length bytes
+// starting offset bytes back in the output. The literals left after the last sequence
+// end the output. Lengths and offsets are stored as a code, in their stream, and the
+// extra bits of the code, least significant bit first (see valueCode). As in zstd, an
+// offset value of 1 to 3 repeats one of the last 3 offsets, larger ones are offset + 3.
+//
+// The literals and codes are byte streams: | mode | count(uvarint) | ... |, where mode
+// streamRaw stores the bytes, streamRLE one byte repeated and streamHuffman the code
+// lengths of the symbols below a symbol count(uvarint), 4 bits each, followed by the
+// length(uvarint) and bits of their canonical Huffman codes.
+const (
+	streamRaw = iota
+	streamRLE
+	streamHuffman
+
+	zMinMatch    = 4
+	zMaxOffset   = 1<<20 - 1
+	zHashLog     = 15
+	zSearchDepth = 16
+	zRepOffsets  = 3
+
+	maxCodeLen = 11
+	// maxCodeValue bounds the values stored as a code, see valueCode.
+	maxCodeValue = 1<<31 - 1
+)
+
+// initialRepOffsets are the repeated offsets before the first sequence, as in zstd.
+var initialRepOffsets = [zRepOffsets]int{1, 4, 8}
+
+type sequence struct {
+	litLen, matchLen, offsetValue uint32
+}
+
+func encodeZstd(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	// 1. Parse src into sequences
+	seqs, literals := parseSequences(src)
+
+	// 2. Split the sequences into codes and their extra bits
+	llCodes := make([]byte, len(seqs))
+	mlCodes := make([]byte, len(seqs))
+	ofCodes := make([]byte, len(seqs))
+	var extra bitWriter
+	for i, s := range seqs {
+		llCodes[i] = extra.writeValue(s.litLen)
+		mlCodes[i] = extra.writeValue(s.matchLen - zMinMatch)
+		ofCodes[i] = extra.writeValue(s.offsetValue)
+	}
+
+	// 3. Entropy code the streams
+	dst = binary.AppendUvarint(dst, uint64(len(seqs)))
+	for _, stream := range [][]byte{literals, llCodes, mlCodes, ofCodes} {
+		dst = appendStream(dst, stream)
+	}
+	extraBits := extra.finish()
+	dst = binary.AppendUvarint(dst, uint64(len(extraBits)))
+	return append(dst, extraBits...)
+}
+
+// parseSequences finds the matches of src with hash chains, one step lazily, and
+// returns them with the literals between them.
+func parseSequences(src []byte) ([]sequence, []byte) {
+	var seqs []sequence
+	var literals []byte
+	if len(src) < zMinMatch {
+		return nil, append(literals, src...)
+	}
+
+	// head maps the hash of 4 bytes to 1 + their last position, chain a position to
+	// 1 + the previous one with the same hash
+	head := make([]int32, 1<<zHashLog)
+	chain := make([]int32, len(src))
+	inserted := 0
+	insert := func(end int) {
+		for ; inserted < end && inserted+zMinMatch <= len(src); inserted++ {
+			h := hashZstd(binary.LittleEndian.Uint32(src[inserted:]))
+			chain[inserted] = head[h]
+			head[h] = int32(inserted + 1)
+		}
+	}
+	rep := initialRepOffsets
+	findMatch := func(i int) (offset, length int) {
+		insert(i)
+		for _, o := range rep {
+			if n := matchLen(src, i-o, i); n >= zMinMatch && n > length {
+				offset, length = o, n
+			}
+		}
+		cand := int(head[hashZstd(binary.LittleEndian.Uint32(src[i:]))]) - 1
+		for depth := 0; cand >= 0 && i-cand <= zMaxOffset && depth < zSearchDepth; depth++ {
+			// a repeated offset of the same length is cheaper
+			if n := matchLen(src, cand, i); n > length {
+				offset, length = i-cand, n
+			}
+			cand = int(chain[cand]) - 1
+		}
+		return offset, length
+	}
+
+	lit := 0
+	for i := 0; i+zMinMatch <= len(src); {
+		offset, length := findMatch(i)
+		if length < zMinMatch {
+			i++
+			continue
+		}
+		// a longer match at the next position is worth a literal
+		if i+1+zMinMatch <= len(src) {
+			if nextOffset, nextLength := findMatch(i + 1); nextLength > length+1 {
+				i, offset, length = i+1, nextOffset, nextLength
+			}
+		}
+
+		seqs = append(seqs, sequence{litLen: uint32(i - lit), matchLen: uint32(length), offsetValue: offsetValue(&rep, offset)})
+		literals = append(literals, src[lit:i]...)
+		i += length
+		lit = i
+		insert(i)
+	}
+	return seqs, append(literals, src[lit:]...)
+}
+
+func hashZstd(u uint32) uint32 {
+	return (u * 0x9e3779b1) >> (32 - zHashLog)
+}
+
+// matchLen returns the length of the match of src at i with the bytes at cand, which
+// may overlap it, up to maxCodeValue.
+func matchLen(src []byte, cand, i int) int {
+	if cand < 0 || cand >= i {
+		return 0
+	}
+	n := 0
+	for i+n < len(src) && src[cand+n] == src[i+n] && n < maxCodeValue {
+		n++
+	}
+	return n
+}
+
+// offsetValue returns the stored value of offset, and updates the repeated offsets.
+func offsetValue(rep *[zRepOffsets]int, offset int) uint32 {
+	for k, o := range rep {
+		if o == offset {
+			copy(rep[1:k+1], rep[:k])
+			rep[0] = offset
+			return uint32(k + 1)
+		}
+	}
+	copy(rep[1:], rep[:zRepOffsets-1])
+	rep[0] = offset
+	return uint32(offset + zRepOffsets)
+}
+
+// valueCode returns the code of v, and the extra bits it needs: values below 16 are
+// their own code, larger ones are 12 + the index of their highest bit, followed by the
+// bits below it.
+func valueCode(v uint32) (code byte, extra uint32, extraBits uint) {
+	if v < 16 {
+		return byte(v), 0, 0
+	}
+	extraBits = uint(bits.Len32(v) - 1)
+	return byte(12 + extraBits), v & (1<<extraBits - 1), extraBits
+}
+
+// appendStream appends syms with the smallest of the stream modes.
+func appendStream(dst, syms []byte) []byte {
+	var freq [256]int
+	for _, s := range syms {
+		freq[s]++
+	}
+	if len(syms) > 0 && freq[syms[0]] == len(syms) {
+		dst = append(dst, streamRLE)
+		dst = binary.AppendUvarint(dst, uint64(len(syms)))
+		return append(dst, syms[0])
+	}
+
+	raw := append([]byte{streamRaw}, binary.AppendUvarint(nil, uint64(len(syms)))...)
+	raw = append(raw, syms...)
+	if len(syms) == 0 {
+		return append(dst, raw...)
+	}
+	if huffman := encodeHuffman(syms, &freq); len(huffman) < len(raw) {
+		return append(dst, huffman...)
+	}
+	return append(dst, raw...)
+}
+
+// encodeHuffman returns the streamHuffman stream of syms, which has at least two
+// distinct symbols.
+func encodeHuffman(syms []byte, freq *[256]int) []byte {
+	lens := huffmanLengths(freq)
+	codes := canonicalCodes(&lens)
+	symbols := 256
+	for lens[symbols-1] == 0 {
+		symbols--
+	}
+
+	dst := []byte{streamHuffman}
+	dst = binary.AppendUvarint(dst, uint64(len(syms)))
+	dst = binary.AppendUvarint(dst, uint64(symbols))
+	for s := 0; s < symbols; s += 2 {
+		dst = append(dst, lens[s]|lens[s+1]<<4)
+	}
+	var w bitWriter
+	for _, s := range syms {
+		w.write(uint64(codes[s]), uint(lens[s]))
+	}
+	encoded := w.finish()
+	dst = binary.AppendUvarint(dst, uint64(len(encoded)))
+	return append(dst, encoded...)
+}
+
+// huffmanLengths returns the Huffman code lengths of the symbols of freq, at most
+// maxCodeLen: the frequencies are halved until the code fits.
+func huffmanLengths(freq *[256]int) [256]uint8 {
+	var syms []int
+	for s, f := range freq {
+		if f > 0 {
+			syms = append(syms, s)
+		}
+	}
+	weights := make([]int, len(syms))
+	for i, s := range syms {
+		weights[i] = freq[s]
+	}
+
+	for {
+		// 1. Merge the two lightest nodes until one is left. Leaves are sorted, and the
+		// merged nodes are created in order of weight, so both are queues.
+		order := make([]int, len(syms))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return weights[order[i]] < weights[order[j]] })
+
+		n := len(syms)
+		weight := make([]int, 2*n-1)
+		parent := make([]int, 2*n-1)
+		for i, leaf := range order {
+			weight[i] = weights[leaf]
+		}
+		leaf, merged := 0, n
+		lightest := func(next int) int {
+			if leaf < n && (merged >= next || weight[leaf] <= weight[merged]) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for next := n; next < 2*n-1; next++ {
+			a, b := lightest(next), lightest(next)
+			weight[next] = weight[a] + weight[b]
+			parent[a], parent[b] = next, next
+		}
+
+		// 2. A node is one deeper than its parent, created after it
+		depth := make([]uint8, 2*n-1)
+		maxDepth := uint8(0)
+		for i := 2*n - 3; i >= 0; i-- {
+			depth[i] = depth[parent[i]] + 1
+			if depth[i] > maxDepth {
+				maxDepth = depth[i]
+			}
+		}
+		if maxDepth <= maxCodeLen {
+			var lens [256]uint8
+			for i, leaf := range order {
+				lens[syms[leaf]] = depth[i]
+			}
+			return lens
+		}
+		for i := range weights {
+			weights[i] = (weights[i] + 1) / 2
+		}
+	}
+}
+
+// canonicalCodes returns the canonical Huffman codes of lens, bit reversed to be
+// written least significant bit first.
+func canonicalCodes(lens *[256]uint8) [256]uint16 {
+	var count [maxCodeLen + 1]int
+	for _, l := range lens {
+		count[l]++
+	}
+	count[0] = 0
+	var next [maxCodeLen + 1]int
+	code := 0
+	for l := 1; l <= maxCodeLen; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	var codes [256]uint16
+	for s, l := range lens {
+		if l > 0 {
+			codes[s] = bits.Reverse16(uint16(next[l])) >> (16 - l)
+			next[l]++
+		}
+	}
+	return codes
+}
+
+func decodeZstd(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+	seqCount, n := binary.Uvarint(src)
+	if n <= 0 || seqCount > size {
+		return nil, ErrCorrupt
+	}
+	src = src[n:]
+
+	// 1. Read the streams
+	var streams [4]stream
+	var err error
+	for i, limit := range []uint64{size, seqCount, seqCount, seqCount} {
+		if streams[i], src, err = readStream(src, limit); err != nil {
+			return nil, err
+		}
+	}
+	literals := streams[0]
+	for _, codes := range streams[1:] {
+		if uint64(codes.count) != seqCount {
+			return nil, ErrCorrupt
+		}
+	}
+	extraLen, n := binary.Uvarint(src)
+	if n <= 0 || extraLen != uint64(len(src)-n) {
+		return nil, ErrCorrupt
+	}
+	extra := bitReader{src: src[n:]}
+
+	// 2. Run the sequences
+	// the length is not trusted to allocate
+	prealloc := size
+	if limit := uint64(len(src)) * 64; prealloc > limit {
+		prealloc = limit
+	}
+	dst := make([]byte, 0, prealloc)
+	rep := initialRepOffsets
+	lit := 0
+	for i := 0; i < int(seqCount); i++ {
+		litLen, ok1 := extra.readValue(streams[1].at(i))
+		matchLen, ok2 := extra.readValue(streams[2].at(i))
+		value, ok3 := extra.readValue(streams[3].at(i))
+		if !ok1 || !ok2 || !ok3 || litLen > uint64(literals.count-lit) {
+			return nil, ErrCorrupt
+		}
+		dst = literals.appendTo(dst, lit, int(litLen))
+		lit += int(litLen)
+
+		var offset int
+		switch {
+		case value == 0:
+			return nil, ErrCorrupt
+		case value <= zRepOffsets:
+			offset = rep[value-1]
+			copy(rep[1:value], rep[:value-1])
+			rep[0] = offset
+		default:
+			offset = int(value - zRepOffsets)
+			copy(rep[1:], rep[:zRepOffsets-1])
+			rep[0] = offset
+		}
+		matchLen += zMinMatch
+		if offset > len(dst) || matchLen > size-uint64(len(dst)) {
+			return nil, ErrCorrupt
+		}
+		start := len(dst) - offset
+		if offset >= int(matchLen) {
+			dst = append(dst, dst[start:start+int(matchLen)]...)
+			continue
+		}
+		// byte by byte, the copy overlaps its own output
+		for j := 0; j < int(matchLen); j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+
+	dst = literals.appendTo(dst, lit, literals.count-lit)
+	if uint64(len(dst)) != size {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// stream holds the symbols of a decoded stream. Those of a streamRLE stream are not
+// expanded: its count is not trusted to allocate.
+type stream struct {
+	syms  []byte
+	rle   bool
+	count int
+}
+
+func (s stream) at(i int) byte {
+	if s.rle {
+		return s.syms[0]
+	}
+	return s.syms[i]
+}
+
+// appendTo appends the n symbols from the i-th to dst.
+func (s stream) appendTo(dst []byte, i, n int) []byte {
+	if !s.rle {
+		return append(dst, s.syms[i:i+n]...)
+	}
+	for ; n > 0; n-- {
+		dst = append(dst, s.syms[0])
+	}
+	return dst
+}
+
+// readStream reads a stream of at most limit symbols, and returns it with the rest of
+// src.
+func readStream(src []byte, limit uint64) (stream, []byte, error) {
+	if len(src) == 0 {
+		return stream{}, nil, ErrCorrupt
+	}
+	mode := src[0]
+	count, n := binary.Uvarint(src[1:])
+	if n <= 0 || count > limit || count > maxCodeValue {
+		return stream{}, nil, ErrCorrupt
+	}
+	src = src[1+n:]
+
+	switch mode {
+	case streamRaw:
+		if count > uint64(len(src)) {
+			return stream{}, nil, ErrCorrupt
+		}
+		return stream{syms: src[:count], count: int(count)}, src[count:], nil
+	case streamRLE:
+		if len(src) == 0 {
+			return stream{}, nil, ErrCorrupt
+		}
+		return stream{syms: src[:1], rle: true, count: int(count)}, src[1:], nil
+	case streamHuffman:
+		syms, rest, err := decodeHuffman(src, count)
+		return stream{syms: syms, count: len(syms)}, rest, err
+	default:
+		return stream{}, nil, ErrCorrupt
+	}
+}
+
+// decodeHuffman decodes count symbols of a streamHuffman stream, after its count.
+func decodeHuffman(src []byte, count uint64) ([]byte, []byte, error) {
+	// 1. Read the code lengths
+	symbols, n := binary.Uvarint(src)
+	if n <= 0 || symbols > 256 || uint64(len(src)-n) < (symbols+1)/2 {
+		return nil, nil, ErrCorrupt
+	}
+	src = src[n:]
+	var lens [256]uint8
+	for s := uint64(0); s < symbols; s++ {
+		lens[s] = src[s/2] >> (4 * (s % 2)) & 0x0f
+		if lens[s] > maxCodeLen {
+			return nil, nil, ErrCorrupt
+		}
+	}
+	src = src[(symbols+1)/2:]
+	encodedLen, n := binary.Uvarint(src)
+	if n <= 0 || encodedLen > uint64(len(src)-n) || count > encodedLen*8 {
+		return nil, nil, ErrCorrupt
+	}
+	encoded, rest := src[n:n+int(encodedLen)], src[n+int(encodedLen):]
+
+	// 2. Build the table of the symbol and code length of every maxCodeLen bits. An
+	// over-subscribed code is corrupt, the bits an incomplete one misses are left zero.
+	kraft := 0
+	for _, l := range lens {
+		if l > 0 {
+			kraft += 1 << (maxCodeLen - l)
+		}
+	}
+	if kraft > 1<<maxCodeLen {
+		return nil, nil, ErrCorrupt
+	}
+	codes := canonicalCodes(&lens)
+	var table [1 << maxCodeLen]uint16
+	for s, l := range lens {
+		if l == 0 {
+			continue
+		}
+		for i := int(codes[s]); i < len(table); i += 1 << l {
+			table[i] = uint16(s)<<4 | uint16(l)
+		}
+	}
+
+	// 3. Decode
+	r := bitReader{src: encoded}
+	syms := make([]byte, count)
+	for i := range syms {
+		e := table[r.peek(maxCodeLen)]
+		if e&0x0f == 0 || !r.skip(uint(e&0x0f)) {
+			return nil, nil, ErrCorrupt
+		}
+		syms[i] = byte(e >> 4)
+	}
+	return syms, rest, nil
+}
+
+// bitWriter appends bits least significant first.
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+// write appends the low nb bits of v, nb at most 32.
+func (w *bitWriter) write(v uint64, nb uint) {
+	w.acc |= v << w.n
+	w.n += nb
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// writeValue writes the extra bits of v, and returns its code.
+func (w *bitWriter) writeValue(v uint32) byte {
+	code, extra, nb := valueCode(v)
+	w.write(uint64(extra), nb)
+	return code
+}
+
+// finish returns the bits written, the last byte padded with zeros.
+func (w *bitWriter) finish() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+	}
+	return w.buf
+}
+
+// bitReader reads what bitWriter writes.
+type bitReader struct {
+	src []byte
+	acc uint64
+	n   uint
+}
+
+func (r *bitReader) fill() {
+	for r.n <= 56 && len(r.src) > 0 {
+		r.acc |= uint64(r.src[0]) << r.n
+		r.src = r.src[1:]
+		r.n += 8
+	}
+}
+
+// peek returns the next nb bits, zero past the end.
+func (r *bitReader) peek(nb uint) uint64 {
+	if r.n < nb {
+		r.fill()
+	}
+	return r.acc & (1<<nb - 1)
+}
+
+// skip consumes nb bits, and reports whether there were.
+func (r *bitReader) skip(nb uint) bool {
+	if r.n < nb {
+		r.fill()
+		if r.n < nb {
+			return false
+		}
+	}
+	r.acc >>= nb
+	r.n -= nb
+	return true
+}
+
+// readValue reads the extra bits of the value of code, and returns the value.
+func (r *bitReader) readValue(code byte) (uint64, bool) {
+	if code < 16 {
+		return uint64(code), true
+	}
+	nb := uint(code - 12)
+	if nb > 31 {
+		return 0, false
+	}
+	extra := r.peek(nb)
+	return 1<<nb | extra, r.skip(nb)
+}
@@ -0,0 +1,542 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriterReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), fileName(1))
+	f, err := os.Create(path)
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.BlockSize = 64
+	w := NewWriter(f, opts)
+	for i := 0; i < 1000; i++ {
+		var val []byte
+		if i%10 != 9 {
+			val = []byte(fmt.Sprintf("val-%d", i))
+		}
+		require.NoError(t, w.Add(entry.KeyWithTs([]byte(fmt.Sprintf("%05d", i)), 10), val))
+	}
+	meta, err := w.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.Equal(t, 1000, meta.Entries)
+
+	r, err := OpenReader(path, 1, DefaultOptions())
+	require.NoError(t, err)
+	defer r.Close()
+	assert.True(t, len(r.index) > 1)
+	assert.Equal(t, meta.Smallest, r.Meta().Smallest)
+	assert.Equal(t, meta.Largest, r.Meta().Largest)
+
+	it := r.NewIterator()
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, 1000, count)
+
+	it.Seek(entry.KeyWithTs([]byte("00500"), 20))
+	require.True(t, it.Valid())
+	assert.Equal(t, []byte("00500"), entry.ParseKey(it.Key()))
+	assert.Equal(t, []byte("val-500"), it.Value())
+
+	it.Seek(entry.KeyWithTs([]byte("00509"), 20))
+	require.True(t, it.Valid())
+	assert.Nil(t, it.Value())
+
+	it.Seek(entry.KeyWithTs([]byte("99999"), 20))
+	assert.False(t, it.Valid())
+}
+
+func TestBadMagic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), fileName(1))
+	require.NoError(t, os.WriteFile(path, make([]byte, 100), 0644))
+
+	_, err := OpenReader(path, 1, DefaultOptions())
+	assert.ErrorIs(t, err, ErrBadMagic)
+}
+
+func TestIO(t *testing.T) {
+	dir := t.TempDir()
+	io, err := OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{
+		{Key: "1", Val: []byte("a")},
+		{Key: "2", Val: []byte("b")},
+		{Key: "3", Val: []byte("c")},
+	}), nil, 0))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{
+		{Key: "2", Val: []byte("d")},
+		{Key: "3", Val: nil},
+	}), nil, 0))
+
+	rows := must(io.Scan("1", 3, time.Now(), entry.Bounds{}))
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, []byte("a"), rows[0].Val)
+	assert.Equal(t, []byte("d"), rows[1].Val)
+	assert.Equal(t, []byte("d"), must(io.Get("2", time.Now())))
+	assert.Nil(t, must(io.Get("3", time.Now())))
+	require.NoError(t, io.Close())
+
+	// files survive a restart
+	io, err = OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(io.readers))
+	assert.Equal(t, []byte("a"), must(io.Get("1", time.Now())))
+	assert.Equal(t, []byte("d"), must(io.Get("2", time.Now())))
+
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "4", Val: []byte("e")}}), nil, 0))
+	assert.Greater(t, io.readers[2].Meta().ID, io.readers[1].Meta().ID)
+
+	io.Destroy()
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestIOIterator(t *testing.T) {
+	io := NewDiskIO(DefaultOptions())
+	defer io.Destroy()
+
+	var first, second []entry.Pair[string, []byte]
+	for i := 0; i < 1000; i++ {
+		first = append(first, entry.Pair[string, []byte]{Key: fmt.Sprintf("%04d", i), Val: []byte("old")})
+		if i%2 == 0 {
+			second = append(second, entry.Pair[string, []byte]{Key: fmt.Sprintf("%04d", i), Val: nil})
+		}
+	}
+	require.NoError(t, io.Create(versions(first), nil, 0))
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, io.Create(versions(second), nil, 0))
+
+	// the newest version of every key, tombstones included, across pages
+	it := io.NewIterator(time.Now(), entry.Bounds{})
+	count, deleted := 0, 0
+	for it.Seek(""); it.Valid(); it.Next() {
+		count++
+		if it.Value() == nil {
+			deleted++
+		}
+	}
+	require.NoError(t, it.Close())
+	assert.Equal(t, 1000, count)
+	assert.Equal(t, 500, deleted)
+
+	// pinned to its snapshot
+	it = io.NewIterator(beforeDelete, entry.Bounds{})
+	it.Seek("0500")
+	require.True(t, it.Valid())
+	assert.Equal(t, []byte("0500"), entry.ParseKey(it.Key()))
+	assert.Equal(t, []byte("old"), it.Value())
+	require.NoError(t, it.Close())
+	assert.False(t, it.Valid())
+
+	// bounded scans
+	assert.Equal(t, 5, len(must(io.Scan("", 100, time.Now(), entry.Bounds{Prefix: "001"}))))
+	assert.Equal(t, 2, len(must(io.Scan("", 100, time.Now(), entry.Bounds{EndKey: "0005"}))))
+	assert.Equal(t, 1, len(must(io.Scan("0013", 100, time.Now(), entry.Bounds{EndKey: "0015", Prefix: "001"}))))
+}
+
+func TestIOReverse(t *testing.T) {
+	io := NewDiskIO(DefaultOptions())
+	defer io.Destroy()
+
+	var first, second []entry.Pair[string, []byte]
+	for i := 0; i < 1000; i++ {
+		first = append(first, entry.Pair[string, []byte]{Key: fmt.Sprintf("%04d", i), Val: []byte("old")})
+		if i%2 == 0 {
+			second = append(second, entry.Pair[string, []byte]{Key: fmt.Sprintf("%04d", i), Val: nil})
+		}
+	}
+	require.NoError(t, io.Create(versions(first), nil, 0))
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, io.Create(versions(second), nil, 0))
+
+	// the newest version of every key, in descending order, across blocks and pages
+	it := io.NewIterator(time.Now(), entry.Bounds{Reverse: true})
+	count, deleted := 0, 0
+	var lastKey []byte
+	for it.Seek(""); it.Valid(); it.Next() {
+		if lastKey != nil {
+			require.Equal(t, 1, bytes.Compare(lastKey, entry.ParseKey(it.Key())))
+		}
+		lastKey = append(lastKey[:0], entry.ParseKey(it.Key())...)
+		count++
+		if it.Value() == nil {
+			deleted++
+		}
+	}
+	require.NoError(t, it.Close())
+	assert.Equal(t, 1000, count)
+	assert.Equal(t, 500, deleted)
+
+	// pinned to its snapshot
+	rows := must(io.Scan("0500", 2, beforeDelete, entry.Bounds{Reverse: true}))
+	assert.Equal(t, []entry.Pair[string, []byte]{{Key: "0500", Val: []byte("old")}, {Key: "0499", Val: []byte("old")}}, rows)
+
+	rows = must(io.Scan("", 3, time.Now(), entry.Bounds{Reverse: true}))
+	assert.Equal(t, []string{"0999", "0997", "0995"}, []string{rows[0].Key, rows[1].Key, rows[2].Key})
+	rows = must(io.Scan("0500", 2, time.Now(), entry.Bounds{Reverse: true}))
+	assert.Equal(t, []string{"0499", "0497"}, []string{rows[0].Key, rows[1].Key})
+
+	// bounded reverse scans
+	rows = must(io.Scan("", 100, time.Now(), entry.Bounds{Prefix: "001", Reverse: true}))
+	assert.Equal(t, 5, len(rows))
+	assert.Equal(t, "0019", rows[0].Key)
+	rows = must(io.Scan("", 100, time.Now(), entry.Bounds{EndKey: "0005", Reverse: true}))
+	assert.Equal(t, []string{"0003", "0001"}, []string{rows[0].Key, rows[1].Key})
+}
+
+func TestEphemeralIO(t *testing.T) {
+	io := NewDiskIO(DefaultOptions())
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "1", Val: []byte("a")}}), nil, 0))
+	assert.Equal(t, []byte("a"), must(io.Get("1", time.Now())))
+
+	require.NoError(t, io.Close())
+	_, err := os.Stat(io.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBloomFilter(t *testing.T) {
+	io, err := OpenDiskIO(t.TempDir(), DefaultOptions())
+	require.NoError(t, err)
+	defer io.Close()
+
+	var records []entry.Pair[string, []byte]
+	for i := 0; i < 1000; i++ {
+		records = append(records, entry.Pair[string, []byte]{Key: fmt.Sprintf("%05d", i), Val: []byte("val")})
+	}
+	require.NoError(t, io.Create(versions(records), nil, 0))
+	r := io.readers[0]
+
+	for _, record := range records {
+		assert.True(t, r.MayContain([]byte(record.Key)))
+	}
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if r.MayContain([]byte(fmt.Sprintf("%05d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+	assert.Equal(t, []byte{}, must(io.Get("99999", time.Now())))
+
+	// disabled filter matches every key
+	opts := DefaultOptions()
+	opts.BloomBitsPerKey = 0
+	noFilter := NewDiskIO(opts)
+	defer noFilter.Close()
+	require.NoError(t, noFilter.Create(versions(records), nil, 0))
+	assert.True(t, noFilter.readers[0].MayContain([]byte("99999")))
+	assert.Equal(t, []byte("val"), must(noFilter.Get("00010", time.Now())))
+}
+
+func TestBlockCache(t *testing.T) {
+	for _, pin := range []bool{true, false} {
+		opts := DefaultOptions()
+		opts.BlockCache = cache.New(1 << 20)
+		opts.PinIndexAndFilter = pin
+		io := NewDiskIO(opts)
+
+		var records []entry.Pair[string, []byte]
+		for i := 0; i < 1000; i++ {
+			records = append(records, entry.Pair[string, []byte]{Key: fmt.Sprintf("%05d", i), Val: []byte("val")})
+		}
+		require.NoError(t, io.Create(versions(records), nil, 0))
+
+		assert.Equal(t, []byte("val"), must(io.Get("00500", time.Now())))
+		before := io.BlockCacheStats()
+		assert.Equal(t, []byte("val"), must(io.Get("00500", time.Now())))
+		after := io.BlockCacheStats()
+		assert.Equal(t, before.Misses, after.Misses)
+		assert.Greater(t, after.Hits, before.Hits)
+		if pin {
+			// only the data block is cached
+			assert.Equal(t, 1, after.Entries)
+		} else {
+			// data, index and filter blocks
+			assert.Equal(t, 3, after.Entries)
+		}
+		require.NoError(t, io.Close())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, codec := range []compress.Codec{compress.None, compress.LZ, compress.Flate, compress.Zstd} {
+		opts := DefaultOptions()
+		opts.Compression = codec
+		io := NewDiskIO(opts)
+
+		var records []entry.Pair[string, []byte]
+		for i := 0; i < 1000; i++ {
+			val := fmt.Sprintf(`{"id":%d,"name":"user-%d","active":true}`, i, i%10)
+			records = append(records, entry.Pair[string, []byte]{Key: fmt.Sprintf("%05d", i), Val: []byte(val)})
+		}
+		require.NoError(t, io.Create(versions(records), nil, 0))
+
+		rows := must(io.Scan("", 2000, time.Now(), entry.Bounds{}))
+		require.Equal(t, len(records), len(rows), codec.String())
+		for i, row := range rows {
+			assert.Equal(t, records[i].Val, row.Val)
+		}
+		assert.Equal(t, records[10].Val, must(io.Get("00010", time.Now())))
+
+		stats := io.CompressionStats()
+		if codec == compress.None {
+			assert.Less(t, stats.Ratio(), 1.0)
+		} else {
+			assert.Greater(t, stats.Ratio(), 2.0, codec.String())
+		}
+		require.NoError(t, io.Close())
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	io, err := OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+	var records []entry.Pair[string, []byte]
+	for i := 0; i < 1000; i++ {
+		records = append(records, entry.Pair[string, []byte]{Key: fmt.Sprintf("%05d", i), Val: []byte(fmt.Sprintf("val-%d", i))})
+	}
+	require.NoError(t, io.Create(versions(records), nil, 0))
+	r := io.readers[0]
+	path, ft := r.path, r.footer
+	require.Greater(t, len(r.index), 1)
+	require.NoError(t, VerifyChecksums(path))
+	require.NoError(t, io.Close())
+
+	// 1. Damage the last data block
+	buf, err := os.ReadFile(path)
+	require.NoError(t, err)
+	buf[ft.filter.offset-blockTrailerSize-1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+
+	err = VerifyChecksums(path)
+	assert.ErrorIs(t, err, ErrCorruption)
+	var corruption *CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	assert.Equal(t, path, corruption.Path)
+	assert.Less(t, corruption.Offset, ft.filter.offset)
+
+	// reads of the damaged block fail, the others succeed
+	io, err = OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("val-0"), must(io.Get("00000", time.Now())))
+	_, err = io.Get("00999", time.Now())
+	assert.ErrorIs(t, err, ErrCorruption)
+	_, err = io.Scan("", 2000, time.Now(), entry.Bounds{})
+	assert.ErrorIs(t, err, ErrCorruption)
+	assert.ErrorIs(t, io.VerifyChecksums(), ErrCorruption)
+	require.NoError(t, io.Close())
+
+	// 2. Damage the footer
+	buf[len(buf)-footerSize] ^= 0xff
+	require.NoError(t, os.WriteFile(path, buf, 0644))
+	_, err = OpenReader(path, 1, DefaultOptions())
+	assert.ErrorIs(t, err, ErrCorruption)
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	io, err := OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+	defer io.Close()
+
+	for i := 0; i < 4; i++ {
+		records := []entry.Pair[string, []byte]{
+			{Key: "1", Val: []byte(fmt.Sprintf("a%d", i))},
+			{Key: fmt.Sprintf("k%d", i), Val: []byte("b")},
+		}
+		if i == 3 {
+			records = append(records, entry.Pair[string, []byte]{Key: "k0", Val: nil})
+		}
+		require.NoError(t, io.Create(versions(records), nil, 0))
+		time.Sleep(time.Millisecond)
+	}
+
+	// an in-flight read keeps the inputs open
+	inFlight := io.refReaders()
+	compacted, err := io.Compact(time.Now())
+	require.NoError(t, err)
+	assert.True(t, compacted)
+	require.Equal(t, 1, len(io.readers))
+	assert.Equal(t, 1, io.readers[0].Meta().Level)
+	// a3, k1, k2, k3: shadowed versions and the bottom tombstone are dropped
+	assert.Equal(t, 4, io.readers[0].Meta().Entries)
+
+	it := inFlight[0].NewIterator()
+	it.SeekToFirst()
+	assert.True(t, it.Valid())
+	unrefReaders(inFlight)
+	files, err := filepath.Glob(filepath.Join(dir, "*"+sstExt))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	assert.Equal(t, []byte("a3"), must(io.Get("1", time.Now())))
+	assert.Equal(t, []byte{}, must(io.Get("k0", time.Now())))
+	assert.Equal(t, 4, len(must(io.Scan("", 10, time.Now(), entry.Bounds{}))))
+
+	compacted, err = io.Compact(time.Now())
+	require.NoError(t, err)
+	assert.False(t, compacted)
+}
+
+func TestRangeTombstone(t *testing.T) {
+	dir := t.TempDir()
+	io, err := OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	var records []entry.Pair[string, []byte]
+	for i := 0; i < 6; i++ {
+		records = append(records, entry.Pair[string, []byte]{Key: fmt.Sprint(i), Val: []byte("a")})
+	}
+	require.NoError(t, io.Create(versions(records), nil, 0))
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// a file of a range tombstone only
+	tombstone := entry.RangeTombstone{Start: "1", End: "4", Ts: timestamp.Now()}
+	require.NoError(t, io.Create(nil, []entry.RangeTombstone{tombstone}, 0))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "2", Val: []byte("b")}}), nil, 0))
+
+	check := func() {
+		assert.Equal(t, []byte(nil), must(io.Get("1", time.Now())))
+		assert.Equal(t, []byte("b"), must(io.Get("2", time.Now())))
+		assert.Equal(t, []byte("a"), must(io.Get("1", beforeDelete)))
+		rows := must(io.Scan("", 10, time.Now(), entry.Bounds{}))
+		assert.Equal(t, []string{"0", "2", "4", "5"}, []string{rows[0].Key, rows[1].Key, rows[2].Key, rows[3].Key})
+		assert.Equal(t, 4, len(must(io.Scan("", 10, time.Now(), entry.Bounds{Reverse: true}))))
+		assert.Equal(t, 6, len(must(io.Scan("", 10, beforeDelete, entry.Bounds{}))))
+	}
+	check()
+	assert.Equal(t, []entry.RangeTombstone{tombstone}, io.RangeTombstones(time.Now()))
+	assert.Equal(t, 0, len(io.RangeTombstones(beforeDelete)))
+
+	// survives a reopen
+	require.NoError(t, io.Close())
+	io, err = OpenDiskIO(dir, DefaultOptions())
+	require.NoError(t, err)
+	defer io.Close()
+	check()
+
+	// the covered versions and, at the bottom, the tombstone are dropped
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "9", Val: []byte("c")}}), nil, 0))
+	compacted, err := io.Compact(time.Now())
+	require.NoError(t, err)
+	assert.True(t, compacted)
+	require.Equal(t, 1, len(io.readers))
+	// 0, 2, 4, 5, 9
+	assert.Equal(t, 5, io.readers[0].Meta().Entries)
+	assert.Equal(t, 0, len(io.RangeTombstones(time.Now())))
+	assert.Equal(t, []byte{}, must(io.Get("1", time.Now())))
+	assert.Equal(t, []byte("b"), must(io.Get("2", time.Now())))
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Compaction = nil
+	io, err := OpenDiskIO(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "1", Val: []byte("a")}}), nil, 10))
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "2", Val: []byte("b")}}), nil, 20))
+	first, second := io.readers[0].Meta(), io.readers[1].Meta()
+	assert.Equal(t, uint64(11), second.SmallestSeq)
+	assert.Equal(t, uint64(20), second.LargestSeq)
+
+	// 1. A compaction that crashed before its edit was logged
+	_, err = io.newFileWriter(1)
+	require.NoError(t, err)
+	orphan, err := io.newFileWriter(1)
+	require.NoError(t, err)
+	require.NoError(t, orphan.Add(entry.KeyWithTs([]byte("3"), 1), []byte("c")))
+	require.NoError(t, orphan.Finish())
+
+	// 2. A torn edit at the tail of the MANIFEST
+	_, err = io.vs.manifest.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, io.Close())
+
+	io, err = OpenDiskIO(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(io.readers))
+	assert.Equal(t, uint64(20), io.FlushedSeq())
+	assert.Equal(t, first.ID, io.readers[0].Meta().ID)
+	assert.Equal(t, second.LargestSeq, io.readers[1].Meta().LargestSeq)
+	assert.Equal(t, []byte{}, must(io.Get("3", time.Now())))
+	_, err = os.Stat(orphan.path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(orphan.tmpPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// new files never reuse an ID
+	require.NoError(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "4", Val: []byte("d")}}), nil, 0))
+	assert.Greater(t, io.readers[2].Meta().ID, orphan.id)
+	require.NoError(t, io.Close())
+
+	// 3. A recorded file is missing
+	require.NoError(t, os.Remove(filepath.Join(dir, fileName(first.ID))))
+	_, err = OpenDiskIO(dir, opts)
+	assert.ErrorIs(t, err, ErrCorruptManifest)
+}
+
+func TestVersionEdit(t *testing.T) {
+	edit := VersionEdit{
+		AddFiles: []FileMeta{{
+			ID: 7, Level: 2, Size: 100, Entries: 3, SmallestSeq: 1, LargestSeq: 5,
+			Smallest: entry.KeyWithTs([]byte("a"), 1), Largest: entry.KeyWithTs([]byte("z"), 1),
+		}},
+		DeleteFiles: []uint64{3, 4},
+		FlushedSeq:  5,
+		NextFileID:  8,
+	}
+	decoded, err := decodeVersionEdit(edit.encode(nil))
+	require.NoError(t, err)
+	assert.Equal(t, edit, decoded)
+
+	_, err = decodeVersionEdit([]byte{tagAddFile, 7})
+	assert.ErrorIs(t, err, ErrCorruptManifest)
+}
+
+// versions stamps records with the current time, as a flush of fresh writes would.
+func versions(records []entry.Pair[string, []byte]) []entry.Pair[[]byte, []byte] {
+	ts := timestamp.Now()
+	res := make([]entry.Pair[[]byte, []byte], len(records))
+	for i, record := range records {
+		res[i] = entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(record.Key), ts), Val: record.Val}
+	}
+	return res
+}
+
+// must unwraps the result of a read that is expected to succeed.
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
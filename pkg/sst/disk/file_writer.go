@@ -0,0 +1,80 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// fileWriter writes a new file of the IO under a temp name, and publishes it on Finish.
+type fileWriter struct {
+	*Writer
+	io      *IO
+	id      uint64
+	level   int
+	f       *os.File
+	path    string
+	tmpPath string
+
+	// r is the reader of the published file.
+	r *Reader
+}
+
+func (io *IO) newFileWriter(level int) (*fileWriter, error) {
+	id := io.vs.newFileID()
+	path := filepath.Join(io.dir, fileName(id))
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{
+		Writer:  NewWriter(f, io.opts),
+		io:      io,
+		id:      id,
+		level:   level,
+		f:       f,
+		path:    path,
+		tmpPath: tmpPath,
+	}, nil
+}
+
+// Finish writes and fsyncs the file, then renames it to its final name.
+func (w *fileWriter) Finish() error {
+	// 1. Write the file under a temp name
+	meta, err := w.Writer.Finish()
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	// 2. Publish the file
+	if err = os.Rename(w.tmpPath, w.path); err != nil {
+		w.abort()
+		return err
+	}
+	if err = syncDir(w.io.dir); err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	r, err := newReader(w.f, w.path, w.id, w.io.opts)
+	if err != nil {
+		_ = w.f.Close()
+		return err
+	}
+	r.meta.Level = w.level
+	r.meta.Entries = meta.Entries
+	w.r = r
+	return nil
+}
+
+// abort drops the file, published or not.
+func (w *fileWriter) abort() {
+	if w.r != nil {
+		w.r.obsolete.Store(true)
+		_ = w.r.unref()
+		return
+	}
+	_ = w.f.Close()
+	_ = os.Remove(w.tmpPath)
+	_ = os.Remove(w.path)
+}
@@ -0,0 +1,262 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"hash/crc32"
+)
+
+// File layout:
+//
+//	| data block 0 | ... | data block n | filter block | index block | range del block | footer |
+//
+// Every block is followed by a trailer: | codec(1) | crc32c(4) |, codec being the
+// compress.Codec of the block and the checksum covering the stored block and codec.
+// Block handles do not count the trailer.
+//
+// Data block entry: | kind(1) | keyLen(uvarint) | valLen(uvarint) | key | val |
+// The key is the internal key built by entry.KeyWithTs.
+//
+// Index block entry: | lastKeyLen(uvarint) | lastKey | offset(uvarint) | size(uvarint) |
+// one per data block, lastKey being the largest key of the block.
+//
+// Filter block: bloom.Filter over the user keys of the file, empty if disabled.
+//
+// Range del block entry: | startLen(uvarint) | start | endLen(uvarint) | end | ts(8) |
+// one per range tombstone of the file.
+//
+// Footer: | filter offset(8) | filter size(8) | index offset(8) | index size(8) |
+// range del offset(8) | range del size(8) | raw data size(8) | version(4) | magic(8) |
+// crc32c(4) |, raw data size being the size of the data blocks before compression and
+// the checksum covering the rest of the footer.
+const (
+	magic            uint64 = 0x636f6d65746b7673 // "cometkvs"
+	formatVersion    uint32 = 5
+	footerSize              = 72
+	blockTrailerSize        = 5
+)
+
+const (
+	kindValue     byte = 0
+	kindTombstone byte = 1
+)
+
+var (
+	ErrBadMagic = errors.New("disk: not an sst file")
+	// ErrCorruption matches every *CorruptionError with errors.Is.
+	ErrCorruption = errors.New("disk: corruption")
+
+	errCorruptBlock     = errors.New("corrupt block")
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errKeyOrder         = errors.New("keys out of order")
+)
+
+// CorruptionError reports a block or footer of an SST file that failed its checksum or
+// could not be decoded.
+type CorruptionError struct {
+	Path   string
+	Offset uint64 // of the block or footer
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("disk: corruption in %s at offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+func (e *CorruptionError) Is(target error) bool { return target == ErrCorruption }
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type footer struct {
+	filter      blockHandle
+	index       blockHandle
+	rangeDel    blockHandle
+	rawDataSize uint64
+	version     uint32
+}
+
+func (f *footer) encode() []byte {
+	buf := make([]byte, 0, footerSize)
+	buf = binary.BigEndian.AppendUint64(buf, f.filter.offset)
+	buf = binary.BigEndian.AppendUint64(buf, f.filter.size)
+	buf = binary.BigEndian.AppendUint64(buf, f.index.offset)
+	buf = binary.BigEndian.AppendUint64(buf, f.index.size)
+	buf = binary.BigEndian.AppendUint64(buf, f.rangeDel.offset)
+	buf = binary.BigEndian.AppendUint64(buf, f.rangeDel.size)
+	buf = binary.BigEndian.AppendUint64(buf, f.rawDataSize)
+	buf = binary.BigEndian.AppendUint32(buf, f.version)
+	buf = binary.BigEndian.AppendUint64(buf, magic)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	return buf
+}
+
+func decodeFooter(buf []byte) (footer, error) {
+	if len(buf) != footerSize || binary.BigEndian.Uint64(buf[60:]) != magic {
+		return footer{}, ErrBadMagic
+	}
+	if crc32.Checksum(buf[:68], crcTable) != binary.BigEndian.Uint32(buf[68:]) {
+		return footer{}, errChecksumMismatch
+	}
+	f := footer{
+		filter: blockHandle{
+			offset: binary.BigEndian.Uint64(buf[0:]),
+			size:   binary.BigEndian.Uint64(buf[8:]),
+		},
+		index: blockHandle{
+			offset: binary.BigEndian.Uint64(buf[16:]),
+			size:   binary.BigEndian.Uint64(buf[24:]),
+		},
+		rangeDel: blockHandle{
+			offset: binary.BigEndian.Uint64(buf[32:]),
+			size:   binary.BigEndian.Uint64(buf[40:]),
+		},
+		rawDataSize: binary.BigEndian.Uint64(buf[48:]),
+		version:     binary.BigEndian.Uint32(buf[56:]),
+	}
+	if f.version != formatVersion {
+		return footer{}, fmt.Errorf("disk: unsupported sst version %d", f.version)
+	}
+	return f, nil
+}
+
+func blockTrailer(block []byte, codec compress.Codec) []byte {
+	trailer := make([]byte, blockTrailerSize)
+	trailer[0] = byte(codec)
+	crc := crc32.Update(crc32.Checksum(block, crcTable), crcTable, trailer[:1])
+	binary.BigEndian.PutUint32(trailer[1:], crc)
+	return trailer
+}
+
+// verifyBlock checks the trailer of block and returns its codec.
+func verifyBlock(block, trailer []byte) (compress.Codec, error) {
+	crc := crc32.Update(crc32.Checksum(block, crcTable), crcTable, trailer[:1])
+	if crc != binary.BigEndian.Uint32(trailer[1:]) {
+		return 0, errChecksumMismatch
+	}
+	return compress.Codec(trailer[0]), nil
+}
+
+func appendEntry(buf []byte, key, val []byte) []byte {
+	kind := kindValue
+	if val == nil {
+		kind = kindTombstone
+	}
+	buf = append(buf, kind)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = binary.AppendUvarint(buf, uint64(len(val)))
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+	return buf
+}
+
+// decodeEntry returns the entry at the start of buf and its encoded length. A nil val
+// is a tombstone.
+func decodeEntry(buf []byte) (key, val []byte, n int, err error) {
+	if len(buf) < 1 {
+		return nil, nil, 0, errCorruptBlock
+	}
+	kind := buf[0]
+	n = 1
+
+	keyLen, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return nil, nil, 0, errCorruptBlock
+	}
+	n += m
+	valLen, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return nil, nil, 0, errCorruptBlock
+	}
+	n += m
+	if uint64(len(buf)-n) < keyLen+valLen {
+		return nil, nil, 0, errCorruptBlock
+	}
+
+	key = buf[n : n+int(keyLen)]
+	n += int(keyLen)
+	if kind == kindValue {
+		val = buf[n : n+int(valLen) : n+int(valLen)]
+	}
+	n += int(valLen)
+	return key, val, n, nil
+}
+
+func appendIndexEntry(buf []byte, lastKey []byte, h blockHandle) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(lastKey)))
+	buf = append(buf, lastKey...)
+	buf = binary.AppendUvarint(buf, h.offset)
+	buf = binary.AppendUvarint(buf, h.size)
+	return buf
+}
+
+type indexEntry struct {
+	lastKey []byte
+	handle  blockHandle
+}
+
+func decodeIndex(buf []byte) ([]indexEntry, error) {
+	var index []indexEntry
+	for len(buf) > 0 {
+		keyLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < keyLen {
+			return nil, errCorruptBlock
+		}
+		buf = buf[n:]
+		lastKey := buf[:keyLen]
+		buf = buf[keyLen:]
+
+		offset, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
+		buf = buf[n:]
+		size, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errCorruptBlock
+		}
+		buf = buf[n:]
+
+		index = append(index, indexEntry{lastKey: lastKey, handle: blockHandle{offset: offset, size: size}})
+	}
+	return index, nil
+}
+
+func appendRangeTombstone(buf []byte, t entry.RangeTombstone) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(t.Start)))
+	buf = append(buf, t.Start...)
+	buf = binary.AppendUvarint(buf, uint64(len(t.End)))
+	buf = append(buf, t.End...)
+	buf = binary.BigEndian.AppendUint64(buf, t.Ts)
+	return buf
+}
+
+func decodeRangeTombstones(buf []byte) ([]entry.RangeTombstone, error) {
+	var tombstones []entry.RangeTombstone
+	for len(buf) > 0 {
+		var t entry.RangeTombstone
+		for _, field := range []*string{&t.Start, &t.End} {
+			keyLen, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < keyLen {
+				return nil, errCorruptBlock
+			}
+			*field = string(buf[n : n+int(keyLen)])
+			buf = buf[n+int(keyLen):]
+		}
+		if len(buf) < 8 {
+			return nil, errCorruptBlock
+		}
+		t.Ts = binary.BigEndian.Uint64(buf)
+		buf = buf[8:]
+
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, nil
+}
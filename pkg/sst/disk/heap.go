@@ -0,0 +1,46 @@
+package disk
+
+import "github.com/dborchard/cometkv/pkg/y/entry"
+
+type MinHeap []*Iterator
+
+func (m *MinHeap) Len() int { return len(*m) }
+func (m *MinHeap) Less(i, j int) bool {
+	return entry.CompareKeys((*m)[i].Key(), (*m)[j].Key()) < 0
+}
+func (m *MinHeap) Swap(i, j int) { (*m)[i], (*m)[j] = (*m)[j], (*m)[i] }
+
+func (m *MinHeap) Push(x interface{}) {
+	*m = append(*m, x.(*Iterator))
+}
+
+func (m *MinHeap) Pop() interface{} {
+	old := *m
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*m = old[0 : n-1]
+	return x
+}
+
+// MaxHeap orders iterators walking backwards, largest key first.
+type MaxHeap []*Iterator
+
+func (m *MaxHeap) Len() int { return len(*m) }
+func (m *MaxHeap) Less(i, j int) bool {
+	return entry.CompareKeys((*m)[i].Key(), (*m)[j].Key()) > 0
+}
+func (m *MaxHeap) Swap(i, j int) { (*m)[i], (*m)[j] = (*m)[j], (*m)[i] }
+
+func (m *MaxHeap) Push(x interface{}) {
+	*m = append(*m, x.(*Iterator))
+}
+
+func (m *MaxHeap) Pop() interface{} {
+	old := *m
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*m = old[0 : n-1]
+	return x
+}
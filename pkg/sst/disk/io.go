@@ -0,0 +1,727 @@
+package disk
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compaction"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sstExt = ".sst"
+
+type Options struct {
+	BlockSize int
+	// BloomBitsPerKey sizes the per-file bloom filter. Zero disables it.
+	BloomBitsPerKey int
+	// Compaction picks the files merged by Compact. Nil disables compaction.
+	Compaction compaction.Policy
+	// BlockCache is shared by the readers of every file. Nil disables it.
+	BlockCache *cache.Cache
+	// PinIndexAndFilter keeps the index and filter blocks of every file in memory
+	// instead of in the block cache.
+	PinIndexAndFilter bool
+	// Compression is the codec of the blocks of new files: compress.None, compress.LZ,
+	// compress.Zstd or compress.Flate.
+	Compression compress.Codec
+}
+
+const DefaultBlockCacheSize = 8 << 20 // 8MB
+
+func DefaultOptions() Options {
+	return Options{
+		BlockSize:         4 << 10, // 4KB
+		BloomBitsPerKey:   10,      // ~1% false positives
+		Compaction:        compaction.DefaultLeveledPolicy(),
+		BlockCache:        cache.New(DefaultBlockCacheSize),
+		PinIndexAndFilter: true,
+		Compression:       compress.LZ,
+	}
+}
+
+// IO stores every flush as an immutable SST file under dir. The set of files is
+// recorded in the MANIFEST, which every flush and compaction edits atomically.
+type IO struct {
+	sync.Mutex
+	dir     string
+	opts    Options
+	readers []*Reader
+	vs      *versionSet
+
+	// compactMu serializes compactions.
+	compactMu sync.Mutex
+
+	// ephemeral IOs live in a temp dir that is removed on Close.
+	ephemeral bool
+}
+
+// NewDiskIO returns an IO backed by a new temp dir, removed on Close.
+func NewDiskIO(opts Options) *IO {
+	dir, err := os.MkdirTemp("", "cometkv-sst-")
+	if err != nil {
+		panic(err)
+	}
+	io, err := OpenDiskIO(dir, opts)
+	if err != nil {
+		panic(err)
+	}
+	io.ephemeral = true
+	return io
+}
+
+// OpenDiskIO opens the SST files recorded in the MANIFEST of dir, creating dir if
+// needed. Files left behind by an unfinished flush or compaction are deleted.
+func OpenDiskIO(dir string, opts Options) (*IO, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// 1. Replay the MANIFEST
+	vs, found, err := openVersionSet(dir)
+	if err != nil {
+		return nil, err
+	}
+	io := &IO{dir: dir, opts: opts, vs: vs}
+
+	// 2. Open the recorded files, delete the others
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range dirEntries {
+		name := de.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// unfinished file of a crash
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, sstExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, sstExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if id >= vs.nextFileID {
+			vs.nextFileID = id + 1
+		}
+		meta, recorded := vs.files[id]
+		if found && !recorded {
+			// output of a flush or compaction whose edit was never logged
+			_ = os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		r, err := OpenReader(filepath.Join(dir, name), id, opts)
+		if err != nil {
+			_ = io.Close()
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if recorded {
+			r.meta.Level, r.meta.Entries = meta.Level, meta.Entries
+			r.meta.SmallestSeq, r.meta.LargestSeq = meta.SmallestSeq, meta.LargestSeq
+		} else {
+			// dir predates the MANIFEST, adopt the file in level 0
+			vs.files[id] = r.meta
+		}
+		io.readers = append(io.readers, r)
+	}
+	if len(io.readers) != len(vs.files) {
+		_ = io.Close()
+		return nil, fmt.Errorf("%d sst files of the manifest are missing: %w",
+			len(vs.files)-len(io.readers), ErrCorruptManifest)
+	}
+
+	// 3. Start a new MANIFEST holding the current set
+	if err = vs.rotate(); err != nil {
+		_ = io.Close()
+		return nil, err
+	}
+
+	sort.Slice(io.readers, func(i, j int) bool {
+		return io.readers[i].meta.ID < io.readers[j].meta.ID
+	})
+	return io, nil
+}
+
+// Get seeks only the files whose bloom filter may contain key, and returns the newest
+// version at or below snapshotTs: nil if it is a tombstone or is covered by a range
+// tombstone, empty if there is none. A damaged file fails the read with a
+// *CorruptionError.
+func (io *IO) Get(key string, snapshotTs time.Time) ([]byte, error) {
+	userKey := []byte(key)
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	seekKey := entry.KeyWithTs(userKey, snapshotTsNano)
+
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+
+	var res []byte
+	var resTs uint64
+	found := false
+	for _, r := range readers {
+		if !r.MayContain(userKey) {
+			continue
+		}
+
+		iter := r.NewIterator()
+		iter.Seek(seekKey)
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		if !iter.Valid() || !bytes.Equal(entry.ParseKey(iter.Key()), userKey) {
+			continue
+		}
+		if itemTs := entry.ParseTs(iter.Key()); !found || itemTs > resTs {
+			res, resTs, found = iter.Value(), itemTs, true
+		}
+	}
+
+	if !found {
+		return []byte{}, nil
+	}
+	if _, covered := entry.CoveringTs(rangeTombstones(readers, snapshotTsNano), userKey, resTs, snapshotTsNano); res == nil || covered {
+		// deleted
+		return nil, nil
+	}
+	return append([]byte{}, res...), nil
+}
+
+func (io *IO) Scan(startKey string, count int, snapshotTs time.Time, bounds entry.Bounds) ([]entry.Pair[string, []byte], error) {
+	var res []entry.Pair[string, []byte]
+	err := io.visible(startKey, snapshotTs, bounds, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		if val != nil {
+			res = append(res, entry.Pair[string, []byte]{Key: string(entry.ParseKey(key)), Val: append([]byte{}, val...)})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ScanVersions is Scan returning tombstones too, with internal keys so that the version
+// of every row is known.
+func (io *IO) ScanVersions(startKey string, count int, snapshotTs time.Time, bounds entry.Bounds) ([]entry.Pair[[]byte, []byte], error) {
+	var res []entry.Pair[[]byte, []byte]
+	err := io.visible(startKey, snapshotTs, bounds, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		pair := entry.Pair[[]byte, []byte]{Key: append([]byte{}, key...)}
+		if val != nil {
+			pair.Val = append([]byte{}, val...)
+		}
+		res = append(res, pair)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewIterator iterates over what ScanVersions returns, at snapshotTs, a page at a time.
+func (io *IO) NewIterator(snapshotTs time.Time, bounds entry.Bounds) iterator.Iterator {
+	scan := func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error) {
+		return io.ScanVersions(startKey, count, snapshotTs, bounds)
+	}
+	if bounds.Reverse {
+		return iterator.NewReversePaged(iterator.DefaultPageSize, scan)
+	}
+	return iterator.NewPaged(iterator.DefaultPageSize, scan)
+}
+
+// History returns every version of key at or below snapshotTs kept by the files,
+// newest first. Range tombstones are not applied.
+func (io *IO) History(key string, snapshotTs time.Time) ([]entry.Pair[[]byte, []byte], error) {
+	userKey := []byte(key)
+	seekKey := entry.KeyWithTs(userKey, timestamp.ToUnit64(snapshotTs))
+
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+
+	var res []entry.Pair[[]byte, []byte]
+	for _, r := range readers {
+		if !r.MayContain(userKey) {
+			continue
+		}
+
+		iter := r.NewIterator()
+		for iter.Seek(seekKey); iter.Valid() && bytes.Equal(entry.ParseKey(iter.Key()), userKey); iter.Next() {
+			pair := entry.Pair[[]byte, []byte]{Key: append([]byte{}, iter.Key()...)}
+			if val := iter.Value(); val != nil {
+				pair.Val = append([]byte{}, val...)
+			}
+			res = append(res, pair)
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return entry.CompareKeys(res[i].Key, res[j].Key) < 0
+	})
+	return res, nil
+}
+
+// RangeTombstones returns the range tombstones of the files visible at snapshotTs.
+func (io *IO) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+	return rangeTombstones(readers, timestamp.ToUnit64(snapshotTs))
+}
+
+func rangeTombstones(readers []*Reader, snapshotTs uint64) []entry.RangeTombstone {
+	var res []entry.RangeTombstone
+	for _, r := range readers {
+		res = append(res, entry.VisibleTombstones(r.RangeTombstones(), snapshotTs)...)
+	}
+	return res
+}
+
+// visible walks the newest versions in key order, descending with bounds.Reverse. A
+// version covered by a range tombstone is walked as a tombstone at the ts of the range.
+func (io *IO) visible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) error {
+	if tombstones := io.RangeTombstones(snapshotTs); len(tombstones) > 0 {
+		snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+		next := fn
+		fn = func(key, val []byte) bool {
+			userKey := entry.ParseKey(key)
+			if ts, ok := entry.CoveringTs(tombstones, userKey, entry.ParseTs(key), snapshotTsNano); ok {
+				return next(entry.KeyWithTs(userKey, ts), nil)
+			}
+			return next(key, val)
+		}
+	}
+
+	if bounds.Reverse {
+		return io.descendVisible(startKey, snapshotTs, bounds, fn)
+	}
+	return io.ascendVisible(startKey, snapshotTs, bounds, fn)
+}
+
+// ascendVisible calls fn, in key order, on the newest version at or below snapshotTs
+// of every key at or after startKey, within bounds. key and val are only valid during
+// the call. It stops at the first damaged block of any file and returns its error.
+func (io *IO) ascendVisible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) error {
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	internalKey := entry.KeyWithTs([]byte(bounds.Start(startKey)), snapshotTsNano)
+
+	//1. Init Heap
+	mh := &MinHeap{}
+	heap.Init(mh)
+
+	// 2. Fetch all iterators and add to PQ
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+	for _, r := range readers {
+		iter := r.NewIterator()
+		iter.Seek(internalKey)
+		if iter.Valid() {
+			heap.Push(mh, iter)
+		} else if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	// 3. Merge, versions of a key are adjacent and newest first
+	var lastKey []byte
+	seen := false
+	for mh.Len() > 0 {
+		smallestIter := (*mh)[0]
+		key, val := smallestIter.Key(), smallestIter.Value()
+		if bounds.Past(entry.ParseKey(key)) {
+			return nil
+		}
+
+		// ItemTs <= snapshotTs
+		if entry.ParseTs(key) <= snapshotTsNano {
+			userKey := entry.ParseKey(key)
+			if !seen || !bytes.Equal(userKey, lastKey) {
+				lastKey, seen = append(lastKey[:0], userKey...), true
+				if !fn(key, val) {
+					return nil
+				}
+			}
+		}
+
+		smallestIter.Next()
+		if smallestIter.Valid() {
+			heap.Fix(mh, 0)
+		} else if err := smallestIter.Err(); err != nil {
+			return err
+		} else {
+			heap.Pop(mh)
+		}
+	}
+	return nil
+}
+
+// descendVisible is ascendVisible in descending key order, on the keys at or before
+// startKey.
+func (io *IO) descendVisible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) error {
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	last := bounds.Last(startKey)
+
+	//1. Init Heap
+	mh := &MaxHeap{}
+	heap.Init(mh)
+
+	// 2. Fetch all iterators and add to PQ
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+	for _, r := range readers {
+		iter := r.NewIterator()
+		if last == nil {
+			iter.SeekToLast()
+		} else {
+			iter.SeekForPrev(last)
+		}
+		if iter.Valid() {
+			heap.Push(mh, iter)
+		} else if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	// 3. Merge, versions of a key are adjacent and oldest first, so a key is known once
+	// the next one is reached
+	var lastKey, lastVal []byte
+	pending := false
+	for mh.Len() > 0 {
+		largestIter := (*mh)[0]
+		key, val := largestIter.Key(), largestIter.Value()
+		userKey := entry.ParseKey(key)
+		if bounds.Past(userKey) {
+			break
+		}
+
+		// ItemTs <= snapshotTs
+		if entry.ParseTs(key) <= snapshotTsNano {
+			if pending && !bytes.Equal(userKey, entry.ParseKey(lastKey)) && !fn(lastKey, lastVal) {
+				return nil
+			}
+			lastKey, lastVal, pending = append(lastKey[:0], key...), nil, true
+			if val != nil {
+				lastVal = append([]byte{}, val...)
+			}
+		}
+
+		largestIter.Prev()
+		if largestIter.Valid() {
+			heap.Fix(mh, 0)
+		} else if err := largestIter.Err(); err != nil {
+			return err
+		} else {
+			heap.Pop(mh)
+		}
+	}
+	if pending {
+		fn(lastKey, lastVal)
+	}
+	return nil
+}
+
+// Create writes records and range tombstones to a new level 0 file. flushedSeq is the
+// last WAL sequence covered by records, recorded in the MANIFEST along with the file.
+func (io *IO) Create(records []entry.Pair[[]byte, []byte], tombstones []entry.RangeTombstone, flushedSeq uint64) error {
+	if len(records) == 0 && len(tombstones) == 0 {
+		return nil
+	}
+
+	// 1. Sort by internal key, the last record of a version wins
+	sorted := make([]entry.Pair[[]byte, []byte], len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return entry.CompareKeys(sorted[i].Key, sorted[j].Key) < 0
+	})
+
+	// 2. Write the file
+	w, err := io.newFileWriter(0)
+	if err != nil {
+		return err
+	}
+	for i, record := range sorted {
+		if i+1 < len(sorted) && bytes.Equal(sorted[i+1].Key, record.Key) {
+			continue
+		}
+		if err = w.Add(record.Key, record.Val); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	for _, t := range tombstones {
+		if err = w.AddRangeTombstone(t); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if err = w.Finish(); err != nil {
+		return err
+	}
+
+	// 3. Record it
+	if prevSeq := io.vs.FlushedSeq(); flushedSeq > prevSeq {
+		w.r.meta.SmallestSeq, w.r.meta.LargestSeq = prevSeq+1, flushedSeq
+	}
+	edit := VersionEdit{AddFiles: []FileMeta{w.r.meta}, FlushedSeq: flushedSeq}
+	if err = io.vs.logAndApply(&edit); err != nil {
+		w.abort()
+		return err
+	}
+
+	io.Lock()
+	io.readers = append(io.readers, w.r)
+	io.Unlock()
+	return nil
+}
+
+// FlushedSeq returns the last WAL sequence persisted in the SSTs.
+func (io *IO) FlushedSeq() uint64 {
+	return io.vs.FlushedSeq()
+}
+
+// Compact runs one compaction picked by the policy, and reports whether there was
+// anything to compact. Versions shadowed at oldestSnapshotTs are dropped. The inputs
+// are swapped for the outputs by a single MANIFEST edit.
+func (io *IO) Compact(oldestSnapshotTs time.Time) (bool, error) {
+	if io.opts.Compaction == nil {
+		return false, nil
+	}
+	io.compactMu.Lock()
+	defer io.compactMu.Unlock()
+
+	// 1. Pick
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+
+	infos := make([]compaction.FileInfo, len(readers))
+	byID := make(map[uint64]*Reader, len(readers))
+	for i, r := range readers {
+		infos[i] = compaction.FileInfo{
+			ID:       r.meta.ID,
+			Level:    r.meta.Level,
+			Size:     r.meta.Size,
+			Smallest: entry.ParseKey(r.meta.Smallest),
+			Largest:  entry.ParseKey(r.meta.Largest),
+		}
+		byID[r.meta.ID] = r
+	}
+
+	task := io.opts.Compaction.Pick(infos)
+	if task == nil {
+		return false, nil
+	}
+
+	// 2. Merge
+	iters := make([]compaction.Iterator, len(task.Inputs))
+	var tombstones []entry.RangeTombstone
+	for i, input := range task.Inputs {
+		iter := byID[input.ID].newIterator(false)
+		iter.SeekToFirst()
+		iters[i] = iter
+		tombstones = append(tombstones, byID[input.ID].RangeTombstones()...)
+	}
+	var outputs []*fileWriter
+	err := compaction.Run(task, iters, tombstones, timestamp.ToUnit64(oldestSnapshotTs), func() (compaction.Writer, error) {
+		w, err := io.newFileWriter(task.OutputLevel)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, w)
+		return w, nil
+	})
+	for _, iter := range iters {
+		if iterErr := iter.(*Iterator).Err(); err == nil {
+			err = iterErr
+		}
+	}
+	if err != nil {
+		for _, w := range outputs {
+			w.abort()
+		}
+		return false, err
+	}
+
+	// 3. Swap the inputs for the outputs
+	edit := VersionEdit{DeleteFiles: make([]uint64, len(task.Inputs))}
+	for i, input := range task.Inputs {
+		edit.DeleteFiles[i] = input.ID
+	}
+	smallestSeq, largestSeq := seqRange(task.Inputs, byID)
+	for _, w := range outputs {
+		w.r.meta.SmallestSeq, w.r.meta.LargestSeq = smallestSeq, largestSeq
+		edit.AddFiles = append(edit.AddFiles, w.r.meta)
+	}
+	if err = io.vs.logAndApply(&edit); err != nil {
+		for _, w := range outputs {
+			w.abort()
+		}
+		return false, err
+	}
+
+	io.Lock()
+	live := make([]*Reader, 0, len(io.readers)-len(task.Inputs)+len(outputs))
+	var obsolete []*Reader
+	for _, r := range io.readers {
+		if task.IsInput(r.meta.ID) {
+			obsolete = append(obsolete, r)
+		} else {
+			live = append(live, r)
+		}
+	}
+	for _, w := range outputs {
+		live = append(live, w.r)
+	}
+	io.readers = live
+	io.Unlock()
+
+	// 4. Inputs are deleted once the last read using them is done
+	for _, r := range obsolete {
+		r.obsolete.Store(true)
+		_ = r.unref()
+	}
+	return true, nil
+}
+
+func seqRange(inputs []compaction.FileInfo, byID map[uint64]*Reader) (smallest, largest uint64) {
+	for _, input := range inputs {
+		meta := byID[input.ID].meta
+		if meta.LargestSeq == 0 {
+			continue
+		}
+		if smallest == 0 || meta.SmallestSeq < smallest {
+			smallest = meta.SmallestSeq
+		}
+		if meta.LargestSeq > largest {
+			largest = meta.LargestSeq
+		}
+	}
+	return smallest, largest
+}
+
+// refReaders returns the live files, referenced until unrefReaders.
+func (io *IO) refReaders() []*Reader {
+	io.Lock()
+	defer io.Unlock()
+
+	readers := make([]*Reader, len(io.readers))
+	for i, r := range io.readers {
+		r.ref()
+		readers[i] = r
+	}
+	return readers
+}
+
+func unrefReaders(readers []*Reader) {
+	for _, r := range readers {
+		_ = r.unref()
+	}
+}
+
+// Close closes every file. The files are kept, unless the IO is ephemeral.
+func (io *IO) Close() error {
+	io.Lock()
+	defer io.Unlock()
+
+	var firstErr error
+	for _, r := range io.readers {
+		if err := r.unref(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	io.readers = nil
+	if err := io.vs.close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	if io.ephemeral {
+		return os.RemoveAll(io.dir)
+	}
+	return firstErr
+}
+
+// Destroy closes and deletes every file.
+func (io *IO) Destroy() {
+	io.Lock()
+	readers := io.readers
+	io.readers = nil
+	io.Unlock()
+
+	for _, r := range readers {
+		r.obsolete.Store(true)
+		_ = r.unref()
+	}
+	io.vs.destroy()
+	if io.ephemeral {
+		_ = os.RemoveAll(io.dir)
+	}
+}
+
+// VerifyChecksums checks every block of the live files, reading them from disk. The
+// first damage found is returned as a *CorruptionError.
+func (io *IO) VerifyChecksums() error {
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+
+	for _, r := range readers {
+		if err := VerifyChecksums(r.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompressionStats sums the sizes of the data blocks of the files, before and after
+// compression.
+func (io *IO) CompressionStats() compress.Stats {
+	readers := io.refReaders()
+	defer unrefReaders(readers)
+
+	var stats compress.Stats
+	for _, r := range readers {
+		s := r.CompressionStats()
+		stats.RawBytes += s.RawBytes
+		stats.StoredBytes += s.StoredBytes
+	}
+	return stats
+}
+
+// BlockCacheStats returns the statistics of the block cache.
+func (io *IO) BlockCacheStats() cache.Stats {
+	return io.opts.BlockCache.Stats()
+}
+
+func (io *IO) Name() string {
+	return "disk"
+}
+
+func fileName(id uint64) string {
+	return fmt.Sprintf("%06d%s", id, sstExt)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
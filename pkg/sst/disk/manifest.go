@@ -0,0 +1,271 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	currentFileName = "CURRENT"
+	manifestPrefix  = "MANIFEST-"
+
+	// maxManifestSize triggers a rotation to a new MANIFEST holding a single edit.
+	maxManifestSize = 4 << 20 // 4MB
+
+	// manifestHeaderSize is crc(4) + edit length(4)
+	manifestHeaderSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// versionSet is the SST set recorded in the MANIFEST. The MANIFEST is a log of
+// VersionEdits framed as | crc32c | len | edit |, and CURRENT names the live one.
+// Edits are applied in memory only once they are durable.
+type versionSet struct {
+	sync.Mutex
+	dir        string
+	files      map[uint64]FileMeta
+	flushedSeq uint64
+	nextFileID uint64
+
+	manifest     *os.File
+	manifestID   uint64
+	manifestSize int64
+}
+
+// openVersionSet replays the MANIFEST named by CURRENT. found is false if dir has no
+// CURRENT yet. No MANIFEST is written until rotate is called.
+func openVersionSet(dir string) (vs *versionSet, found bool, err error) {
+	vs = &versionSet{dir: dir, files: make(map[uint64]FileMeta), nextFileID: 1}
+
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if os.IsNotExist(err) {
+		return vs, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	name := strings.TrimSuffix(string(current), "\n")
+	if _, err = fmt.Sscanf(name, manifestPrefix+"%d", &vs.manifestID); err != nil {
+		return nil, false, fmt.Errorf("%s: %w", currentFileName, ErrCorruptManifest)
+	}
+	if err = replayManifest(filepath.Join(dir, name), vs.apply); err != nil {
+		return nil, false, fmt.Errorf("%s: %w", name, err)
+	}
+	if vs.manifestID >= vs.nextFileID {
+		vs.nextFileID = vs.manifestID + 1
+	}
+	return vs, true, nil
+}
+
+func (vs *versionSet) newFileID() uint64 {
+	vs.Lock()
+	defer vs.Unlock()
+
+	id := vs.nextFileID
+	vs.nextFileID++
+	return id
+}
+
+func (vs *versionSet) FlushedSeq() uint64 {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.flushedSeq
+}
+
+// logAndApply makes edit durable in the MANIFEST, then applies it.
+func (vs *versionSet) logAndApply(edit *VersionEdit) error {
+	vs.Lock()
+	defer vs.Unlock()
+
+	edit.NextFileID = vs.nextFileID
+	if edit.FlushedSeq <= vs.flushedSeq {
+		edit.FlushedSeq = 0
+	}
+
+	buf := encodeManifestRecord(nil, edit)
+	if _, err := vs.manifest.Write(buf); err != nil {
+		// the tail of the MANIFEST is unknown, start a new one without the edit.
+		_ = vs.rotateLocked()
+		return err
+	}
+	if err := vs.manifest.Sync(); err != nil {
+		_ = vs.rotateLocked()
+		return err
+	}
+	vs.manifestSize += int64(len(buf))
+	vs.apply(*edit)
+
+	if vs.manifestSize >= maxManifestSize {
+		return vs.rotateLocked()
+	}
+	return nil
+}
+
+func (vs *versionSet) apply(edit VersionEdit) {
+	for _, id := range edit.DeleteFiles {
+		delete(vs.files, id)
+	}
+	for _, f := range edit.AddFiles {
+		vs.files[f.ID] = f
+	}
+	if edit.FlushedSeq > vs.flushedSeq {
+		vs.flushedSeq = edit.FlushedSeq
+	}
+	if edit.NextFileID > vs.nextFileID {
+		vs.nextFileID = edit.NextFileID
+	}
+}
+
+func (vs *versionSet) rotate() error {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.rotateLocked()
+}
+
+// rotateLocked writes the whole set as a single edit to a new MANIFEST, points CURRENT
+// to it and deletes the previous one.
+func (vs *versionSet) rotateLocked() error {
+	// 1. Write the new MANIFEST
+	id := vs.nextFileID
+	vs.nextFileID++
+	path := filepath.Join(vs.dir, manifestName(id))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	snapshot := VersionEdit{FlushedSeq: vs.flushedSeq, NextFileID: vs.nextFileID}
+	for _, meta := range vs.files {
+		snapshot.AddFiles = append(snapshot.AddFiles, meta)
+	}
+	sort.Slice(snapshot.AddFiles, func(i, j int) bool {
+		return snapshot.AddFiles[i].ID < snapshot.AddFiles[j].ID
+	})
+	buf := encodeManifestRecord(nil, &snapshot)
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+
+	// 2. Point CURRENT to it
+	if err = setCurrent(vs.dir, manifestName(id)); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+
+	// 3. Drop the previous one
+	if vs.manifest != nil {
+		_ = vs.manifest.Close()
+	}
+	if vs.manifestID != 0 {
+		_ = os.Remove(filepath.Join(vs.dir, manifestName(vs.manifestID)))
+	}
+	vs.manifest, vs.manifestID, vs.manifestSize = f, id, int64(len(buf))
+	return nil
+}
+
+func (vs *versionSet) close() error {
+	vs.Lock()
+	defer vs.Unlock()
+
+	if vs.manifest == nil {
+		return nil
+	}
+	err := vs.manifest.Close()
+	vs.manifest = nil
+	return err
+}
+
+// destroy closes and deletes the MANIFEST and CURRENT.
+func (vs *versionSet) destroy() {
+	_ = vs.close()
+	_ = os.Remove(filepath.Join(vs.dir, currentFileName))
+	if vs.manifestID != 0 {
+		_ = os.Remove(filepath.Join(vs.dir, manifestName(vs.manifestID)))
+	}
+}
+
+func manifestName(id uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, id)
+}
+
+// setCurrent atomically replaces CURRENT.
+func setCurrent(dir, name string) error {
+	tmpPath := filepath.Join(dir, currentFileName+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(dir, currentFileName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func encodeManifestRecord(buf []byte, edit *VersionEdit) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, manifestHeaderSize)...)
+	buf = edit.encode(buf)
+
+	payload := buf[start+manifestHeaderSize:]
+	binary.BigEndian.PutUint32(buf[start:], crc32.Checksum(payload, crcTable))
+	binary.BigEndian.PutUint32(buf[start+4:], uint32(len(payload)))
+	return buf
+}
+
+// replayManifest calls fn for every edit. A torn last record, left by a crash while
+// it was written, is ignored: its edit was never applied.
+func replayManifest(path string, fn func(edit VersionEdit)) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for len(buf) > 0 {
+		if len(buf) < manifestHeaderSize {
+			return nil
+		}
+		size := binary.BigEndian.Uint32(buf[4:])
+		if uint64(len(buf)-manifestHeaderSize) < uint64(size) {
+			return nil
+		}
+		crc := binary.BigEndian.Uint32(buf)
+		payload := buf[manifestHeaderSize : manifestHeaderSize+int(size)]
+		buf = buf[manifestHeaderSize+int(size):]
+
+		if crc32.Checksum(payload, crcTable) != crc {
+			if len(buf) == 0 {
+				return nil
+			}
+			return ErrCorruptManifest
+		}
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return err
+		}
+		fn(edit)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+package disk
+
+import (
+	"github.com/dborchard/cometkv/pkg/sst/bloom"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"math"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// Reader serves reads of a single SST file using pread. Blocks are read through the
+// block cache; the index and filter are kept in memory if pinned.
+type Reader struct {
+	f      *os.File
+	path   string
+	meta   FileMeta
+	footer footer
+
+	cache   *cache.Cache
+	cacheID uint64
+	pinned  bool
+	index   []indexEntry // nil unless pinned
+	filter  bloom.Filter // nil unless pinned
+	// rangeTombstones are always in memory.
+	rangeTombstones []entry.RangeTombstone
+
+	// refs counts the owner and the in-flight reads of the file. The file is closed,
+	// and deleted if obsolete, when the last one is released.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// OpenReader opens the file at path, using the block cache and pinning of opts.
+func OpenReader(path string, id uint64, opts Options) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReader(f, path, id, opts)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newReader(f *os.File, path string, id uint64, opts Options) (*Reader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := stat.Size()
+	if size < footerSize {
+		return nil, ErrBadMagic
+	}
+
+	// 1. Footer
+	buf := make([]byte, footerSize)
+	if _, err = f.ReadAt(buf, size-footerSize); err != nil {
+		return nil, err
+	}
+	ft, err := decodeFooter(buf)
+	if err == errChecksumMismatch {
+		return nil, &CorruptionError{Path: path, Offset: uint64(size - footerSize), Err: err}
+	} else if err != nil {
+		return nil, err
+	}
+
+	// 2. Filter and Index
+	r := &Reader{
+		f:       f,
+		path:    path,
+		meta:    FileMeta{ID: id, Size: uint64(size)},
+		footer:  ft,
+		cache:   opts.BlockCache,
+		cacheID: opts.BlockCache.NewID(),
+		pinned:  opts.PinIndexAndFilter,
+	}
+	r.refs.Store(1)
+	index, err := r.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	if r.pinned {
+		if r.filter, err = r.readBlock(ft.filter, false); err != nil {
+			return nil, err
+		}
+		r.index = index
+	}
+
+	// 3. Range tombstones
+	buf, err = r.readBlock(ft.rangeDel, false)
+	if err != nil {
+		return nil, err
+	}
+	if r.rangeTombstones, err = decodeRangeTombstones(buf); err != nil {
+		return nil, &CorruptionError{Path: path, Offset: ft.rangeDel.offset, Err: err}
+	}
+
+	// 4. Key range, that of the range tombstones included
+	if len(index) > 0 {
+		it := r.newIterator(false)
+		it.SeekToFirst()
+		if !it.Valid() {
+			return nil, it.Err()
+		}
+		r.meta.Smallest = append([]byte{}, it.Key()...)
+		r.meta.Largest = index[len(index)-1].lastKey
+	}
+	for _, t := range r.rangeTombstones {
+		if smallest := entry.KeyWithTs([]byte(t.Start), math.MaxUint64); r.meta.Smallest == nil || entry.CompareKeys(smallest, r.meta.Smallest) < 0 {
+			r.meta.Smallest = smallest
+		}
+		if largest := entry.KeyWithTs([]byte(t.End), 0); r.meta.Largest == nil || entry.CompareKeys(largest, r.meta.Largest) > 0 {
+			r.meta.Largest = largest
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) Meta() FileMeta {
+	return r.meta
+}
+
+// RangeTombstones returns the range tombstones of the file.
+func (r *Reader) RangeTombstones() []entry.RangeTombstone {
+	return r.rangeTombstones
+}
+
+// MayContain checks the file's bloom filter for a user key.
+func (r *Reader) MayContain(key []byte) bool {
+	filter := r.filter
+	if !r.pinned {
+		var err error
+		if filter, err = r.readBlock(r.footer.filter, true); err != nil {
+			// let the read report the error
+			return true
+		}
+	}
+	return bloom.Filter(filter).MayContain(key)
+}
+
+func (r *Reader) loadIndex() ([]indexEntry, error) {
+	if r.pinned && r.index != nil {
+		return r.index, nil
+	}
+	buf, err := r.readBlock(r.footer.index, !r.pinned)
+	if err != nil {
+		return nil, err
+	}
+	index, err := decodeIndex(buf)
+	if err != nil {
+		return nil, &CorruptionError{Path: r.path, Offset: r.footer.index.offset, Err: err}
+	}
+	return index, nil
+}
+
+// readBlock reads, verifies and decompresses the block at h, through the block cache.
+// Blocks read only once, like the inputs of a compaction, do not fill the cache.
+func (r *Reader) readBlock(h blockHandle, fillCache bool) ([]byte, error) {
+	key := cache.Key{ID: r.cacheID, Offset: h.offset}
+	if block, ok := r.cache.Get(key); ok {
+		return block, nil
+	}
+
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := r.f.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	codec, err := verifyBlock(buf[:h.size], buf[h.size:])
+	if err != nil {
+		return nil, &CorruptionError{Path: r.path, Offset: h.offset, Err: err}
+	}
+	block, err := compress.Decompress(codec, buf[:h.size])
+	if err != nil {
+		return nil, &CorruptionError{Path: r.path, Offset: h.offset, Err: err}
+	}
+	if fillCache {
+		r.cache.Insert(key, block)
+	}
+	return block, nil
+}
+
+// CompressionStats compares the size of the data blocks before and after compression.
+func (r *Reader) CompressionStats() compress.Stats {
+	// the data blocks are stored before the filter
+	return compress.Stats{RawBytes: r.footer.rawDataSize, StoredBytes: r.footer.filter.offset}
+}
+
+// Close releases the reference of the owner.
+func (r *Reader) Close() error {
+	return r.unref()
+}
+
+func (r *Reader) ref() {
+	r.refs.Add(1)
+}
+
+func (r *Reader) unref() error {
+	if r.refs.Add(-1) > 0 {
+		return nil
+	}
+	err := r.f.Close()
+	if r.obsolete.Load() {
+		if rmErr := os.Remove(r.path); err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+func (r *Reader) NewIterator() *Iterator {
+	return r.newIterator(true)
+}
+
+// newIterator returns an iterator whose data blocks fill the block cache if fillCache.
+func (r *Reader) newIterator(fillCache bool) *Iterator {
+	it := &Iterator{r: r, blockIdx: -1, fillCache: fillCache}
+	it.index, it.err = r.loadIndex()
+	return it
+}
+
+// Iterator walks the entries of a file in internal key order, or in reverse with Prev.
+// Key and Value are only valid until the next call to a Seek method, Next or Prev.
+type Iterator struct {
+	r         *Reader
+	index     []indexEntry
+	fillCache bool
+	blockIdx  int
+	block     []byte
+	pos       int
+	// start is the offset of the current entry in the block. offsets holds those of
+	// every entry of the block, to walk it backwards; nil until Prev needs them.
+	start   int
+	offsets []int
+
+	key, val []byte
+	valid    bool
+	err      error
+}
+
+// Seek moves to the first entry whose internal key is >= key.
+func (it *Iterator) Seek(key []byte) {
+	// first block whose last key is >= key
+	idx := sort.Search(len(it.index), func(i int) bool {
+		return entry.CompareKeys(it.index[i].lastKey, key) >= 0
+	})
+	if !it.loadBlock(idx) {
+		return
+	}
+	for it.valid && entry.CompareKeys(it.key, key) < 0 {
+		it.Next()
+	}
+}
+
+func (it *Iterator) SeekToFirst() {
+	it.loadBlock(0)
+}
+
+// SeekForPrev moves to the last entry whose internal key is <= key.
+func (it *Iterator) SeekForPrev(key []byte) {
+	// first block whose last key is >= key, or the last block
+	idx := sort.Search(len(it.index), func(i int) bool {
+		return entry.CompareKeys(it.index[i].lastKey, key) >= 0
+	})
+	if idx == len(it.index) {
+		idx--
+	}
+	if !it.loadBlockLast(idx) {
+		return
+	}
+	for it.valid && entry.CompareKeys(it.key, key) > 0 {
+		it.Prev()
+	}
+}
+
+func (it *Iterator) SeekToLast() {
+	it.loadBlockLast(len(it.index) - 1)
+}
+
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.pos >= len(it.block) {
+		it.loadBlock(it.blockIdx + 1)
+		return
+	}
+	it.decode()
+}
+
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+	if it.offsets == nil {
+		if it.offsets, it.err = it.blockOffsets(); it.err != nil {
+			it.valid = false
+			return
+		}
+	}
+	i := sort.SearchInts(it.offsets, it.start)
+	if i == 0 {
+		it.loadBlockLast(it.blockIdx - 1)
+		return
+	}
+	it.pos = it.offsets[i-1]
+	it.decode()
+}
+
+func (it *Iterator) Valid() bool { return it.valid }
+func (it *Iterator) Key() []byte { return it.key }
+
+// Value returns nil for a tombstone.
+func (it *Iterator) Value() []byte { return it.val }
+func (it *Iterator) Err() error    { return it.err }
+
+// loadBlock positions the iterator on the first entry of block idx.
+func (it *Iterator) loadBlock(idx int) bool {
+	it.valid = false
+	if idx >= len(it.index) {
+		return false
+	}
+
+	block, err := it.r.readBlock(it.index[idx].handle, it.fillCache)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.blockIdx, it.block, it.pos, it.offsets = idx, block, 0, nil
+	it.decode()
+	return it.valid
+}
+
+// loadBlockLast positions the iterator on the last entry of block idx.
+func (it *Iterator) loadBlockLast(idx int) bool {
+	it.valid = false
+	if idx < 0 || !it.loadBlock(idx) {
+		return false
+	}
+	if it.offsets, it.err = it.blockOffsets(); it.err != nil {
+		it.valid = false
+		return false
+	}
+	it.pos = it.offsets[len(it.offsets)-1]
+	it.decode()
+	return it.valid
+}
+
+// blockOffsets returns the offset of every entry of the current block.
+func (it *Iterator) blockOffsets() ([]int, error) {
+	var offsets []int
+	for pos := 0; pos < len(it.block); {
+		_, _, n, err := decodeEntry(it.block[pos:])
+		if err != nil {
+			return nil, it.corruption(err)
+		}
+		offsets = append(offsets, pos)
+		pos += n
+	}
+	return offsets, nil
+}
+
+func (it *Iterator) decode() {
+	key, val, n, err := decodeEntry(it.block[it.pos:])
+	if err != nil {
+		it.err, it.valid = it.corruption(err), false
+		return
+	}
+	it.key, it.val, it.valid = key, val, true
+	it.start = it.pos
+	it.pos += n
+}
+
+func (it *Iterator) corruption(err error) error {
+	return &CorruptionError{Path: it.r.path, Offset: it.index[it.blockIdx].handle.offset, Err: err}
+}
+
+// VerifyChecksums checks the footer and every block of the file at path, and that the
+// entries are in increasing key order. Blocks are read from the file, bypassing any
+// cache. The first damage found is returned as a *CorruptionError.
+func VerifyChecksums(path string) error {
+	// the footer, filter, index and range del block are verified on open
+	r, err := OpenReader(path, 0, Options{PinIndexAndFilter: true})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var prev []byte
+	it := r.newIterator(false)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if prev != nil && entry.CompareKeys(prev, it.Key()) >= 0 {
+			return it.corruption(errKeyOrder)
+		}
+		prev = append(prev[:0], it.Key()...)
+	}
+	return it.Err()
+}
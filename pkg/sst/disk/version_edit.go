@@ -0,0 +1,125 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// VersionEdit is a change of the SST set, logged to the MANIFEST.
+type VersionEdit struct {
+	AddFiles    []FileMeta
+	DeleteFiles []uint64
+	// FlushedSeq is the last WAL sequence persisted in the SSTs. Zero keeps it unchanged.
+	FlushedSeq uint64
+	// NextFileID is above every file ID in use. Zero keeps it unchanged.
+	NextFileID uint64
+}
+
+// ErrCorruptManifest is returned when the MANIFEST cannot be decoded.
+var ErrCorruptManifest = errors.New("disk: corrupt manifest")
+
+const (
+	tagFlushedSeq byte = iota + 1
+	tagNextFileID
+	tagDeleteFile
+	tagAddFile
+)
+
+// encode appends the edit as a list of tagged fields.
+// Add file: | id | level | size | entries | smallestSeq | largestSeq | smallest | largest |
+func (e *VersionEdit) encode(buf []byte) []byte {
+	if e.FlushedSeq != 0 {
+		buf = append(buf, tagFlushedSeq)
+		buf = binary.AppendUvarint(buf, e.FlushedSeq)
+	}
+	if e.NextFileID != 0 {
+		buf = append(buf, tagNextFileID)
+		buf = binary.AppendUvarint(buf, e.NextFileID)
+	}
+	for _, id := range e.DeleteFiles {
+		buf = append(buf, tagDeleteFile)
+		buf = binary.AppendUvarint(buf, id)
+	}
+	for _, f := range e.AddFiles {
+		buf = append(buf, tagAddFile)
+		buf = binary.AppendUvarint(buf, f.ID)
+		buf = binary.AppendUvarint(buf, uint64(f.Level))
+		buf = binary.AppendUvarint(buf, f.Size)
+		buf = binary.AppendUvarint(buf, uint64(f.Entries))
+		buf = binary.AppendUvarint(buf, f.SmallestSeq)
+		buf = binary.AppendUvarint(buf, f.LargestSeq)
+		buf = binary.AppendUvarint(buf, uint64(len(f.Smallest)))
+		buf = append(buf, f.Smallest...)
+		buf = binary.AppendUvarint(buf, uint64(len(f.Largest)))
+		buf = append(buf, f.Largest...)
+	}
+	return buf
+}
+
+func decodeVersionEdit(buf []byte) (VersionEdit, error) {
+	d := editDecoder{buf: buf}
+	var e VersionEdit
+	for len(d.buf) > 0 && d.err == nil {
+		tag := d.buf[0]
+		d.buf = d.buf[1:]
+
+		switch tag {
+		case tagFlushedSeq:
+			e.FlushedSeq = d.uvarint()
+		case tagNextFileID:
+			e.NextFileID = d.uvarint()
+		case tagDeleteFile:
+			e.DeleteFiles = append(e.DeleteFiles, d.uvarint())
+		case tagAddFile:
+			f := FileMeta{
+				ID:          d.uvarint(),
+				Level:       int(d.uvarint()),
+				Size:        d.uvarint(),
+				Entries:     int(d.uvarint()),
+				SmallestSeq: d.uvarint(),
+				LargestSeq:  d.uvarint(),
+			}
+			f.Smallest = d.bytes()
+			f.Largest = d.bytes()
+			e.AddFiles = append(e.AddFiles, f)
+		default:
+			return VersionEdit{}, ErrCorruptManifest
+		}
+	}
+	if d.err != nil {
+		return VersionEdit{}, d.err
+	}
+	return e, nil
+}
+
+type editDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *editDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorruptManifest
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *editDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = ErrCorruptManifest
+		return nil
+	}
+	b := append([]byte{}, d.buf[:n]...)
+	d.buf = d.buf[n:]
+	return b
+}
@@ -0,0 +1,160 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/dborchard/cometkv/pkg/sst/bloom"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"os"
+)
+
+// FileMeta describes a finished SST file.
+type FileMeta struct {
+	ID       uint64
+	Level    int
+	Size     uint64
+	Entries  int
+	Smallest []byte // internal key
+	Largest  []byte // internal key
+
+	// SmallestSeq and LargestSeq bound the WAL sequences of the entries, zero if unknown.
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// Writer builds an SST file. Keys must be added in increasing internal key order.
+type Writer struct {
+	f      *os.File
+	bw     *bufio.Writer
+	opts   Options
+	offset uint64
+
+	block        []byte
+	blockLastKey []byte
+	index        []byte
+	filter       *bloom.Builder
+	rangeDel     []byte
+
+	compressed  []byte
+	rawDataSize uint64
+
+	meta FileMeta
+}
+
+func NewWriter(f *os.File, opts Options) *Writer {
+	return &Writer{
+		f:      f,
+		bw:     bufio.NewWriter(f),
+		opts:   opts,
+		filter: bloom.NewBuilder(opts.BloomBitsPerKey),
+	}
+}
+
+func (w *Writer) Add(key, val []byte) error {
+	if w.meta.Entries == 0 {
+		w.meta.Smallest = append([]byte{}, key...)
+		w.filter.Add(entry.ParseKey(key))
+	} else if entry.CompareKeys(key, w.blockLastKey) <= 0 {
+		panic("disk: keys must be added in increasing order")
+	} else if !bytes.Equal(entry.ParseKey(key), entry.ParseKey(w.blockLastKey)) {
+		w.filter.Add(entry.ParseKey(key))
+	}
+
+	w.block = appendEntry(w.block, key, val)
+	w.blockLastKey = append(w.blockLastKey[:0], key...)
+	w.meta.Entries++
+
+	if len(w.block) >= w.opts.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// AddRangeTombstone adds a range tombstone to the file, in any order relative to the
+// keys.
+func (w *Writer) AddRangeTombstone(t entry.RangeTombstone) error {
+	w.rangeDel = appendRangeTombstone(w.rangeDel, t)
+	return nil
+}
+
+// EstimatedSize is the size of the file written so far, without filter, index and footer.
+func (w *Writer) EstimatedSize() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+func (w *Writer) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+
+	h, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.rawDataSize += uint64(len(w.block))
+	w.index = appendIndexEntry(w.index, w.blockLastKey, h)
+	w.block = w.block[:0]
+	return nil
+}
+
+// writeBlock compresses block with the configured codec, unless that saves less than
+// 1/8 of its size, and writes it followed by its trailer.
+func (w *Writer) writeBlock(block []byte) (blockHandle, error) {
+	codec, payload := w.opts.Compression, block
+	if codec != compress.None {
+		w.compressed = compress.Compress(codec, w.compressed[:0], block)
+		if len(w.compressed) < len(block)-len(block)/8 {
+			payload = w.compressed
+		} else {
+			codec = compress.None
+		}
+	}
+
+	h := blockHandle{offset: w.offset, size: uint64(len(payload))}
+	if _, err := w.bw.Write(payload); err != nil {
+		return blockHandle{}, err
+	}
+	if _, err := w.bw.Write(blockTrailer(payload, codec)); err != nil {
+		return blockHandle{}, err
+	}
+	w.offset += uint64(len(payload)) + blockTrailerSize
+	return h, nil
+}
+
+// Finish writes the filter, index, range del block and footer and fsyncs the file. The
+// file is not closed.
+func (w *Writer) Finish() (FileMeta, error) {
+	w.meta.Largest = append([]byte{}, w.blockLastKey...)
+	if err := w.flushBlock(); err != nil {
+		return FileMeta{}, err
+	}
+
+	filterHandle, err := w.writeBlock(w.filter.Build())
+	if err != nil {
+		return FileMeta{}, err
+	}
+	indexHandle, err := w.writeBlock(w.index)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	rangeDelHandle, err := w.writeBlock(w.rangeDel)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	ft := footer{filter: filterHandle, index: indexHandle, rangeDel: rangeDelHandle, rawDataSize: w.rawDataSize, version: formatVersion}
+	if _, err = w.bw.Write(ft.encode()); err != nil {
+		return FileMeta{}, err
+	}
+	w.offset += footerSize
+
+	if err = w.bw.Flush(); err != nil {
+		return FileMeta{}, err
+	}
+	if err = w.f.Sync(); err != nil {
+		return FileMeta{}, err
+	}
+
+	w.meta.Size = w.offset
+	return w.meta, nil
+}
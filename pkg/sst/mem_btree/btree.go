@@ -1,56 +1,222 @@
 package mem_btree
 
 import (
+	"bytes"
 	"container/heap"
+	"github.com/dborchard/cometkv/pkg/sst/bloom"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compaction"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
 	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"github.com/tidwall/btree"
+	"sort"
 	"sync"
 	"time"
 )
 
+type Options struct {
+	// BloomBitsPerKey sizes the per-file bloom filter. Zero disables it.
+	BloomBitsPerKey int
+	// Compaction picks the files merged by Compact. Nil disables compaction.
+	Compaction compaction.Policy
+}
+
 type IO struct {
 	sync.Mutex
-	files []*btree.BTreeG[entry.Pair[[]byte, []byte]]
+	files      []*file
+	nextID     uint64
+	flushedSeq uint64
+	opts       Options
+
+	// compactMu serializes compactions.
+	compactMu sync.Mutex
+}
+
+type file struct {
+	tree            *btree.BTreeG[entry.Pair[[]byte, []byte]]
+	filter          bloom.Filter
+	rangeTombstones []entry.RangeTombstone
+	info            compaction.FileInfo
 }
 
-func NewMBtreeIO() *IO {
+func NewMBtreeIO(opts Options) *IO {
 	return &IO{
-		files: make([]*btree.BTreeG[entry.Pair[[]byte, []byte]], 0),
+		files:  make([]*file, 0),
+		nextID: 1,
+		opts:   opts,
+	}
+}
+
+// Get seeks only the files whose bloom filter may contain key, and returns the newest
+// version at or below snapshotTs: nil if it is a tombstone or is covered by a range
+// tombstone, empty if there is none.
+func (io *IO) Get(key string, snapshotTs time.Time) ([]byte, error) {
+	userKey := []byte(key)
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	startRow := entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs(userKey, snapshotTsNano)}
+
+	io.Lock()
+	files := append([]*file{}, io.files...)
+	io.Unlock()
+
+	var res entry.Pair[[]byte, []byte]
+	found := false
+	for _, f := range files {
+		if !f.filter.MayContain(userKey) {
+			continue
+		}
+
+		f.tree.Ascend(startRow, func(item entry.Pair[[]byte, []byte]) bool {
+			if bytes.Equal(entry.ParseKey(item.Key), userKey) {
+				if !found || entry.ParseTs(item.Key) > entry.ParseTs(res.Key) {
+					res, found = item, true
+				}
+			}
+			return false
+		})
+	}
+
+	if !found {
+		return []byte{}, nil
+	}
+	if _, covered := entry.CoveringTs(io.RangeTombstones(snapshotTs), userKey, entry.ParseTs(res.Key), snapshotTsNano); covered {
+		return nil, nil
+	}
+	// nil if deleted
+	return res.Val, nil
+}
+
+// History returns every version of key at or below snapshotTs kept by the files,
+// newest first. Range tombstones are not applied.
+func (io *IO) History(key string, snapshotTs time.Time) ([]entry.Pair[[]byte, []byte], error) {
+	userKey := []byte(key)
+	startRow := entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs(userKey, timestamp.ToUnit64(snapshotTs))}
+
+	io.Lock()
+	files := append([]*file{}, io.files...)
+	io.Unlock()
+
+	var res []entry.Pair[[]byte, []byte]
+	for _, f := range files {
+		if !f.filter.MayContain(userKey) {
+			continue
+		}
+
+		f.tree.Ascend(startRow, func(item entry.Pair[[]byte, []byte]) bool {
+			if !bytes.Equal(entry.ParseKey(item.Key), userKey) {
+				return false
+			}
+			res = append(res, item)
+			return true
+		})
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return entry.CompareKeys(res[i].Key, res[j].Key) < 0
+	})
+	return res, nil
+}
+
+// RangeTombstones returns the range tombstones of the files visible at snapshotTs.
+func (io *IO) RangeTombstones(snapshotTs time.Time) []entry.RangeTombstone {
+	io.Lock()
+	defer io.Unlock()
+
+	var res []entry.RangeTombstone
+	for _, f := range io.files {
+		res = append(res, entry.VisibleTombstones(f.rangeTombstones, timestamp.ToUnit64(snapshotTs))...)
+	}
+	return res
+}
+
+func (io *IO) Scan(startKey string, count int, snapshotTs time.Time, bounds entry.Bounds) ([]entry.Pair[string, []byte], error) {
+	var res []entry.Pair[string, []byte]
+	io.visible(startKey, snapshotTs, bounds, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		if val != nil {
+			res = append(res, entry.Pair[string, []byte]{Key: string(entry.ParseKey(key)), Val: val})
+		}
+		return true
+	})
+	return res, nil
+}
+
+// ScanVersions is Scan returning tombstones too, with internal keys so that the version
+// of every row is known.
+func (io *IO) ScanVersions(startKey string, count int, snapshotTs time.Time, bounds entry.Bounds) ([]entry.Pair[[]byte, []byte], error) {
+	var res []entry.Pair[[]byte, []byte]
+	io.visible(startKey, snapshotTs, bounds, func(key, val []byte) bool {
+		if len(res) >= count {
+			return false
+		}
+		res = append(res, entry.Pair[[]byte, []byte]{Key: key, Val: val})
+		return true
+	})
+	return res, nil
+}
+
+// NewIterator iterates over what ScanVersions returns, at snapshotTs, a page at a time.
+func (io *IO) NewIterator(snapshotTs time.Time, bounds entry.Bounds) iterator.Iterator {
+	scan := func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error) {
+		return io.ScanVersions(startKey, count, snapshotTs, bounds)
+	}
+	if bounds.Reverse {
+		return iterator.NewReversePaged(iterator.DefaultPageSize, scan)
 	}
+	return iterator.NewPaged(iterator.DefaultPageSize, scan)
 }
 
-func (io *IO) Get(key string, snapshotTs time.Time) []byte {
-	res := io.Scan(key, 1, snapshotTs)
-	if len(res) != 1 || res[0].Key != key {
-		return []byte{}
+// visible walks the newest versions in key order, descending with bounds.Reverse. A
+// version covered by a range tombstone is walked as a tombstone at the ts of the range.
+func (io *IO) visible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) {
+	if tombstones := io.RangeTombstones(snapshotTs); len(tombstones) > 0 {
+		snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+		next := fn
+		fn = func(key, val []byte) bool {
+			userKey := entry.ParseKey(key)
+			if ts, ok := entry.CoveringTs(tombstones, userKey, entry.ParseTs(key), snapshotTsNano); ok {
+				return next(entry.KeyWithTs(userKey, ts), nil)
+			}
+			return next(key, val)
+		}
 	}
-	return res[0].Val
+
+	if bounds.Reverse {
+		io.descendVisible(startKey, snapshotTs, bounds, fn)
+		return
+	}
+	io.ascendVisible(startKey, snapshotTs, bounds, fn)
 }
 
-func (io *IO) Scan(startKey string, count int, snapshotTs time.Time) []entry.Pair[string, []byte] {
-	internalKey := entry.KeyWithTs([]byte(startKey), timestamp.ToUnit64(snapshotTs))
-	startRow := entry.Pair[[]byte, []byte]{Key: internalKey}
+// ascendVisible calls fn, in key order, on the newest version at or below snapshotTs
+// of every key at or after startKey, within bounds.
+func (io *IO) ascendVisible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) {
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	startRow := entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(bounds.Start(startKey)), snapshotTsNano)}
 
 	//1. Init Heap
 	mh := &MinHeap{}
 	heap.Init(mh)
 
-	// 2. Fetch all iterators and add to PQ
+	// 2. Fetch all iterators and add to PQ. Copying a tree waits for its readers, such
+	// as a compaction, so it is done out of io's lock.
 	io.Lock()
-	for _, file := range io.files {
-		iter := file.Copy().Iter()
-		iter.Seek(startRow)
-		heap.Push(mh, &iter)
-	}
+	files := append([]*file{}, io.files...)
 	io.Unlock()
+	for _, f := range files {
+		iter := f.tree.Copy().Iter()
+		if iter.Seek(startRow) {
+			heap.Push(mh, &iter)
+		} else {
+			iter.Release()
+		}
+	}
 
-	// 3.a Variable
-	seenKeys := make(map[string]any)
-	uniqueKVs := make(map[string][]byte)
-	idx := 1
-	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
-
+	// 3. Merge, versions of a key are adjacent and newest first
+	var lastKey []byte
 	for mh.Len() > 0 {
 		smallestIter := heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]])
 		item := smallestIter.Item()
@@ -60,57 +226,207 @@ func (io *IO) Scan(startKey string, count int, snapshotTs time.Time) []entry.Pai
 			smallestIter.Release()
 		}
 
-		// 3.b scan logic
-		if idx > count {
+		userKey := entry.ParseKey(item.Key)
+		if bounds.Past(userKey) {
 			break
 		}
 		// ItemTs <= snapshotTs
-		itemTs := entry.ParseTs(item.Key)
-		lessThanOrEqualToSnapshotTs := itemTs <= snapshotTsNano
-
-		if lessThanOrEqualToSnapshotTs {
-			strKey := string(entry.ParseKey(item.Key))
-			if _, seen := seenKeys[strKey]; !seen {
-				seenKeys[strKey] = true
-				if item.Val != nil {
-					uniqueKVs[strKey] = item.Val
-					idx++
-				}
-			}
+		if entry.ParseTs(item.Key) > snapshotTsNano {
+			continue
+		}
+		if lastKey != nil && bytes.Equal(userKey, lastKey) {
+			continue
+		}
+		lastKey = userKey
+		if !fn(item.Key, item.Val) {
+			break
 		}
 	}
 
 	for mh.Len() > 0 {
 		heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]]).Release()
 	}
+}
 
-	// 4. Range Scan delegation
-	return entry.MapToArray(uniqueKVs)
+// descendVisible is ascendVisible in descending key order, on the keys at or before
+// startKey.
+func (io *IO) descendVisible(startKey string, snapshotTs time.Time, bounds entry.Bounds, fn func(key, val []byte) bool) {
+	snapshotTsNano := timestamp.ToUnit64(snapshotTs)
+	last := bounds.Last(startKey)
+
+	//1. Init Heap
+	mh := &MaxHeap{}
+	heap.Init(mh)
+
+	// 2. Fetch all iterators and add to PQ. Copying a tree waits for its readers, such
+	// as a compaction, so it is done out of io's lock.
+	io.Lock()
+	files := append([]*file{}, io.files...)
+	io.Unlock()
+	for _, f := range files {
+		iter := f.tree.Copy().Iter()
+		if seekLast(&iter, last) {
+			heap.Push(mh, &iter)
+		} else {
+			iter.Release()
+		}
+	}
+
+	// 3. Merge, versions of a key are adjacent and oldest first, so a key is known once
+	// the next one is reached
+	var lastKey, lastVal []byte
+	for mh.Len() > 0 {
+		largestIter := heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]])
+		item := largestIter.Item()
+		if largestIter.Prev() {
+			heap.Push(mh, largestIter)
+		} else {
+			largestIter.Release()
+		}
+
+		userKey := entry.ParseKey(item.Key)
+		if bounds.Past(userKey) {
+			break
+		}
+		// ItemTs <= snapshotTs
+		if entry.ParseTs(item.Key) > snapshotTsNano {
+			continue
+		}
+		if lastKey != nil && !bytes.Equal(userKey, entry.ParseKey(lastKey)) && !fn(lastKey, lastVal) {
+			lastKey = nil
+			break
+		}
+		lastKey, lastVal = item.Key, item.Val
+	}
+	if lastKey != nil {
+		fn(lastKey, lastVal)
+	}
+
+	for mh.Len() > 0 {
+		heap.Pop(mh).(*btree.IterG[entry.Pair[[]byte, []byte]]).Release()
+	}
 }
 
-func (io *IO) Create(records []entry.Pair[string, []byte]) error {
-	newFile := btree.NewBTreeG(func(a, b entry.Pair[[]byte, []byte]) bool {
-		return entry.CompareKeys(a.Key, b.Key) < 0
-	})
+// seekLast moves iter to the last item at or before start, the last item if start is
+// nil, and reports whether there is one.
+func seekLast(iter *btree.IterG[entry.Pair[[]byte, []byte]], start []byte) bool {
+	if start == nil || !iter.Seek(entry.Pair[[]byte, []byte]{Key: start}) {
+		return iter.Last()
+	}
+	if entry.CompareKeys(iter.Item().Key, start) > 0 {
+		return iter.Prev()
+	}
+	return true
+}
+
+func (io *IO) Create(records []entry.Pair[[]byte, []byte], tombstones []entry.RangeTombstone, flushedSeq uint64) error {
+	if len(records) == 0 && len(tombstones) == 0 {
+		return nil
+	}
+
+	w := io.newFileWriter(0)
 	for _, record := range records {
-		internalKey := entry.KeyWithTs([]byte(record.Key), timestamp.Now())
-		newFile.Set(entry.Pair[[]byte, []byte]{
-			Key: internalKey,
-			Val: record.Val,
-		})
+		_ = w.Add(record.Key, record.Val)
+	}
+	for _, t := range tombstones {
+		_ = w.AddRangeTombstone(t)
 	}
+	_ = w.Finish()
+
 	io.Lock()
-	io.files = append(io.files, newFile)
+	io.files = append(io.files, w.f)
+	if flushedSeq > io.flushedSeq {
+		io.flushedSeq = flushedSeq
+	}
 	io.Unlock()
 	return nil
 }
 
+func (io *IO) FlushedSeq() uint64 {
+	io.Lock()
+	defer io.Unlock()
+	return io.flushedSeq
+}
+
+// Compact runs one compaction picked by the policy, and reports whether there was
+// anything to compact. Versions shadowed at oldestSnapshotTs are dropped.
+func (io *IO) Compact(oldestSnapshotTs time.Time) (bool, error) {
+	if io.opts.Compaction == nil {
+		return false, nil
+	}
+	io.compactMu.Lock()
+	defer io.compactMu.Unlock()
+
+	// 1. Pick
+	io.Lock()
+	infos := make([]compaction.FileInfo, len(io.files))
+	byID := make(map[uint64]*file, len(io.files))
+	for i, f := range io.files {
+		infos[i] = f.info
+		byID[f.info.ID] = f
+	}
+	io.Unlock()
+
+	task := io.opts.Compaction.Pick(infos)
+	if task == nil {
+		return false, nil
+	}
+
+	// 2. Merge copies of the inputs, whose iterators are released before the swap
+	iters := make([]compaction.Iterator, len(task.Inputs))
+	var tombstones []entry.RangeTombstone
+	for i, input := range task.Inputs {
+		iters[i] = newFileIterator(byID[input.ID])
+		tombstones = append(tombstones, byID[input.ID].rangeTombstones...)
+	}
+	var outputs []*file
+	err := compaction.Run(task, iters, tombstones, timestamp.ToUnit64(oldestSnapshotTs), func() (compaction.Writer, error) {
+		w := io.newFileWriter(task.OutputLevel)
+		outputs = append(outputs, w.f)
+		return w, nil
+	})
+	for _, iter := range iters {
+		iter.(*fileIterator).Release()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// 3. Swap the inputs for the outputs
+	io.Lock()
+	files := make([]*file, 0, len(io.files)-len(task.Inputs)+len(outputs))
+	for _, f := range io.files {
+		if !task.IsInput(f.info.ID) {
+			files = append(files, f)
+		}
+	}
+	io.files = append(files, outputs...)
+	io.Unlock()
+	return true, nil
+}
+
+// Close drops every file, mem_btree files never outlive the IO.
+func (io *IO) Close() error {
+	io.Destroy()
+	return nil
+}
+
 func (io *IO) Destroy() {
 	io.Lock()
 	io.files = nil
 	io.Unlock()
 }
 
+// BlockCacheStats is always empty, files are not made of blocks.
+func (io *IO) BlockCacheStats() cache.Stats {
+	return cache.Stats{}
+}
+
+// CompressionStats is always empty, files are not compressed.
+func (io *IO) CompressionStats() compress.Stats {
+	return compress.Stats{}
+}
+
 func (io *IO) Name() string {
 	return "mem_btree"
 }
@@ -0,0 +1,124 @@
+package mem_btree
+
+import (
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/sst/compaction"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGet(t *testing.T) {
+	io := NewMBtreeIO(Options{BloomBitsPerKey: 10})
+	assert.Nil(t, io.Create(versions([]entry.Pair[string, []byte]{
+		{Key: "1", Val: []byte("a")},
+		{Key: "2", Val: []byte("b")},
+	}), nil, 0))
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, io.Create(versions([]entry.Pair[string, []byte]{
+		{Key: "2", Val: nil},
+	}), nil, 0))
+
+	assert.Equal(t, []byte("a"), must(io.Get("1", time.Now())))
+	assert.Nil(t, must(io.Get("2", time.Now())))
+	assert.Equal(t, []byte("b"), must(io.Get("2", beforeDelete)))
+	assert.Equal(t, []byte{}, must(io.Get("3", time.Now())))
+	assert.False(t, io.files[0].filter.MayContain([]byte("3")) && io.files[1].filter.MayContain([]byte("3")))
+
+	// reverse scans
+	reverse := entry.Bounds{Reverse: true}
+	assert.Equal(t, []entry.Pair[string, []byte]{{Key: "1", Val: []byte("a")}}, must(io.Scan("", 10, time.Now(), reverse)))
+	assert.Equal(t, []entry.Pair[string, []byte]{{Key: "2", Val: []byte("b")}, {Key: "1", Val: []byte("a")}}, must(io.Scan("", 10, beforeDelete, reverse)))
+	assert.Equal(t, []entry.Pair[string, []byte]{{Key: "1", Val: []byte("a")}}, must(io.Scan("1", 10, beforeDelete, reverse)))
+}
+
+func TestCompact(t *testing.T) {
+	io := NewMBtreeIO(Options{BloomBitsPerKey: 10, Compaction: compaction.DefaultSizeTieredPolicy()})
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, io.Create(versions([]entry.Pair[string, []byte]{
+			{Key: "1", Val: []byte(fmt.Sprintf("a%d", i))},
+			{Key: fmt.Sprintf("k%d", i), Val: []byte("b")},
+		}), nil, 0))
+	}
+	assert.Nil(t, io.Create(versions([]entry.Pair[string, []byte]{{Key: "k0", Val: nil}}), nil, 0))
+	time.Sleep(time.Millisecond)
+
+	compacted, err := io.Compact(time.Now())
+	assert.Nil(t, err)
+	assert.True(t, compacted)
+	// the small file holding the tombstone is in another tier
+	assert.Equal(t, 2, len(io.files))
+	assert.Equal(t, 5, io.files[1].tree.Len())
+
+	assert.Equal(t, []byte("a3"), must(io.Get("1", time.Now())))
+	assert.Nil(t, must(io.Get("k0", time.Now())))
+	assert.Equal(t, 4, len(must(io.Scan("", 10, time.Now(), entry.Bounds{}))))
+
+	compacted, err = io.Compact(time.Now())
+	assert.Nil(t, err)
+	assert.False(t, compacted)
+}
+
+func TestCompactWithScan(t *testing.T) {
+	io := NewMBtreeIO(Options{BloomBitsPerKey: 10, Compaction: compaction.DefaultSizeTieredPolicy()})
+	for i := 0; i < 4; i++ {
+		records := make([]entry.Pair[string, []byte], 50000)
+		for j := range records {
+			records[j] = entry.Pair[string, []byte]{Key: fmt.Sprintf("%d-%06d", i, j), Val: []byte("a")}
+		}
+		assert.Nil(t, io.Create(versions(records), nil, 0))
+	}
+
+	stop := make(chan struct{})
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_, _ = io.Scan("", 10, time.Now(), entry.Bounds{})
+				_, _ = io.Scan("", 10, time.Now(), entry.Bounds{Reverse: true})
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := io.Compact(time.Now())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("compaction blocked by a concurrent scan")
+	}
+	close(stop)
+	<-scanned
+	assert.Equal(t, 1, len(io.files))
+	assert.Equal(t, 10, len(must(io.Scan("", 10, time.Now(), entry.Bounds{}))))
+}
+
+// versions stamps records with the current time, as a flush of fresh writes would.
+func versions(records []entry.Pair[string, []byte]) []entry.Pair[[]byte, []byte] {
+	ts := timestamp.Now()
+	res := make([]entry.Pair[[]byte, []byte], len(records))
+	for i, record := range records {
+		res[i] = entry.Pair[[]byte, []byte]{Key: entry.KeyWithTs([]byte(record.Key), ts), Val: record.Val}
+	}
+	return res
+}
+
+// must unwraps the result of a read that is expected to succeed.
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
@@ -0,0 +1,94 @@
+package mem_btree
+
+import (
+	"bytes"
+	"github.com/dborchard/cometkv/pkg/sst/bloom"
+	"github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/tidwall/btree"
+)
+
+// fileWriter builds a file. Unlike disk.Writer, keys may be added in any order.
+type fileWriter struct {
+	f      *file
+	filter *bloom.Builder
+	// empty is unset once the key range of the file is known.
+	empty bool
+}
+
+func (io *IO) newFileWriter(level int) *fileWriter {
+	io.Lock()
+	id := io.nextID
+	io.nextID++
+	io.Unlock()
+
+	f := &file{
+		tree: btree.NewBTreeG(func(a, b entry.Pair[[]byte, []byte]) bool {
+			return entry.CompareKeys(a.Key, b.Key) < 0
+		}),
+	}
+	f.info.ID = id
+	f.info.Level = level
+	return &fileWriter{f: f, filter: bloom.NewBuilder(io.opts.BloomBitsPerKey), empty: true}
+}
+
+func (w *fileWriter) Add(key, val []byte) error {
+	key = append([]byte{}, key...)
+	if val != nil {
+		val = append([]byte{}, val...)
+	}
+	w.f.tree.Set(entry.Pair[[]byte, []byte]{Key: key, Val: val})
+
+	userKey := entry.ParseKey(key)
+	w.extend(userKey, userKey)
+	w.f.info.Size += uint64(len(key) + len(val))
+	w.filter.Add(userKey)
+	return nil
+}
+
+// AddRangeTombstone adds a range tombstone to the file. Its range counts in the key
+// range of the file, so that compactions see what it overlaps.
+func (w *fileWriter) AddRangeTombstone(t entry.RangeTombstone) error {
+	w.f.rangeTombstones = append(w.f.rangeTombstones, t)
+	w.extend([]byte(t.Start), []byte(t.End))
+	w.f.info.Size += uint64(len(t.Start) + len(t.End) + 8)
+	return nil
+}
+
+func (w *fileWriter) extend(smallest, largest []byte) {
+	info := &w.f.info
+	if w.empty || bytes.Compare(smallest, info.Smallest) < 0 {
+		info.Smallest = smallest
+	}
+	if w.empty || bytes.Compare(largest, info.Largest) > 0 {
+		info.Largest = largest
+	}
+	w.empty = false
+}
+
+func (w *fileWriter) EstimatedSize() uint64 {
+	return w.f.info.Size
+}
+
+func (w *fileWriter) Finish() error {
+	w.f.filter = w.filter.Build()
+	return nil
+}
+
+// fileIterator adapts a btree iterator to compaction.Iterator. It iterates over a copy
+// of the file, so that it holds no lock of the file's tree.
+type fileIterator struct {
+	iter  btree.IterG[entry.Pair[[]byte, []byte]]
+	valid bool
+}
+
+func newFileIterator(f *file) *fileIterator {
+	it := &fileIterator{iter: f.tree.Copy().Iter()}
+	it.valid = it.iter.First()
+	return it
+}
+
+func (it *fileIterator) Valid() bool   { return it.valid }
+func (it *fileIterator) Key() []byte   { return it.iter.Item().Key }
+func (it *fileIterator) Value() []byte { return it.iter.Item().Val }
+func (it *fileIterator) Next()         { it.valid = it.iter.Next() }
+func (it *fileIterator) Release()      { it.iter.Release() }
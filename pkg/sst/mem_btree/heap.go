@@ -31,3 +31,26 @@ func (m *MinHeap) Pop() interface{} {
 	*m = old[0 : n-1]
 	return x
 }
+
+// MaxHeap orders iterators walking backwards, largest key first. Only iterators at an
+// item are expected.
+type MaxHeap []*btree.IterG[entry.Pair[[]byte, []byte]]
+
+func (m *MaxHeap) Len() int { return len(*m) }
+func (m *MaxHeap) Less(i, j int) bool {
+	return entry.CompareKeys((*m)[i].Item().Key, (*m)[j].Item().Key) > 0
+}
+func (m *MaxHeap) Swap(i, j int) { (*m)[i], (*m)[j] = (*m)[j], (*m)[i] }
+
+func (m *MaxHeap) Push(x interface{}) {
+	*m = append(*m, x.(*btree.IterG[entry.Pair[[]byte, []byte]]))
+}
+
+func (m *MaxHeap) Pop() interface{} {
+	old := *m
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*m = old[0 : n-1]
+	return x
+}
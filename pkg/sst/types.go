@@ -1,15 +1,53 @@
 package sst
 
 import (
+	"fmt"
+	"github.com/dborchard/cometkv/pkg/sst/cache"
+	"github.com/dborchard/cometkv/pkg/sst/compaction"
+	"github.com/dborchard/cometkv/pkg/sst/compress"
+	"github.com/dborchard/cometkv/pkg/sst/disk"
 	"github.com/dborchard/cometkv/pkg/sst/mem_btree"
 	common "github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/iterator"
 	"time"
 )
 
+// IO stores the flushed memtables. Reads fail, rather than return wrong data, when a
+// file is found damaged.
 type IO interface {
-	Scan(startKey string, count int, snapshotTs time.Time) []common.Pair[string, []byte]
-	Get(key string, snapshotTs time.Time) []byte
-	Create(records []common.Pair[string, []byte]) error
+	// Scan returns the first count live keys at or after startKey at snapshotTs, within
+	// bounds. With bounds.Reverse, it returns the last count keys at or before startKey,
+	// in descending order.
+	Scan(startKey string, count int, snapshotTs time.Time, bounds common.Bounds) ([]common.Pair[string, []byte], error)
+	// ScanVersions is Scan returning tombstones too, with internal keys so that the
+	// version of every row is known.
+	ScanVersions(startKey string, count int, snapshotTs time.Time, bounds common.Bounds) ([]common.Pair[[]byte, []byte], error)
+	// NewIterator iterates over what ScanVersions returns, at snapshotTs. A failed read
+	// ends the iteration with its error.
+	NewIterator(snapshotTs time.Time, bounds common.Bounds) iterator.Iterator
+	// Get returns a nil value if key is deleted, and an empty one if it is missing.
+	Get(key string, snapshotTs time.Time) ([]byte, error)
+	// History returns every version of key at or below snapshotTs kept by the files,
+	// newest first, tombstones included. Range tombstones are not applied.
+	History(key string, snapshotTs time.Time) ([]common.Pair[[]byte, []byte], error)
+	// RangeTombstones returns the range tombstones visible at snapshotTs. Get, Scan and
+	// the iterators already apply them.
+	RangeTombstones(snapshotTs time.Time) []common.RangeTombstone
+	// Create writes records and range tombstones to a new file. Records are keyed by
+	// internal key, so that every version keeps the timestamp it was written at; a nil
+	// value is a tombstone. flushedSeq is the last WAL sequence covered by records, zero
+	// if unknown.
+	Create(records []common.Pair[[]byte, []byte], tombstones []common.RangeTombstone, flushedSeq uint64) error
+	// FlushedSeq returns the highest flushedSeq of the files that survived a restart.
+	FlushedSeq() uint64
+	// Compact runs one compaction, if any is due, and reports whether it did. Versions
+	// shadowed at oldestSnapshotTs are dropped.
+	Compact(oldestSnapshotTs time.Time) (bool, error)
+	// BlockCacheStats returns the hit/miss counters and usage of the block cache.
+	BlockCacheStats() cache.Stats
+	// CompressionStats compares the size of the data before and after compression.
+	CompressionStats() compress.Stats
+	Close() error
 	Destroy()
 
 	//NOTE: SST's are immutable.
@@ -18,18 +56,93 @@ type IO interface {
 }
 
 var _ IO = new(mem_btree.IO)
+var _ IO = new(disk.IO)
 
 type Type int
 
 const (
 	MBtree Type = iota
+	Disk
 )
 
+// IsPersistent reports whether the files of this type survive a restart.
+func (t Type) IsPersistent() bool {
+	// mem_btree files never outlive the process.
+	return t != MBtree
+}
+
+// Options configures the files of an IO.
+type Options struct {
+	// BlockSize is the target size of a data block. Only used by Disk.
+	BlockSize int
+	// BloomBitsPerKey sizes the bloom filter built for every file. Zero disables it.
+	BloomBitsPerKey int
+	CompactionStyle compaction.Style
+	// BlockCacheSize is the byte capacity of the block cache shared by the files of
+	// the IO. Zero disables it. Only used by Disk.
+	BlockCacheSize int64
+	// PinIndexAndFilter keeps index and filter blocks out of the block cache, always
+	// in memory. Only used by Disk.
+	PinIndexAndFilter bool
+	// Compression is the codec of the blocks of new files: compress.None, compress.LZ,
+	// compress.Zstd or compress.Flate. Only used by Disk.
+	Compression compress.Codec
+}
+
+func DefaultOptions() Options {
+	return Options{
+		BlockSize:         disk.DefaultOptions().BlockSize,
+		BloomBitsPerKey:   10,
+		CompactionStyle:   compaction.Leveled,
+		BlockCacheSize:    disk.DefaultBlockCacheSize,
+		PinIndexAndFilter: true,
+		Compression:       compress.LZ,
+	}
+}
+
+func (o Options) diskOptions() disk.Options {
+	return disk.Options{
+		BlockSize:         o.BlockSize,
+		BloomBitsPerKey:   o.BloomBitsPerKey,
+		Compaction:        compaction.NewPolicy(o.CompactionStyle),
+		BlockCache:        cache.New(o.BlockCacheSize),
+		PinIndexAndFilter: o.PinIndexAndFilter,
+		Compression:       o.Compression,
+	}
+}
+
+func (o Options) mBtreeOptions() mem_btree.Options {
+	return mem_btree.Options{
+		BloomBitsPerKey: o.BloomBitsPerKey,
+		Compaction:      compaction.NewPolicy(o.CompactionStyle),
+	}
+}
+
 func NewSstIO(t Type) IO {
+	opts := DefaultOptions()
 	switch t {
 	case MBtree:
-		return mem_btree.NewMBtreeIO()
+		return mem_btree.NewMBtreeIO(opts.mBtreeOptions())
+	case Disk:
+		return disk.NewDiskIO(opts.diskOptions())
 	default:
 		panic("unknown disk_io type")
 	}
 }
+
+// OpenSstIO reloads the SSTs persisted under dir.
+func OpenSstIO(t Type, dir string, opts Options) (IO, error) {
+	switch t {
+	case MBtree:
+		// mem_btree files never outlive the process.
+		return mem_btree.NewMBtreeIO(opts.mBtreeOptions()), nil
+	case Disk:
+		io, err := disk.OpenDiskIO(dir, opts.diskOptions())
+		if err != nil {
+			return nil, err
+		}
+		return io, nil
+	default:
+		return nil, fmt.Errorf("unknown disk_io type %d", t)
+	}
+}
@@ -0,0 +1,84 @@
+package entry
+
+import (
+	"bytes"
+	"math"
+	"strings"
+)
+
+// Bounds limits a scan to the keys below EndKey, exclusive, that start with Prefix. An
+// empty EndKey or Prefix does not limit it.
+type Bounds struct {
+	EndKey string
+	Prefix string
+	// Reverse scans in descending key order, from the keys at or before the start key.
+	// An empty start key starts at the last key.
+	Reverse bool
+}
+
+// Start returns the first key of the forward scan starting at startKey.
+func (b Bounds) Start(startKey string) string {
+	if b.Prefix > startKey {
+		return b.Prefix
+	}
+	return startKey
+}
+
+// Last returns the internal key the reverse scan starting at startKey descends from,
+// the oldest version of its last key. It is nil when the scan starts at the last key.
+func (b Bounds) Last(startKey string) []byte {
+	var last []byte
+	if startKey != "" {
+		last = KeyWithTs([]byte(startKey), 0)
+	}
+	// the newest version of a key sorts before all the versions of the keys below it
+	for _, end := range []string{b.EndKey, prefixEnd(b.Prefix)} {
+		if end == "" {
+			continue
+		}
+		if key := KeyWithTs([]byte(end), math.MaxUint64); last == nil || CompareKeys(key, last) < 0 {
+			last = key
+		}
+	}
+	return last
+}
+
+// Past reports whether the user key, and every key after it in the order of the scan,
+// is out of the bounds. Keys before the Start, or after the Last, of the scan are not
+// expected.
+func (b Bounds) Past(key []byte) bool {
+	if b.Reverse {
+		return b.Prefix != "" && string(key) < b.Prefix
+	}
+	if b.EndKey != "" && string(key) >= b.EndKey {
+		return true
+	}
+	return b.Prefix != "" && !bytes.HasPrefix(key, []byte(b.Prefix)) && string(key) > b.Prefix
+}
+
+// End returns the exclusive end of the keys within the bounds, empty if there is none.
+func (b Bounds) End() string {
+	end := prefixEnd(b.Prefix)
+	if b.EndKey != "" && (end == "" || b.EndKey < end) {
+		end = b.EndKey
+	}
+	return end
+}
+
+// Contains reports whether the user key is within the bounds.
+func (b Bounds) Contains(key string) bool {
+	return (b.EndKey == "" || key < b.EndKey) && strings.HasPrefix(key, b.Prefix)
+}
+
+// prefixEnd returns the smallest key after all the keys starting with prefix, empty if
+// there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
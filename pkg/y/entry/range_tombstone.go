@@ -0,0 +1,44 @@
+package entry
+
+// RangeTombstone deletes the versions of the keys in [Start, End) written before Ts.
+// Versions written at Ts, in the same batch, are not deleted.
+type RangeTombstone struct {
+	Start string
+	End   string
+	Ts    uint64
+}
+
+// Covers reports whether the tombstone deletes the version of key written at ts.
+func (t RangeTombstone) Covers(key []byte, ts uint64) bool {
+	return ts < t.Ts && string(key) >= t.Start && string(key) < t.End
+}
+
+// Overlaps reports whether the tombstone deletes a key of [start, end). An empty end
+// does not limit the range.
+func (t RangeTombstone) Overlaps(start, end string) bool {
+	return t.Start < t.End && (end == "" || t.Start < end) && start < t.End
+}
+
+// CoveringTs returns the ts of the newest of tombstones visible at snapshotTs that
+// deletes the version of key written at ts.
+func CoveringTs(tombstones []RangeTombstone, key []byte, ts, snapshotTs uint64) (uint64, bool) {
+	var res uint64
+	found := false
+	for _, t := range tombstones {
+		if t.Ts <= snapshotTs && t.Covers(key, ts) && (!found || t.Ts > res) {
+			res, found = t.Ts, true
+		}
+	}
+	return res, found
+}
+
+// VisibleTombstones returns the tombstones visible at snapshotTs.
+func VisibleTombstones(tombstones []RangeTombstone, snapshotTs uint64) []RangeTombstone {
+	var res []RangeTombstone
+	for _, t := range tombstones {
+		if t.Ts <= snapshotTs {
+			res = append(res, t)
+		}
+	}
+	return res
+}
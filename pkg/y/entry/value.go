@@ -0,0 +1,39 @@
+package entry
+
+import "encoding/binary"
+
+// Value meta bytes, stored in front of every value written through the KV.
+const (
+	valuePlain byte = iota
+	valueExpiring
+)
+
+// EncodeValue prefixes val with its meta: | meta(1) | expiresAt(8), if any | val |.
+// An expiresAt of 0 never expires. A nil val, a tombstone, stays nil.
+func EncodeValue(val []byte, expiresAt uint64) []byte {
+	if val == nil {
+		return nil
+	}
+	if expiresAt == 0 {
+		out := make([]byte, 1+len(val))
+		out[0] = valuePlain
+		copy(out[1:], val)
+		return out
+	}
+	out := make([]byte, 9+len(val))
+	out[0] = valueExpiring
+	binary.BigEndian.PutUint64(out[1:], expiresAt)
+	copy(out[9:], val)
+	return out
+}
+
+// DecodeValue returns the value encoded by EncodeValue and its expiry.
+func DecodeValue(enc []byte) (val []byte, expiresAt uint64) {
+	if len(enc) >= 9 && enc[0] == valueExpiring {
+		return enc[9:], binary.BigEndian.Uint64(enc[1:9])
+	}
+	if len(enc) >= 1 {
+		return enc[1:], 0
+	}
+	return enc, 0
+}
@@ -0,0 +1,107 @@
+package iterator
+
+import "github.com/dborchard/cometkv/pkg/y/entry"
+
+// DefaultPageSize is the number of rows a Paged iterator reads at a time.
+const DefaultPageSize = 256
+
+// Iterator walks keys in ascending order, at the snapshot it was created at. Reverse
+// iterators walk them in descending order.
+type Iterator interface {
+	// Seek moves to the first key at or after key, at or before it for a reverse
+	// iterator. An iterator is not valid until the first Seek.
+	Seek(key string)
+	Next()
+	// Valid reports whether the iterator is at a key. It is false at the end, and after
+	// an error.
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	// Err returns the error that ended the iteration, if any.
+	Err() error
+	// Close releases the iterator and returns Err.
+	Close() error
+}
+
+// Paged iterates over the rows returned by scan, keyed by internal key, reading
+// pageSize of them at a time. Only the newest version of a key is expected.
+type Paged struct {
+	scan      func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error)
+	pageSize  int
+	reverse   bool
+	page      []entry.Pair[[]byte, []byte]
+	pos       int
+	exhausted bool
+	err       error
+}
+
+var _ Iterator = new(Paged)
+
+func NewPaged(pageSize int, scan func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error)) *Paged {
+	if pageSize <= 0 {
+		panic("page size must be positive")
+	}
+	return &Paged{scan: scan, pageSize: pageSize}
+}
+
+// NewReversePaged is NewPaged for a scan returning keys at or before its start key, in
+// descending order.
+func NewReversePaged(pageSize int, scan func(startKey string, count int) ([]entry.Pair[[]byte, []byte], error)) *Paged {
+	p := NewPaged(pageSize, scan)
+	p.reverse = true
+	return p
+}
+
+func (p *Paged) Seek(key string) {
+	p.seek(key, p.pageSize)
+}
+
+func (p *Paged) seek(key string, count int) {
+	if p.err != nil {
+		return
+	}
+	p.page, p.err = p.scan(key, count)
+	p.pos = 0
+	p.exhausted = p.err != nil || len(p.page) < count
+}
+
+func (p *Paged) Next() {
+	p.pos++
+	if p.pos < len(p.page) || p.exhausted {
+		return
+	}
+	lastKey := string(entry.ParseKey(p.page[len(p.page)-1].Key))
+	if !p.reverse {
+		// the smallest key after the last one of the page
+		p.Seek(lastKey + "\x00")
+		return
+	}
+	// there is no largest key before the last one of the page, so it is read again
+	p.seek(lastKey, p.pageSize+1)
+	if p.Valid() && string(entry.ParseKey(p.Key())) == lastKey {
+		p.pos++
+	}
+}
+
+func (p *Paged) Valid() bool {
+	return p.err == nil && p.pos < len(p.page)
+}
+
+// Key returns the internal key of the row.
+func (p *Paged) Key() []byte {
+	return p.page[p.pos].Key
+}
+
+// Value returns the value of the row, nil for a tombstone.
+func (p *Paged) Value() []byte {
+	return p.page[p.pos].Val
+}
+
+func (p *Paged) Err() error {
+	return p.err
+}
+
+func (p *Paged) Close() error {
+	p.page = nil
+	return p.err
+}
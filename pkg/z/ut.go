@@ -3,6 +3,8 @@ package tests
 import (
 	"fmt"
 	memtable "github.com/dborchard/cometkv/pkg/memtable"
+	common "github.com/dborchard/cometkv/pkg/y/entry"
+	"github.com/dborchard/cometkv/pkg/y/timestamp"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -345,3 +347,185 @@ func Test11(
 
 	tbl.Close()
 }
+
+// Test12 Version expiring before the TTL. Verify the GC reclaims it
+func Test12(
+	newTable func(gcInterval, ttl time.Duration) memtable.IMemtable,
+	t *testing.T,
+) {
+	tbl := newTable(1*time.Second, 60*time.Second)
+
+	ts := timestamp.Now()
+	tbl.PutWithTs("1", []byte("a"), ts)
+	tbl.PutWithTs("2", []byte("b"), ts)
+	tbl.ExpireAt("1", ts, ts+uint64(100*time.Millisecond))
+
+	assert.Equal(t, []byte("a"), tbl.Get("1", time.Now()))
+	time.Sleep(2500 * time.Millisecond)
+
+	// the value is dropped, the version stays as a tombstone
+	assert.Equal(t, []byte(nil), tbl.Get("1", time.Now()))
+	assert.Equal(t, []byte("b"), tbl.Get("2", time.Now()))
+	rows := tbl.Scan("1", 2, memtable.ScanOptions{SnapshotTs: time.Now()})
+	assert.Equal(t, 1, len(rows))
+	assert.Equal(t, "2", rows[0].Key)
+
+	tbl.Close()
+}
+
+// Test13 Iterate over many keys, a page at a time, at a snapshot
+func Test13(
+	newTable func(gcInterval, ttl time.Duration) memtable.IMemtable,
+	t *testing.T,
+) {
+	tbl := newTable(15*time.Second, 60*time.Second)
+
+	for i := 0; i < 1000; i++ {
+		tbl.Put(fmt.Sprintf("%04d", i), []byte("a"))
+	}
+	snapshot := time.Now()
+	time.Sleep(time.Millisecond)
+	tbl.Delete("0500")
+
+	it := tbl.NewIterator(memtable.ScanOptions{SnapshotTs: snapshot})
+	count := 0
+	for it.Seek("0100"); it.Valid(); it.Next() {
+		count++
+	}
+	assert.Nil(t, it.Close())
+	assert.Equal(t, 900, count)
+
+	// tombstones are returned
+	it = tbl.NewIterator(memtable.ScanOptions{SnapshotTs: time.Now()})
+	it.Seek("0500")
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte(nil), it.Value())
+	assert.Nil(t, it.Close())
+
+	tbl.Close()
+}
+
+// Test14 Scan bounded by an end key and a prefix
+func Test14(
+	newTable func(gcInterval, ttl time.Duration) memtable.IMemtable,
+	t *testing.T,
+) {
+	tbl := newTable(15*time.Second, 60*time.Second)
+
+	tbl.Put("user:1/a", []byte("a"))
+	tbl.Put("user:1/b", []byte("b"))
+	tbl.Put("user:2/a", []byte("c"))
+	tbl.Put("user:3/a", []byte("d"))
+
+	rows := tbl.Scan("", 10, memtable.ScanOptions{SnapshotTs: time.Now(), Bounds: common.Bounds{Prefix: "user:1/"}})
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "user:1/b", rows[1].Key)
+
+	rows = tbl.Scan("user:1/b", 10, memtable.ScanOptions{SnapshotTs: time.Now(), Bounds: common.Bounds{EndKey: "user:3"}})
+	assert.Equal(t, 2, len(rows))
+	assert.Equal(t, "user:2/a", rows[1].Key)
+
+	assert.Equal(t, 0, len(tbl.ScanVersions("", 10, memtable.ScanOptions{SnapshotTs: time.Now(), Bounds: common.Bounds{Prefix: "user:4/"}})))
+
+	tbl.Close()
+}
+
+// Test15 Reverse Scan and Iterator
+func Test15(
+	newTable func(gcInterval, ttl time.Duration) memtable.IMemtable,
+	t *testing.T,
+) {
+	tbl := newTable(15*time.Second, 60*time.Second)
+
+	for i := 0; i < 300; i++ {
+		tbl.Put(fmt.Sprintf("%03d", i), []byte("old"))
+	}
+	time.Sleep(time.Millisecond)
+	beforeUpdate := time.Now()
+	time.Sleep(time.Millisecond)
+	tbl.Put("299", []byte("new"))
+	tbl.Delete("298")
+
+	reverse := func(snapshotTs time.Time, bounds common.Bounds) memtable.ScanOptions {
+		bounds.Reverse = true
+		return memtable.ScanOptions{SnapshotTs: snapshotTs, Bounds: bounds}
+	}
+
+	// newest version first, deleted keys skipped
+	rows := tbl.Scan("", 3, reverse(time.Now(), common.Bounds{}))
+	assert.Equal(t, []common.Pair[string, []byte]{
+		{Key: "299", Val: []byte("new")},
+		{Key: "297", Val: []byte("old")},
+		{Key: "296", Val: []byte("old")},
+	}, rows)
+
+	rows = tbl.Scan("", 2, reverse(beforeUpdate, common.Bounds{}))
+	assert.Equal(t, []common.Pair[string, []byte]{
+		{Key: "299", Val: []byte("old")},
+		{Key: "298", Val: []byte("old")},
+	}, rows)
+
+	rows = tbl.Scan("150", 2, reverse(time.Now(), common.Bounds{}))
+	assert.Equal(t, "150", rows[0].Key)
+	assert.Equal(t, "149", rows[1].Key)
+
+	// bounded
+	rows = tbl.Scan("", 100, reverse(time.Now(), common.Bounds{Prefix: "01"}))
+	assert.Equal(t, 10, len(rows))
+	assert.Equal(t, "019", rows[0].Key)
+	assert.Equal(t, 5, len(tbl.Scan("", 100, reverse(time.Now(), common.Bounds{EndKey: "005"}))))
+
+	// across pages, tombstones included
+	it := tbl.NewIterator(reverse(time.Now(), common.Bounds{}))
+	var keys []string
+	for it.Seek(""); it.Valid(); it.Next() {
+		keys = append(keys, string(common.ParseKey(it.Key())))
+	}
+	assert.Nil(t, it.Close())
+	assert.Equal(t, 300, len(keys))
+	assert.Equal(t, "299", keys[0])
+	assert.Equal(t, "000", keys[299])
+
+	tbl.Close()
+}
+
+// Test16 DeleteRange hides the older versions of a range from Get, Scan and Iterator
+func Test16(
+	newTable func(gcInterval, ttl time.Duration) memtable.IMemtable,
+	t *testing.T,
+) {
+	tbl := newTable(15*time.Second, 60*time.Second)
+
+	for i := 0; i < 10; i++ {
+		tbl.Put(fmt.Sprintf("%03d", i), []byte("old"))
+	}
+	time.Sleep(time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(time.Millisecond)
+	tbl.DeleteRange("003", "007", timestamp.Now())
+	time.Sleep(time.Millisecond)
+	tbl.Put("005", []byte("new"))
+
+	rows := tbl.Scan("", 10, memtable.ScanOptions{SnapshotTs: time.Now()})
+	assert.Equal(t, 7, len(rows))
+	assert.Equal(t, common.Pair[string, []byte]{Key: "005", Val: []byte("new")}, rows[3])
+	assert.Equal(t, "007", rows[4].Key)
+	assert.Equal(t, []byte(nil), tbl.Get("004", time.Now()))
+	assert.Equal(t, []byte("new"), tbl.Get("005", time.Now()))
+	assert.Equal(t, 10, len(tbl.Scan("", 10, memtable.ScanOptions{SnapshotTs: beforeDelete})))
+	assert.Equal(t, []byte("old"), tbl.Get("004", beforeDelete))
+
+	// reverse, covered versions walked as tombstones
+	rows = tbl.Scan("", 3, memtable.ScanOptions{SnapshotTs: time.Now(), Bounds: common.Bounds{EndKey: "007", Reverse: true}})
+	assert.Equal(t, []string{"005", "002", "001"}, []string{rows[0].Key, rows[1].Key, rows[2].Key})
+	it := tbl.NewIterator(memtable.ScanOptions{SnapshotTs: time.Now()})
+	it.Seek("003")
+	assert.True(t, it.Valid())
+	assert.Equal(t, []byte(nil), it.Value())
+	assert.Nil(t, it.Close())
+
+	assert.Equal(t, 1, len(tbl.RangeTombstones(time.Now())))
+	assert.Equal(t, 0, len(tbl.RangeTombstones(beforeDelete)))
+
+	tbl.Close()
+}